@@ -0,0 +1,433 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// Alert rule kinds
+const (
+    AlertDown = "down" // threshold is the number of failed probes in a row
+    AlertLoss = "loss" // threshold is the packet loss in percent
+    AlertP95  = "p95"  // threshold is the p95 round-trip time in milliseconds
+)
+
+// Alert states sent to webhooks
+const (
+    AlertFiring   = "firing"
+    AlertResolved = "resolved"
+)
+
+// Webhook delivery defaults
+const (
+    DefaultWebhookTimeout     = 10 * time.Second
+    DefaultWebhookMaxAttempts = 5
+    DefaultWebhookBackoff     = time.Second
+    maxWebhookBackoff         = time.Minute
+    webhookQueueSize          = 100
+)
+
+// Headers of webhook deliveries, the signature is the hex HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the webhook secret
+const (
+    SignatureHeader = "X-Espresso-Signature"
+    TimestampHeader = "X-Espresso-Timestamp"
+)
+
+// AlertsConfig struct for alert rules and the webhooks they notify
+type AlertsConfig struct {
+    Webhooks []WebhookConfig `json:"webhooks"`
+    Rules    []AlertRule     `json:"rules"`
+}
+
+// WebhookConfig struct for an alert destination
+type WebhookConfig struct {
+    Name        string   `json:"name"`
+    URL         string   `json:"url"`
+    Secret      string   `json:"secret,omitempty"`
+    Timeout     Duration `json:"timeout,omitempty"`
+    MaxAttempts int      `json:"max_attempts,omitempty"`
+    Backoff     Duration `json:"backoff,omitempty"`
+}
+
+// withDefaults fills in the delivery settings that were not set
+func (w WebhookConfig) withDefaults() WebhookConfig {
+    if w.Timeout == 0 {
+        w.Timeout = Duration(DefaultWebhookTimeout)
+    }
+    if w.MaxAttempts == 0 {
+        w.MaxAttempts = DefaultWebhookMaxAttempts
+    }
+    if w.Backoff == 0 {
+        w.Backoff = Duration(DefaultWebhookBackoff)
+    }
+    return w
+}
+
+// AlertRule struct for a condition on the statistics of monitors
+//
+// The rule fires once the condition held for For probes in a row and
+// resolves once the value stayed at or below ResolveThreshold for For
+// probes in a row, so an alert does not flap around its threshold.
+type AlertRule struct {
+    Name             string   `json:"name"`
+    Kind             string   `json:"kind"`
+    Monitors         []string `json:"monitors,omitempty"` // all monitors when empty
+    Threshold        float64  `json:"threshold"`
+    ResolveThreshold *float64 `json:"resolve_threshold,omitempty"`
+    For              int      `json:"for,omitempty"`
+    Webhooks         []string `json:"webhooks,omitempty"` // all webhooks when empty
+}
+
+// value returns what the rule compares against its thresholds
+func (r AlertRule) value(status MonitorStatus) float64 {
+    switch r.Kind {
+    case AlertDown:
+        return float64(status.ConsecutiveFailures)
+    case AlertLoss:
+        return status.PacketLoss
+    default:
+        return float64(status.P95Rtt) / float64(time.Millisecond)
+    }
+}
+
+// breached reports whether value meets the firing condition
+func (r AlertRule) breached(value float64) bool {
+    if r.Kind == AlertDown {
+        return value >= r.Threshold
+    }
+    return value > r.Threshold
+}
+
+// cleared reports whether value meets the resolving condition
+func (r AlertRule) cleared(value float64) bool {
+    if r.ResolveThreshold != nil {
+        return value <= *r.ResolveThreshold
+    }
+    if r.Kind == AlertDown {
+        return value == 0
+    }
+    return value <= r.Threshold
+}
+
+// probes returns how many probes in a row a change of state needs
+func (r AlertRule) probes() int {
+    if r.For > 0 {
+        return r.For
+    }
+    return 1
+}
+
+// Validate checks the rules refer to known monitors and webhooks
+func (a AlertsConfig) Validate(monitors []MonitorConfig) error {
+    webhooks := make(map[string]bool)
+    for _, w := range a.Webhooks {
+        if w.Name == "" {
+            return errors.New("webhook name is required")
+        }
+        if webhooks[w.Name] {
+            return fmt.Errorf("duplicate webhook %q", w.Name)
+        }
+        webhooks[w.Name] = true
+        u, err := url.Parse(w.URL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return fmt.Errorf("webhook %s: url must be an http or https URL", w.Name)
+        }
+        if w.Timeout < 0 || w.MaxAttempts < 0 || w.Backoff < 0 {
+            return fmt.Errorf("webhook %s: timeout, max_attempts and backoff must not be negative", w.Name)
+        }
+    }
+
+    known := make(map[string]bool)
+    for _, m := range monitors {
+        known[m.Name] = true
+    }
+    names := make(map[string]bool)
+    for _, r := range a.Rules {
+        if r.Name == "" {
+            return errors.New("rule name is required")
+        }
+        if names[r.Name] {
+            return fmt.Errorf("duplicate rule %q", r.Name)
+        }
+        names[r.Name] = true
+        if r.Kind != AlertDown && r.Kind != AlertLoss && r.Kind != AlertP95 {
+            return fmt.Errorf("rule %s: kind must be %s, %s or %s", r.Name, AlertDown, AlertLoss, AlertP95)
+        }
+        if r.Threshold <= 0 || (r.Kind == AlertLoss && r.Threshold > 100) {
+            return fmt.Errorf("rule %s: threshold out of range", r.Name)
+        }
+        if r.ResolveThreshold != nil && (*r.ResolveThreshold < 0 || *r.ResolveThreshold > r.Threshold) {
+            return fmt.Errorf("rule %s: resolve_threshold must be between 0 and threshold", r.Name)
+        }
+        if r.For < 0 {
+            return fmt.Errorf("rule %s: for must not be negative", r.Name)
+        }
+        for _, name := range r.Monitors {
+            if !known[name] {
+                return fmt.Errorf("rule %s: unknown monitor %q", r.Name, name)
+            }
+        }
+        for _, name := range r.Webhooks {
+            if !webhooks[name] {
+                return fmt.Errorf("rule %s: unknown webhook %q", r.Name, name)
+            }
+        }
+    }
+    return nil
+}
+
+// AlertEvent struct for the JSON body sent to webhooks
+type AlertEvent struct {
+    Rule      string        `json:"rule"`
+    Kind      string        `json:"kind"`
+    State     string        `json:"state"`
+    Monitor   string        `json:"monitor"`
+    Target    string        `json:"target"`
+    Value     float64       `json:"value"`
+    Threshold float64       `json:"threshold"`
+    StartedAt time.Time     `json:"started_at"`
+    At        time.Time     `json:"at"`
+    Status    MonitorStatus `json:"status"`
+}
+
+// alertState struct for one rule on one monitor
+type alertState struct {
+    firing    bool
+    streak    int // probes in a row moving towards the other state
+    startedAt time.Time
+}
+
+// Alerter struct for evaluating alert rules and delivering their events
+type Alerter struct {
+    rules    []AlertRule
+    webhooks map[string]*webhook
+
+    mu     sync.Mutex
+    states map[string]*alertState // keyed by rule and monitor
+
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+}
+
+// webhook struct for a destination and its delivery queue
+type webhook struct {
+    cfg    WebhookConfig
+    client *http.Client
+    queue  chan []byte
+}
+
+// NewAlerter create an alerter for a validated config and start delivering
+func NewAlerter(cfg AlertsConfig) *Alerter {
+    ctx, cancel := context.WithCancel(context.Background())
+    a := &Alerter{
+        rules:    cfg.Rules,
+        webhooks: make(map[string]*webhook),
+        states:   make(map[string]*alertState),
+        cancel:   cancel,
+    }
+    for _, w := range cfg.Webhooks {
+        w = w.withDefaults()
+        hook := &webhook{
+            cfg:    w,
+            client: &http.Client{Timeout: time.Duration(w.Timeout)},
+            queue:  make(chan []byte, webhookQueueSize),
+        }
+        a.webhooks[w.Name] = hook
+        a.wg.Add(1)
+        go func() {
+            defer a.wg.Done()
+            hook.run(ctx)
+        }()
+    }
+    return a
+}
+
+// Evaluate checks every rule against a monitor's new status
+func (a *Alerter) Evaluate(status MonitorStatus) {
+    for _, rule := range a.rules {
+        if len(rule.Monitors) > 0 && !containsAny(rule.Monitors, []string{status.Name}) {
+            continue
+        }
+        if event, ok := a.transition(rule, status); ok {
+            log.Printf("Alert %s is %s for monitor %s (value %v, threshold %v)\n",
+                rule.Name, event.State, status.Name, event.Value, rule.Threshold)
+            a.notify(rule, event)
+        }
+    }
+}
+
+// transition updates the rule's state for the monitor, returning an event
+// when the alert fires or resolves
+func (a *Alerter) transition(rule AlertRule, status MonitorStatus) (AlertEvent, bool) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    key := rule.Name + "\x00" + status.Name
+    state, ok := a.states[key]
+    if !ok {
+        state = &alertState{}
+        a.states[key] = state
+    }
+
+    value := rule.value(status)
+    moving := rule.breached(value)
+    if state.firing {
+        moving = rule.cleared(value)
+    }
+    if !moving {
+        state.streak = 0
+        return AlertEvent{}, false
+    }
+    state.streak++
+    if state.streak < rule.probes() {
+        return AlertEvent{}, false
+    }
+
+    state.firing = !state.firing
+    state.streak = 0
+    now := status.LastProbe
+    if now.IsZero() {
+        now = time.Now()
+    }
+    event := AlertEvent{
+        Rule:      rule.Name,
+        Kind:      rule.Kind,
+        State:     AlertResolved,
+        Monitor:   status.Name,
+        Target:    status.Target,
+        Value:     value,
+        Threshold: rule.Threshold,
+        StartedAt: state.startedAt,
+        At:        now,
+        Status:    status,
+    }
+    if state.firing {
+        state.startedAt = now
+        event.State = AlertFiring
+        event.StartedAt = now
+    }
+    return event, true
+}
+
+// notify queues event for the rule's webhooks
+func (a *Alerter) notify(rule AlertRule, event AlertEvent) {
+    body, err := json.Marshal(event)
+    if err != nil {
+        log.Printf("Failed to encode alert %s: %v\n", rule.Name, err)
+        return
+    }
+    for name, hook := range a.webhooks {
+        if len(rule.Webhooks) > 0 && !containsAny(rule.Webhooks, []string{name}) {
+            continue
+        }
+        select {
+        case hook.queue <- body:
+        default:
+            log.Printf("Dropped alert %s for webhook %s: queue is full\n", rule.Name, name)
+        }
+    }
+}
+
+// Close stops delivering, queued events that were not sent are dropped
+func (a *Alerter) Close() error {
+    a.cancel()
+    a.wg.Wait()
+    return nil
+}
+
+// run delivers queued events one at a time until ctx is cancelled
+func (w *webhook) run(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case body := <-w.queue:
+            w.deliver(ctx, body)
+        }
+    }
+}
+
+// deliver sends body, retrying with exponential backoff on network
+// errors, 429 and 5xx responses
+func (w *webhook) deliver(ctx context.Context, body []byte) {
+    backoff := time.Duration(w.cfg.Backoff)
+    for attempt := 1; ; attempt++ {
+        err := w.send(ctx, body)
+        if err == nil {
+            return
+        }
+        var permanent permanentError
+        if errors.As(err, &permanent) || attempt >= w.cfg.MaxAttempts {
+            log.Printf("Giving up on webhook %s after %d attempts: %v\n", w.cfg.Name, attempt, err)
+            return
+        }
+        log.Printf("Webhook %s attempt %d failed, retrying in %v: %v\n", w.cfg.Name, attempt, backoff, err)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(backoff):
+        }
+        backoff *= 2
+        if backoff > maxWebhookBackoff {
+            backoff = maxWebhookBackoff
+        }
+    }
+}
+
+// permanentError struct for a delivery that retrying will not fix
+type permanentError struct {
+    err error
+}
+
+func (e permanentError) Error() string {
+    return e.err.Error()
+}
+
+// send makes one signed delivery attempt
+func (w *webhook) send(ctx context.Context, body []byte) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+    if err != nil {
+        return permanentError{err}
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "espresso-commander/"+Version)
+    req.Header.Set(TimestampHeader, timestamp)
+    if w.cfg.Secret != "" {
+        req.Header.Set(SignatureHeader, "sha256="+signWebhook(w.cfg.Secret, timestamp, body))
+    }
+
+    resp, err := w.client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    switch {
+    case resp.StatusCode >= 200 && resp.StatusCode < 300:
+        return nil
+    case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+        return fmt.Errorf("webhook responded %d", resp.StatusCode)
+    default:
+        return permanentError{fmt.Errorf("webhook responded %d", resp.StatusCode)}
+    }
+}
+
+// signWebhook returns the hex HMAC-SHA256 of timestamp, a dot and body
+func signWebhook(secret, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
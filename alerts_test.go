@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStandIn records the deliveries it receives, failing the first
+// failures of them with a 503
+type webhookStandIn struct {
+	t        *testing.T
+	secret   string
+	failures int
+
+	mu       sync.Mutex
+	attempts int
+	events   chan AlertEvent
+}
+
+func newWebhookStandIn(t *testing.T, secret string, failures int) (*webhookStandIn, *httptest.Server) {
+	w := &webhookStandIn{t: t, secret: secret, failures: failures, events: make(chan AlertEvent, 10)}
+	server := httptest.NewServer(w)
+	t.Cleanup(server.Close)
+	return w, server
+}
+
+func (w *webhookStandIn) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	w.attempts++
+	attempt := w.attempts
+	w.mu.Unlock()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.t.Errorf("failed to read delivery: %v", err)
+		return
+	}
+	want := ""
+	if w.secret != "" {
+		want = "sha256=" + signWebhook(w.secret, r.Header.Get(TimestampHeader), body)
+	}
+	if got := r.Header.Get(SignatureHeader); got != want {
+		w.t.Errorf("bad signature %q, want %q", got, want)
+	}
+	if attempt <= w.failures {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var event AlertEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		w.t.Errorf("failed to decode delivery: %v", err)
+	}
+	w.events <- event
+}
+
+// next waits for the next delivered event
+func (w *webhookStandIn) next(t *testing.T) AlertEvent {
+	t.Helper()
+	select {
+	case event := <-w.events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no alert was delivered")
+		return AlertEvent{}
+	}
+}
+
+func TestAlerter_DownFiresAndResolves(t *testing.T) {
+	standIn, server := newWebhookStandIn(t, "s3cret", 2)
+	alerter := NewAlerter(AlertsConfig{
+		Webhooks: []WebhookConfig{{Name: "ops", URL: server.URL, Secret: "s3cret", Backoff: Duration(time.Millisecond)}},
+		Rules:    []AlertRule{{Name: "gateway down", Kind: AlertDown, Threshold: 3}},
+	})
+	defer alerter.Close()
+
+	status := MonitorStatus{Name: "gateway", Target: "192.0.2.1"}
+	for failures := 1; failures <= 4; failures++ {
+		status.ConsecutiveFailures = failures
+		alerter.Evaluate(status)
+	}
+
+	event := standIn.next(t)
+	if event.State != AlertFiring || event.Rule != "gateway down" || event.Monitor != "gateway" || event.Value != 3 {
+		t.Errorf("unexpected firing event %+v", event)
+	}
+	// two 503s were retried before the delivery succeeded
+	standIn.mu.Lock()
+	attempts := standIn.attempts
+	standIn.mu.Unlock()
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	status.ConsecutiveFailures = 0
+	status.Up = true
+	alerter.Evaluate(status)
+	if event := standIn.next(t); event.State != AlertResolved || event.StartedAt.IsZero() {
+		t.Errorf("unexpected resolved event %+v", event)
+	}
+
+	// firing only once while it stays down
+	select {
+	case event := <-standIn.events:
+		t.Errorf("unexpected extra event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAlertRule_Hysteresis(t *testing.T) {
+	resolve := 2.0
+	rule := AlertRule{Name: "loss", Kind: AlertLoss, Threshold: 10, ResolveThreshold: &resolve, For: 2}
+	alerter := NewAlerter(AlertsConfig{Rules: []AlertRule{rule}})
+	defer alerter.Close()
+
+	steps := []struct {
+		loss  float64
+		state string
+	}{
+		{loss: 20},                     // one probe over is not enough
+		{loss: 5},                      // streak broken
+		{loss: 20},                     //
+		{loss: 25, state: AlertFiring}, // two probes in a row
+		{loss: 5},                      // below threshold but above resolve
+		{loss: 5},                      //
+		{loss: 1},                      //
+		{loss: 0, state: AlertResolved},
+		{loss: 0},
+	}
+	for i, step := range steps {
+		event, ok := alerter.transition(rule, MonitorStatus{Name: "dns", PacketLoss: step.loss})
+		if step.state == "" && ok {
+			t.Errorf("step %d: unexpected %s event", i, event.State)
+		}
+		if step.state != "" && (!ok || event.State != step.state) {
+			t.Errorf("step %d: expected %s, got %+v %v", i, step.state, event, ok)
+		}
+	}
+}
+
+func TestAlertRule_P95(t *testing.T) {
+	rule := AlertRule{Name: "slow", Kind: AlertP95, Threshold: 100}
+	if rule.breached(rule.value(MonitorStatus{P95Rtt: 100 * time.Millisecond})) {
+		t.Error("expected 100ms not to breach a 100ms threshold")
+	}
+	if !rule.breached(rule.value(MonitorStatus{P95Rtt: 150 * time.Millisecond})) {
+		t.Error("expected 150ms to breach a 100ms threshold")
+	}
+}
+
+func TestAlerter_RulesFilterWebhooks(t *testing.T) {
+	ops, opsServer := newWebhookStandIn(t, "", 0)
+	dev, devServer := newWebhookStandIn(t, "", 0)
+	alerter := NewAlerter(AlertsConfig{
+		Webhooks: []WebhookConfig{{Name: "ops", URL: opsServer.URL}, {Name: "dev", URL: devServer.URL}},
+		Rules:    []AlertRule{{Name: "down", Kind: AlertDown, Threshold: 1, Monitors: []string{"gateway"}, Webhooks: []string{"dev"}}},
+	})
+	defer alerter.Close()
+
+	alerter.Evaluate(MonitorStatus{Name: "printer", ConsecutiveFailures: 5})
+	alerter.Evaluate(MonitorStatus{Name: "gateway", ConsecutiveFailures: 1})
+
+	if event := dev.next(t); event.Monitor != "gateway" {
+		t.Errorf("expected the gateway alert, got %+v", event)
+	}
+	select {
+	case event := <-ops.events:
+		t.Errorf("unexpected delivery to ops %+v", event)
+	case event := <-dev.events:
+		t.Errorf("unexpected extra delivery %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhook_GivesUpOnClientErrors(t *testing.T) {
+	var attempts int
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	hook := &webhook{
+		cfg:    WebhookConfig{Name: "bad", URL: server.URL}.withDefaults(),
+		client: server.Client(),
+	}
+	hook.deliver(context.Background(), []byte(`{}`))
+	if attempts != 1 {
+		t.Errorf("expected a 400 not to be retried, got %d attempts", attempts)
+	}
+}
+
+func TestAlertsConfig_Validate(t *testing.T) {
+	monitors := []MonitorConfig{{Name: "gateway"}}
+	webhooks := []WebhookConfig{{Name: "ops", URL: "https://hooks.example.com/alerts"}}
+	valid := AlertsConfig{
+		Webhooks: webhooks,
+		Rules:    []AlertRule{{Name: "down", Kind: AlertDown, Threshold: 3, Monitors: []string{"gateway"}, Webhooks: []string{"ops"}}},
+	}
+	if err := valid.Validate(monitors); err != nil {
+		t.Fatalf("expected valid alerts, got %v", err)
+	}
+
+	tooHigh := 50.0
+	invalid := []AlertsConfig{
+		{Webhooks: []WebhookConfig{{Name: "ops", URL: "ftp://example.com"}}},
+		{Webhooks: append(webhooks, webhooks...)},
+		{Rules: []AlertRule{{Name: "x", Kind: "jitter", Threshold: 1}}},
+		{Rules: []AlertRule{{Name: "x", Kind: AlertLoss, Threshold: 150}}},
+		{Rules: []AlertRule{{Name: "x", Kind: AlertLoss, Threshold: 10, ResolveThreshold: &tooHigh}}},
+		{Rules: []AlertRule{{Name: "x", Kind: AlertDown, Threshold: 1, Monitors: []string{"printer"}}}},
+		{Rules: []AlertRule{{Name: "x", Kind: AlertDown, Threshold: 1, Webhooks: []string{"pager"}}}},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(monitors); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
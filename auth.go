@@ -0,0 +1,286 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// KeyReloadInterval is how often the key file is checked for changes
+var KeyReloadInterval = 5 * time.Second
+
+// hashPrefix marks the hash algorithm used for stored API keys
+const hashPrefix = "sha256:"
+
+// AuthConfig struct for API key authentication
+type AuthConfig struct {
+    Enabled bool     `json:"enabled"`
+    Keys    []APIKey `json:"keys"`
+    KeyFile string   `json:"key_file"`
+}
+
+// APIKey struct for a caller's key, only the hash of the key is stored
+type APIKey struct {
+    Label       string   `json:"label"`
+    Hash        string   `json:"hash"`
+    Permissions []string `json:"permissions,omitempty"`
+    Roles       []string `json:"roles,omitempty"`
+}
+
+// Validate checks every key and that enabled authentication has keys
+func (a AuthConfig) Validate() error {
+    labels := make(map[string]bool)
+    for _, key := range a.Keys {
+        if err := key.Validate(); err != nil {
+            return err
+        }
+        if labels[key.Label] {
+            return fmt.Errorf("duplicate key label %q", key.Label)
+        }
+        labels[key.Label] = true
+    }
+    if a.KeyFile != "" {
+        if _, err := readKeyFile(a.KeyFile); err != nil {
+            return err
+        }
+    }
+    if a.Enabled && len(a.Keys) == 0 && a.KeyFile == "" {
+        return errors.New("keys or key_file are required when enabled")
+    }
+    return nil
+}
+
+// keyFile struct for the contents of AuthConfig.KeyFile
+type keyFile struct {
+    Keys []APIKey `json:"keys"`
+}
+
+// HashAPIKey returns the value to store in APIKey.Hash for key
+func HashAPIKey(key string) string {
+    sum := sha256.Sum256([]byte(key))
+    return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Validate checks the key has a label, a well formed hash and known permissions
+func (k APIKey) Validate() error {
+    if k.Label == "" {
+        return errors.New("key label is required")
+    }
+    digest, ok := strings.CutPrefix(k.Hash, hashPrefix)
+    if !ok {
+        return fmt.Errorf("key %s: hash must start with %s", k.Label, hashPrefix)
+    }
+    if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+        return fmt.Errorf("key %s: hash is not a hex encoded SHA-256 digest", k.Label)
+    }
+    for _, permission := range k.Permissions {
+        if permission != PermissionRead && permission != PermissionNetwork && permission != PermissionHistory {
+            return fmt.Errorf("key %s: unknown permission %q", k.Label, permission)
+        }
+    }
+    return nil
+}
+
+// Principal struct for the identity a request was made with
+type Principal struct {
+    Label       string
+    Permissions []string
+    Roles       []string
+}
+
+// anonymous is used when authentication is disabled
+var anonymous = Principal{Label: "anonymous"}
+
+// Can reports whether the principal holds permission, a principal without
+// explicit permissions holds them all
+func (p Principal) Can(permission string) bool {
+    if len(p.Permissions) == 0 {
+        return true
+    }
+    for _, held := range p.Permissions {
+        if held == permission {
+            return true
+        }
+    }
+    return false
+}
+
+type principalKey struct{}
+
+// withPrincipal stores the caller's identity in ctx
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+    return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the caller's identity, anonymous when there is none
+func principalFrom(ctx context.Context) Principal {
+    if p, ok := ctx.Value(principalKey{}).(Principal); ok {
+        return p
+    }
+    return anonymous
+}
+
+// KeyStore struct for the accepted API keys, keys from the key file are
+// reloaded whenever the file changes
+type KeyStore struct {
+    mu     sync.RWMutex
+    static []APIKey
+    keys   []APIKey
+    file   string
+    stop   chan struct{}
+    once   sync.Once
+}
+
+// NewKeyStore loads the keys from cfg
+func NewKeyStore(cfg AuthConfig) (*KeyStore, error) {
+    ks := &KeyStore{
+        static: cfg.Keys,
+        file:   cfg.KeyFile,
+        stop:   make(chan struct{}),
+    }
+    err := ks.Reload()
+    if err != nil {
+        return nil, err
+    }
+    return ks, nil
+}
+
+// readKeyFile decodes and validates a key file
+func readKeyFile(path string) ([]APIKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("reading key file: %w", err)
+    }
+    var kf keyFile
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    err = decoder.Decode(&kf)
+    if err != nil {
+        return nil, fmt.Errorf("parsing key file %s: %w", path, err)
+    }
+    for _, key := range kf.Keys {
+        if err := key.Validate(); err != nil {
+            return nil, fmt.Errorf("key file %s: %w", path, err)
+        }
+    }
+    return kf.Keys, nil
+}
+
+// Reload re-reads the key file, on error the current keys are kept
+func (ks *KeyStore) Reload() error {
+    keys := append([]APIKey{}, ks.static...)
+    if ks.file != "" {
+        fileKeys, err := readKeyFile(ks.file)
+        if err != nil {
+            return err
+        }
+        keys = append(keys, fileKeys...)
+    }
+
+    ks.mu.Lock()
+    ks.keys = keys
+    ks.mu.Unlock()
+    return nil
+}
+
+// Watch reloads the key file whenever it changes
+func (ks *KeyStore) Watch(interval time.Duration) {
+    if ks.file == "" {
+        return
+    }
+    watchFiles(ks.stop, interval, []string{ks.file}, func() error {
+        if err := ks.Reload(); err != nil {
+            log.Printf("Keeping current API keys: %v\n", err)
+            return err
+        }
+        log.Printf("Reloaded API keys from %s\n", ks.file)
+        return nil
+    })
+}
+
+// Close stops watching the key file
+func (ks *KeyStore) Close() error {
+    ks.once.Do(func() { close(ks.stop) })
+    return nil
+}
+
+// Authenticate returns the key matching token, every key is compared so
+// the time taken does not depend on which key matched
+func (ks *KeyStore) Authenticate(token string) (APIKey, bool) {
+    hash := []byte(HashAPIKey(token))
+    ks.mu.RLock()
+    defer ks.mu.RUnlock()
+    var match APIKey
+    found := false
+    for _, key := range ks.keys {
+        if subtle.ConstantTimeCompare(hash, []byte(key.Hash)) == 1 && !found {
+            match = key
+            found = true
+        }
+    }
+    return match, found
+}
+
+// authenticate requires a valid bearer token when keys is not nil and
+// stores the caller's identity in the request context, without keys the
+// identity comes from the client certificate if there is one
+func authenticate(keys *KeyStore) Middleware {
+    return func(next http.Handler) http.Handler {
+        if keys == nil {
+            return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                // a verified client certificate still names the caller
+                if principal, ok := certPrincipal(r); ok {
+                    r = r.WithContext(withPrincipal(r.Context(), principal))
+                }
+                next.ServeHTTP(w, r)
+            })
+        }
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            token, ok := bearerToken(r)
+            if !ok {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="espresso-commander"`)
+                writeError(w, NewCommandError(ErrCodeUnauthorized, errors.New("missing bearer token")), nil)
+                return
+            }
+            key, ok := keys.Authenticate(token)
+            if !ok {
+                log.Printf("Rejected API key from %s for %s\n", r.RemoteAddr, r.URL.Path)
+                w.Header().Set("WWW-Authenticate", `Bearer realm="espresso-commander", error="invalid_token"`)
+                writeError(w, NewCommandError(ErrCodeUnauthorized, errors.New("invalid API key")), nil)
+                return
+            }
+            principal := Principal{Label: key.Label, Permissions: key.Permissions, Roles: key.Roles}
+            next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+        })
+    }
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+    scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+    if !ok || !strings.EqualFold(scheme, "Bearer") {
+        return "", false
+    }
+    token = strings.TrimSpace(token)
+    return token, token != ""
+}
+
+// certPrincipal names the caller after the subject of its verified client
+// certificate, it holds every permission as the CA vouches for it
+func certPrincipal(r *http.Request) (Principal, bool) {
+    if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+        return Principal{}, false
+    }
+    return Principal{Label: "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName}, true
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeyFile writes keys to a key file in dir
+func writeKeyFile(t *testing.T, path string, keys ...APIKey) {
+	t.Helper()
+	data, err := json.Marshal(keyFile{Keys: keys})
+	if err != nil {
+		t.Fatalf("failed to encode keys: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+}
+
+// authConfig returns a config requiring the keys "admin-secret", with
+// every permission, and "monitor-secret", which may only read
+func authConfig() Config {
+	cfg := DefaultConfig()
+	cfg.Auth = AuthConfig{
+		Enabled: true,
+		Keys: []APIKey{
+			{Label: "admin", Hash: HashAPIKey("admin-secret")},
+			{Label: "monitor", Hash: HashAPIKey("monitor-secret"), Permissions: []string{PermissionRead}},
+		},
+	}
+	return cfg
+}
+
+func TestHashAPIKey(t *testing.T) {
+	// printf %s foo | shasum -a 256
+	want := "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	if got := HashAPIKey("foo"); got != want {
+		t.Errorf("HashAPIKey(foo) = %s, want %s", got, want)
+	}
+	if err := (APIKey{Label: "foo", Hash: want}).Validate(); err != nil {
+		t.Errorf("expected hash to be valid: %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &mockCommander{}, authConfig()))
+
+	tests := []struct {
+		name          string
+		authorization string
+		body          string
+		status        int
+		code          ErrorCode
+	}{
+		{name: "missing header", body: `{"type":"sysinfo"}`, status: http.StatusUnauthorized, code: ErrCodeUnauthorized},
+		{name: "wrong scheme", authorization: "Basic YWRtaW4=", body: `{"type":"sysinfo"}`, status: http.StatusUnauthorized, code: ErrCodeUnauthorized},
+		{name: "unknown key", authorization: "Bearer guess", body: `{"type":"sysinfo"}`, status: http.StatusUnauthorized, code: ErrCodeUnauthorized},
+		{name: "admin sysinfo", authorization: "Bearer admin-secret", body: `{"type":"sysinfo"}`, status: http.StatusOK},
+		{name: "admin ping", authorization: "Bearer admin-secret", body: `{"type":"ping","payload":"127.0.0.1"}`, status: http.StatusOK},
+		{name: "monitor sysinfo", authorization: "bearer monitor-secret", body: `{"type":"sysinfo"}`, status: http.StatusOK},
+		{name: "monitor ping", authorization: "Bearer monitor-secret", body: `{"type":"ping","payload":"127.0.0.1"}`, status: http.StatusForbidden, code: ErrCodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/execute", strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			res := decodeResponse(t, rec)
+			if res.Code != tt.code {
+				t.Errorf("expected code %q, got %q", tt.code, res.Code)
+			}
+			if tt.status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAuthenticate_Commands(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &mockCommander{}, authConfig()))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/commands", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/commands", nil)
+	req.Header.Set("Authorization", "Bearer monitor-secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestKeyStore_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyFile(t, path, APIKey{Label: "old", Hash: HashAPIKey("old-secret")})
+
+	ks, err := NewKeyStore(AuthConfig{Enabled: true, KeyFile: path})
+	if err != nil {
+		t.Fatalf("NewKeyStore: %v", err)
+	}
+	defer ks.Close()
+	ks.Watch(10 * time.Millisecond)
+
+	if key, ok := ks.Authenticate("old-secret"); !ok || key.Label != "old" {
+		t.Fatalf("expected old key to authenticate, got %+v %v", key, ok)
+	}
+
+	// rotate the key, moving the modification time so the change is seen
+	writeKeyFile(t, path, APIKey{Label: "new", Hash: HashAPIKey("new-secret")})
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := ks.Authenticate("new-secret"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new key was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := ks.Authenticate("old-secret"); ok {
+		t.Error("expected old key to be revoked")
+	}
+
+	// a broken key file keeps the current keys
+	if err := os.WriteFile(path, []byte(`{"keys": [`), 0600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	if err := ks.Reload(); err == nil {
+		t.Error("expected reload of a broken key file to fail")
+	}
+	if _, ok := ks.Authenticate("new-secret"); !ok {
+		t.Error("expected current keys to be kept after a failed reload")
+	}
+}
+
+func TestPrincipal_Can(t *testing.T) {
+	if !anonymous.Can(PermissionNetwork) {
+		t.Error("expected a principal without permissions to hold them all")
+	}
+	p := Principal{Label: "monitor", Permissions: []string{PermissionRead}}
+	if !p.Can(PermissionRead) || p.Can(PermissionNetwork) {
+		t.Errorf("unexpected permissions for %+v", p)
+	}
+}
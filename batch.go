@@ -0,0 +1,138 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "sync"
+)
+
+// DefaultBatch are the batch settings used when nothing is configured
+var DefaultBatch = BatchConfig{
+    MaxParallel: 8,
+    MaxRequests: 100,
+}
+
+// BatchConfig struct for running several commands from one /execute request
+type BatchConfig struct {
+    MaxParallel int `json:"max_parallel"`
+    MaxRequests int `json:"max_requests"`
+}
+
+// Validate checks a batch can run at least one command
+func (c BatchConfig) Validate() error {
+    if c.MaxParallel < 1 {
+        return errors.New("max_parallel must be at least 1")
+    }
+    if c.MaxRequests < 1 {
+        return errors.New("max_requests must be at least 1")
+    }
+    return nil
+}
+
+// errSkipped is the error of batch requests that never ran because an
+// earlier one failed with fail-fast set
+var errSkipped = NewCommandError(ErrCodeCancelled, errors.New("skipped after an earlier request failed"))
+
+// ExecuteBatch runs every request through Execute, at most
+// cfg.Batch.MaxParallel at a time, and returns the responses in request
+// order. With failFast the first failure cancels the requests still
+// running and skips the rest.
+func (s *Server) ExecuteBatch(ctx context.Context, reqs []CommandRequest, failFast bool) []CommandResponse {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    responses := make([]CommandResponse, len(reqs))
+    slots := make(chan struct{}, s.cfg.Batch.MaxParallel)
+    var wg sync.WaitGroup
+    for i, req := range reqs {
+        select {
+        case slots <- struct{}{}:
+        case <-ctx.Done():
+        }
+        if ctx.Err() != nil {
+            // the client went away or fail-fast stopped the batch
+            for j := i; j < len(reqs); j++ {
+                responses[j] = errorResponse(errSkipped, nil)
+            }
+            break
+        }
+        wg.Add(1)
+        go func(i int, req CommandRequest) {
+            defer wg.Done()
+            defer func() { <-slots }()
+            defer func() {
+                if rec := recover(); rec != nil {
+                    panicsRecovered.Add(1)
+                    log.Printf("Recovered from panic in batch request %d: %v\n", i, rec)
+                    responses[i] = errorResponse(NewCommandError(ErrCodeInternal, fmt.Errorf("%v", rec)), nil)
+                    if failFast {
+                        cancel()
+                    }
+                }
+            }()
+            res, err := s.Execute(ctx, req)
+            if err != nil {
+                responses[i] = errorResponse(err, res.Data)
+                if failFast {
+                    cancel()
+                }
+                return
+            }
+            responses[i] = res
+        }(i, req)
+    }
+    wg.Wait()
+    return responses
+}
+
+// isBatch reports whether the body holds an array of requests
+func isBatch(body []byte) bool {
+    body = bytes.TrimSpace(body)
+    return len(body) > 0 && body[0] == '['
+}
+
+// handleBatch runs the array of requests in body, the response is 200 with
+// success set only when every request succeeded
+func handleBatch(s *Server, w http.ResponseWriter, r *http.Request, body []byte) {
+    if wantsEventStream(r) {
+        writeError(w, NewCommandError(ErrCodeInvalidRequest, errors.New("batches cannot be streamed")), nil)
+        return
+    }
+    failFast := false
+    if v := r.URL.Query().Get("fail_fast"); v != "" {
+        var err error
+        failFast, err = strconv.ParseBool(v)
+        if err != nil {
+            writeError(w, NewCommandError(ErrCodeInvalidRequest, errors.New("fail_fast must be true or false")), nil)
+            return
+        }
+    }
+    var reqs []CommandRequest
+    err := json.Unmarshal(body, &reqs)
+    if err != nil {
+        writeError(w, NewCommandError(ErrCodeInvalidJSON, err), nil)
+        return
+    }
+    if len(reqs) == 0 {
+        writeError(w, NewCommandError(ErrCodeInvalidRequest, errors.New("batch is empty")), nil)
+        return
+    }
+    if len(reqs) > s.cfg.Batch.MaxRequests {
+        writeError(w, NewCommandError(ErrCodeInvalidRequest,
+            fmt.Errorf("batch has %d requests, at most %d are allowed", len(reqs), s.cfg.Batch.MaxRequests)), nil)
+        return
+    }
+
+    responses := s.ExecuteBatch(r.Context(), reqs, failFast)
+    success := true
+    for _, res := range responses {
+        success = success && res.Success
+    }
+    writeResponse(w, http.StatusOK, CommandResponse{Success: success, Data: responses})
+}
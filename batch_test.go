@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCommander records how many pings run at the same time
+type countingCommander struct {
+	mockCommander
+	running atomic.Int64
+	most    atomic.Int64
+}
+
+func (c *countingCommander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+	n := c.running.Add(1)
+	defer c.running.Add(-1)
+	for {
+		most := c.most.Load()
+		if n <= most || c.most.CompareAndSwap(most, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return PingResult{Successful: true, Host: host}, nil
+}
+
+// executeBatch posts body to /execute with query and decodes the responses
+func executeBatch(t *testing.T, handler http.Handler, query, body string) (int, bool, []CommandResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/execute"+query, strings.NewReader(body)))
+	var res struct {
+		Success bool              `json:"success"`
+		Data    []CommandResponse `json:"data"`
+	}
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return rec.Code, res.Success, res.Data
+}
+
+func TestBatch_Ordered(t *testing.T) {
+	cmdr := &mockCommander{pingResult: PingResult{Successful: true, Host: "example.com"}}
+	handler := handleRequests(newTestServer(t, cmdr, DefaultConfig()))
+
+	code, success, responses := executeBatch(t, handler, "", ` [
+		{"type":"ping","payload":"example.com"},
+		{"type":"sysinfo"},
+		{"type":"ping","payload":""},
+		{"type":"reboot"}
+	]`)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if success {
+		t.Error("expected the batch to fail when any request fails")
+	}
+	if len(responses) != 4 {
+		t.Fatalf("expected 4 responses, got %d", len(responses))
+	}
+	if !responses[0].Success || !responses[1].Success {
+		t.Errorf("expected ping and sysinfo to succeed, got %+v %+v", responses[0], responses[1])
+	}
+	if responses[2].Code != ErrCodeInvalidRequest || responses[3].Code != ErrCodeUnknownCommand {
+		t.Errorf("expected the errors in request order, got %q %q", responses[2].Code, responses[3].Code)
+	}
+
+	_, success, _ = executeBatch(t, handler, "", `[{"type":"sysinfo"},{"type":"ping","payload":"example.com"}]`)
+	if !success {
+		t.Error("expected the batch to succeed when every request does")
+	}
+}
+
+func TestBatch_Parallelism(t *testing.T) {
+	cmdr := &countingCommander{}
+	cfg := DefaultConfig()
+	cfg.Batch.MaxParallel = 2
+	handler := handleRequests(newTestServer(t, cmdr, cfg))
+
+	body := "[" + strings.Repeat(`{"type":"ping","payload":"127.0.0.1"},`, 5) + `{"type":"ping","payload":"127.0.0.1"}]`
+	_, success, responses := executeBatch(t, handler, "", body)
+	if !success || len(responses) != 6 {
+		t.Fatalf("expected 6 successful pings, got %+v", responses)
+	}
+	if most := cmdr.most.Load(); most != 2 {
+		t.Errorf("expected 2 pings at a time, got %d", most)
+	}
+}
+
+func TestBatch_FailFast(t *testing.T) {
+	cmdr := &cancellableCommander{started: make(chan struct{}, 10), release: make(chan struct{})}
+	defer close(cmdr.release)
+	cfg := DefaultConfig()
+	cfg.Batch.MaxParallel = 2
+	handler := handleRequests(newTestServer(t, cmdr, cfg))
+
+	_, success, responses := executeBatch(t, handler, "?fail_fast=true", `[
+		{"type":"ping","payload":"127.0.0.1"},
+		{"type":"ping","payload":""},
+		{"type":"ping","payload":"127.0.0.1"}
+	]`)
+	if success || len(responses) != 3 {
+		t.Fatalf("expected 3 responses for a failed batch, got %+v", responses)
+	}
+	if responses[0].Code != ErrCodeCancelled {
+		t.Errorf("expected the running ping to be cancelled, got %+v", responses[0])
+	}
+	if responses[1].Code != ErrCodeInvalidRequest {
+		t.Errorf("expected the failure, got %+v", responses[1])
+	}
+	if responses[2].Code != ErrCodeCancelled || !strings.Contains(responses[2].Error, "skipped") {
+		t.Errorf("expected the last ping to be skipped, got %+v", responses[2])
+	}
+	if n := len(cmdr.started); n != 1 {
+		t.Errorf("expected only the first ping to start, %d did", n)
+	}
+}
+
+// panickingCommander panics on every ping
+type panickingCommander struct {
+	mockCommander
+}
+
+func (c *panickingCommander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+	panic("boom")
+}
+
+func TestBatch_Panic(t *testing.T) {
+	before := panicsRecovered.Load()
+	handler := handleRequests(newTestServer(t, &panickingCommander{}, DefaultConfig()))
+
+	code, success, responses := executeBatch(t, handler, "", `[{"type":"ping","payload":"127.0.0.1"},{"type":"sysinfo"}]`)
+	if code != http.StatusOK || success || len(responses) != 2 {
+		t.Fatalf("expected a failed batch of 2, got %d %+v", code, responses)
+	}
+	if responses[0].Code != ErrCodeInternal || responses[0].Error != "boom" {
+		t.Errorf("expected the panic as an internal error, got %+v", responses[0])
+	}
+	if !responses[1].Success {
+		t.Errorf("expected sysinfo to succeed, got %+v", responses[1])
+	}
+	if got := panicsRecovered.Load(); got != before+1 {
+		t.Errorf("expected the panic to be counted, got %d after %d", got, before)
+	}
+}
+
+func TestBatch_Invalid(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Batch.MaxRequests = 2
+	handler := handleRequests(newTestServer(t, &mockCommander{}, cfg))
+
+	for _, tt := range []struct {
+		name   string
+		query  string
+		body   string
+		status int
+	}{
+		{"empty", "", `[]`, http.StatusBadRequest},
+		{"too many", "", `[{"type":"sysinfo"},{"type":"sysinfo"},{"type":"sysinfo"}]`, http.StatusBadRequest},
+		{"invalid json", "", `[{"type":]`, http.StatusBadRequest},
+		{"invalid fail_fast", "?fail_fast=maybe", `[{"type":"sysinfo"}]`, http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, _ := executeBatch(t, handler, tt.query, tt.body)
+			if code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, code)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("POST", "/execute", strings.NewReader(`[{"type":"sysinfo"}]`))
+	req.Header.Set("Accept", "text/event-stream")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected streaming a batch to be refused, got %d", rec.Code)
+	}
+}
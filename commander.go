@@ -1,56 +1,205 @@
 package main
 
 import (
+    "context"
+    "errors"
     "fmt"
     probing "github.com/prometheus-community/pro-bing"
     "log"
+    "math"
     "net"
     "os"
+    "runtime"
+    "sync"
     "time"
 )
 
-// Commander interface for commander
+// Commander interface for commander, every operation stops when ctx is
+// cancelled or its deadline passes
 type Commander interface {
-    Ping(host string) (PingResult, error)
-    GetSystemInfo() (SystemInfo, error)
+    Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error)
+    Traceroute(ctx context.Context, host string, opts TracerouteOptions) (TracerouteResult, error)
+    GetSystemInfo(ctx context.Context) (SystemInfo, error)
 }
 
+// ErrUnresolvableHost is returned when the ping target cannot be resolved
+var ErrUnresolvableHost = errors.New("unable to resolve host")
+
+// Ping run statuses
+const (
+    PingStatusCompleted = "completed"
+    PingStatusCancelled = "cancelled"
+    PingStatusTimedOut  = "timed_out"
+)
+
 // PingResult struct for ping result
 type PingResult struct {
-    Successful bool
-    Time       time.Duration
+    Successful            bool          `json:"successful"`
+    Status                string        `json:"status"`
+    Host                  string        `json:"host"`
+    IPAddress             string        `json:"ip_address"`
+    Family                string        `json:"family"`
+    PacketsSent           int           `json:"packets_sent"`
+    PacketsRecv           int           `json:"packets_recv"`
+    PacketsRecvDuplicates int           `json:"packets_recv_duplicates"`
+    PacketLoss            float64       `json:"packet_loss"`
+    MinRtt                time.Duration `json:"min_rtt"`
+    AvgRtt                time.Duration `json:"avg_rtt"`
+    MaxRtt                time.Duration `json:"max_rtt"`
+    StdDevRtt             time.Duration `json:"stddev_rtt"`
+    Packets               []PingPacket  `json:"packets"`
+    Results               []PingResult  `json:"results,omitempty"`
+    Error                 string        `json:"error,omitempty"`
+}
+
+// PingPacket struct for a single echo reply
+type PingPacket struct {
+    Seq       int           `json:"seq"`
+    Rtt       time.Duration `json:"rtt"`
+    TTL       int           `json:"ttl"`
+    Bytes     int           `json:"bytes"`
+    Duplicate bool          `json:"duplicate"`
 }
 
 // SystemInfo struct for system informatin
 type SystemInfo struct {
-    Hostname  string
-    IPAddress string
+    Hostname    string        `json:"hostname"`
+    IPAddress   string        `json:"ip_address"`
+    OS          OSInfo        `json:"os"`
+    CPU         CPUInfo       `json:"cpu"`
+    Memory      MemoryInfo    `json:"memory"`
+    Uptime      time.Duration `json:"uptime"`
+    BootTime    time.Time     `json:"boot_time"`
+    LoadAverage LoadAverage   `json:"load_average"`
+    Network     NetworkInfo   `json:"network"`
+    Daemon      DaemonInfo    `json:"daemon"`
+}
+type commander struct {
+    targets *TargetFilter
+}
+
+// CommanderOption configures a commander
+type CommanderOption func(*commander)
+
+// WithTargetFilter restricts the addresses the commander sends traffic to,
+// by default only multicast, broadcast and unspecified addresses are refused
+func WithTargetFilter(f *TargetFilter) CommanderOption {
+    return func(c *commander) {
+        c.targets = f
+    }
 }
-type commander struct{}
 
 // NewCommander create a new commander instance
-func NewCommander() Commander {
-    return &commander{}
+func NewCommander(opts ...CommanderOption) Commander {
+    c := &commander{targets: NewTargetFilter(TargetsConfig{})}
+    for _, opt := range opts {
+        opt(c)
+    }
+    return c
 }
 
-func (c *commander) Ping(host string) (PingResult, error) {
-    // built from examples in
-    // https://github.com/prometheus-community/pro-bing
-    s := false
-    t := time.Duration(0)
+func (c *commander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+    opts = opts.withDefaults()
 
-    pinger, err := probing.NewPinger(host)
+    if err := ctx.Err(); err != nil {
+        return PingResult{Host: host, Status: pingStatus(err)}, err
+    }
+
+    ips, err := resolveHost(ctx, host, opts.family())
+    if ctx.Err() != nil {
+        return PingResult{Host: host, Status: pingStatus(ctx.Err())}, ctx.Err()
+    }
     if err != nil {
+        return PingResult{}, fmt.Errorf("%w %s: %v", ErrUnresolvableHost, host, err)
+    }
+    // check what the name resolved to so it cannot be rebound to a
+    // refused address after the request was authorized
+    ips, err = c.filterTargets(ctx, host, ips)
+    if err != nil {
+        log.Printf("Refused ping to %s: %v\n", host, err)
         return PingResult{}, err
     }
+    if !opts.AllAddresses {
+        return c.pingAddress(ctx, host, ips[0], opts)
+    }
 
+    // ping every resolved address at the same time
+    results := make([]PingResult, len(ips))
+    var wg sync.WaitGroup
+    for i, ip := range ips {
+        wg.Add(1)
+        go func(i int, ip net.IP) {
+            defer wg.Done()
+            result, err := c.pingAddress(ctx, host, ip, opts)
+            if err != nil && ctx.Err() == nil {
+                result = PingResult{Host: host, IPAddress: ip.String(), Family: ipFamily(ip), Error: err.Error()}
+            }
+            results[i] = result
+        }(i, ip)
+    }
+    wg.Wait()
+
+    result := combinePingResults(host, results)
+    result.Family = opts.family()
+    if ctx.Err() != nil {
+        result.Status = pingStatus(ctx.Err())
+        return result, ctx.Err()
+    }
+    result.Status = PingStatusCompleted
+    return result, nil
+}
+
+// filterTargets returns the addresses of host that the target lists and
+// the check in ctx allow, or the first refusal when there are none
+func (c *commander) filterTargets(ctx context.Context, host string, ips []net.IP) ([]net.IP, error) {
+    ips, err := c.targets.Filter(host, ips)
+    check := targetCheckFrom(ctx)
+    if err != nil || check == nil {
+        return ips, err
+    }
+    var allowed []net.IP
+    var refused error
+    for _, ip := range ips {
+        if err := check(host, ip); err != nil {
+            if refused == nil {
+                refused = err
+            }
+            continue
+        }
+        allowed = append(allowed, ip)
+    }
+    if len(allowed) == 0 {
+        return nil, refused
+    }
+    return allowed, nil
+}
+
+// pingAddress pings a single resolved address of host
+func (c *commander) pingAddress(ctx context.Context, host string, ip net.IP, opts PingOptions) (PingResult, error) {
+    // built from examples in
+    // https://github.com/prometheus-community/pro-bing
+    var result PingResult
+    events := newPingEvents(ctx, host, ip.String(), opts)
+
+    pinger := probing.New(host)
+    pinger.SetIPAddr(&net.IPAddr{IP: ip})
+
+    pinger.OnSend = func(pkt *probing.Packet) {
+        events.sent(pkt.Seq)
+    }
     pinger.OnRecv = func(pkt *probing.Packet) {
-        log.Printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v\n",
+        debugf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v\n",
             pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.TTL)
+        packet := newPingPacket(pkt, false)
+        result.Packets = append(result.Packets, packet)
+        events.received(packet)
     }
     pinger.OnDuplicateRecv = func(pkt *probing.Packet) {
-        log.Printf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v (DUP!)\n",
+        debugf("%d bytes from %s: icmp_seq=%d time=%v ttl=%v (DUP!)\n",
             pkt.Nbytes, pkt.IPAddr, pkt.Seq, pkt.Rtt, pkt.TTL)
+        packet := newPingPacket(pkt, true)
+        result.Packets = append(result.Packets, packet)
+        events.received(packet)
     }
     pinger.OnFinish = func(stats *probing.Statistics) {
         log.Printf("\n--- %s ping statistics ---\n", stats.Addr)
@@ -58,76 +207,137 @@ func (c *commander) Ping(host string) (PingResult, error) {
             stats.PacketsSent, stats.PacketsRecv, stats.PacketsRecvDuplicates, stats.PacketLoss)
         log.Printf("round-trip min/avg/max/stddev = %v/%v/%v/%v\n",
             stats.MinRtt, stats.AvgRtt, stats.MaxRtt, stats.StdDevRtt)
-        s = true
-        t = stats.MaxRtt
+        result.Successful = stats.PacketsRecv > 0
+        result.PacketsSent = stats.PacketsSent
+        result.PacketsRecv = stats.PacketsRecv
+        result.PacketsRecvDuplicates = stats.PacketsRecvDuplicates
+        result.PacketLoss = stats.PacketLoss
+        result.MinRtt = stats.MinRtt
+        result.AvgRtt = stats.AvgRtt
+        result.MaxRtt = stats.MaxRtt
+        result.StdDevRtt = stats.StdDevRtt
     }
 
-    pinger.Count = 4
-    pinger.Size = 24
-    pinger.Interval = time.Second
-    pinger.Timeout = time.Second * 100000
-    pinger.TTL = 64
-    pinger.SetPrivileged(false)
+    pinger.Count = opts.Count
+    pinger.Size = opts.Size
+    pinger.Interval = time.Duration(opts.Interval)
+    pinger.Timeout = opts.runTimeout()
+    pinger.TTL = opts.TTL
+    pinger.Source = opts.Source
+    pinger.SetPrivileged(opts.Privileged)
+
+    result.Host = host
+    result.IPAddress = ip.String()
+    result.Family = ipFamily(ip)
 
-    log.Printf("PING %s (%s):\n", pinger.Addr(), pinger.IPAddr())
-    err = pinger.Run()
+    log.Printf("PING %s (%s):\n", host, ip)
+    // RunWithContext stops the pinger as soon as ctx is done, OnFinish
+    // still runs so the partial statistics are kept
+    err := pinger.RunWithContext(ctx)
+    events.finish(ctx.Err() != nil)
+    if ctx.Err() != nil {
+        result.Status = pingStatus(ctx.Err())
+        return result, ctx.Err()
+    }
     if err != nil {
-        panic(fmt.Errorf("Failed to ping target host: %w", err))
+        return PingResult{}, fmt.Errorf("failed to ping target host: %w", err)
     }
-    return PingResult{Successful: s, Time: t}, nil
+    result.Status = PingStatusCompleted
+    return result, nil
 }
 
-func (c *commander) GetSystemInfo() (SystemInfo, error) {
+// combinePingResults summarises the per-address results of one host, the
+// round-trip statistics cover every reply that was not a duplicate
+func combinePingResults(host string, results []PingResult) PingResult {
+    combined := PingResult{Host: host, Results: results}
+    var rtts []time.Duration
+    for _, r := range results {
+        combined.Successful = combined.Successful || r.Successful
+        combined.PacketsSent += r.PacketsSent
+        combined.PacketsRecv += r.PacketsRecv
+        combined.PacketsRecvDuplicates += r.PacketsRecvDuplicates
+        for _, pkt := range r.Packets {
+            if !pkt.Duplicate {
+                rtts = append(rtts, pkt.Rtt)
+            }
+        }
+    }
+    if combined.PacketsSent > 0 {
+        combined.PacketLoss = float64(combined.PacketsSent-combined.PacketsRecv) / float64(combined.PacketsSent) * 100
+    }
+    combined.MinRtt, combined.AvgRtt, combined.MaxRtt, combined.StdDevRtt = rttStatistics(rtts)
+    return combined
+}
+
+// rttStatistics returns the min, average, max and standard deviation of rtts
+func rttStatistics(rtts []time.Duration) (time.Duration, time.Duration, time.Duration, time.Duration) {
+    if len(rtts) == 0 {
+        return 0, 0, 0, 0
+    }
+    minRtt, maxRtt, total := rtts[0], rtts[0], time.Duration(0)
+    for _, rtt := range rtts {
+        if rtt < minRtt {
+            minRtt = rtt
+        }
+        if rtt > maxRtt {
+            maxRtt = rtt
+        }
+        total += rtt
+    }
+    avg := total / time.Duration(len(rtts))
+    var variance float64
+    for _, rtt := range rtts {
+        variance += math.Pow(float64(rtt-avg), 2)
+    }
+    stddev := time.Duration(math.Sqrt(variance / float64(len(rtts))))
+    return minRtt, avg, maxRtt, stddev
+}
+
+// pingStatus maps a context error onto a ping run status
+func pingStatus(err error) string {
+    switch {
+    case errors.Is(err, context.DeadlineExceeded):
+        return PingStatusTimedOut
+    case err != nil:
+        return PingStatusCancelled
+    default:
+        return PingStatusCompleted
+    }
+}
+
+// newPingPacket converts a pro-bing packet into a PingPacket
+func newPingPacket(pkt *probing.Packet, duplicate bool) PingPacket {
+    return PingPacket{
+        Seq:       pkt.Seq,
+        Rtt:       pkt.Rtt,
+        TTL:       pkt.TTL,
+        Bytes:     pkt.Nbytes,
+        Duplicate: duplicate,
+    }
+}
+
+func (c *commander) GetSystemInfo(ctx context.Context) (SystemInfo, error) {
+    if err := ctx.Err(); err != nil {
+        return SystemInfo{}, err
+    }
+
     // Get the system hostname
     hostname, err := os.Hostname()
     if err != nil {
         return SystemInfo{}, err
     }
 
-    // Initialize IP address variable
-    ipAddress := ""
-
-    // Get all network interfaces
-    interfaces, err := net.Interfaces()
+    // Get every network interface and the primary addresses
+    network, err := readNetworkInfo()
     if err != nil {
         return SystemInfo{}, err
     }
 
-    // Iterate through interfaces to find an active, non-loopback interface
-    for _, iface := range interfaces {
-        // Skip interfaces that are down or loopback
-        if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-            continue
-        }
-
-        // Get addresses for this interface
-        addrs, err := iface.Addrs()
-        if err != nil {
-            continue
-        }
-
-        // Check each address
-        for _, addr := range addrs {
-            var ip net.IP
-            // Extract IP from address based on type
-            switch v := addr.(type) {
-            case *net.IPNet:
-                ip = v.IP
-            case *net.IPAddr:
-                ip = v.IP
-            }
-
-            // Use the first IPv4 address found
-            if ip != nil && ip.To4() != nil {
-                ipAddress = ip.String()
-                break
-            }
-        }
-
-        // Stop searching if we found an IP
-        if ipAddress != "" {
-            break
-        }
+    // Prefer the address on the default route, then the first active,
+    // non-loopback IPv4 address
+    ipAddress := network.Primary.IPv4
+    if ipAddress == "" {
+        ipAddress = network.firstIPv4()
     }
 
     // Fallback to localhost if no suitable IP found
@@ -135,8 +345,24 @@ func (c *commander) GetSystemInfo() (SystemInfo, error) {
         ipAddress = "127.0.0.1"
     }
 
-    return SystemInfo{
+    info := SystemInfo{
         Hostname:  hostname,
         IPAddress: ipAddress,
-    }, nil
+        OS: OSInfo{
+            Name: runtime.GOOS,
+            Arch: runtime.GOARCH,
+        },
+        CPU: CPUInfo{
+            Cores: runtime.NumCPU(),
+        },
+        Network: network,
+        Daemon:  daemonInfo(),
+    }
+
+    // Fill in everything the platform can tell us
+    err = readPlatformInfo(&info)
+    if err != nil {
+        return SystemInfo{}, err
+    }
+    return info, nil
 }
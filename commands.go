@@ -0,0 +1,240 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+)
+
+// NewDefaultRegistry create a registry with the built-in commands enabled
+// in cfg
+func NewDefaultRegistry(cmdr Commander, cfg Config) *Registry {
+    enabled := make(map[string]bool)
+    for _, name := range cfg.EnabledCommands {
+        enabled[name] = true
+    }
+
+    registry := NewRegistry()
+    for _, cmd := range builtinCommands(cmdr, cfg) {
+        if len(enabled) > 0 && !enabled[cmd.Name] {
+            continue
+        }
+        if err := registry.Register(cmd); err != nil {
+            panic(err)
+        }
+    }
+    return registry
+}
+
+// builtinCommands lists every command that ships with the daemon
+func builtinCommands(cmdr Commander, cfg Config) []Command {
+    return []Command{
+        pingCommand(cmdr, cfg.PingLimits),
+        sweepCommand(cmdr, cfg.SweepLimits, cfg.PingLimits),
+        tracerouteCommand(cmdr, cfg.TracerouteLimits, cfg.PingLimits),
+        sysinfoCommand(cmdr),
+    }
+}
+
+// pingCommand sends ICMP echo requests to the host in the payload
+func pingCommand(cmdr Commander, limits PingLimits) Command {
+    return Command{
+        Name:        "ping",
+        Description: "Determine how long it takes for a remote host to respond",
+        Schema:      pingSchema(limits),
+        Timeout:     time.Duration(limits.MaxTimeout) + 30*time.Second,
+        Permission:  PermissionNetwork,
+        Handler: func(ctx context.Context, req CommandRequest) (CommandResponse, error) {
+            if req.Payload == "" {
+                return CommandResponse{}, NewCommandError(ErrCodeInvalidRequest, errors.New("payload must be a host"))
+            }
+            var opts PingOptions
+            if err := decodeOptions(req, &opts); err != nil {
+                return CommandResponse{}, err
+            }
+            if err := opts.Validate(limits); err != nil {
+                return CommandResponse{}, NewCommandError(ErrCodeInvalidRequest, err)
+            }
+            p, err := cmdr.Ping(ctx, req.Payload, opts)
+            if err != nil {
+                if p.Status == PingStatusTimedOut || p.Status == PingStatusCancelled {
+                    // partial statistics are still useful after a timeout
+                    return CommandResponse{Data: p}, err
+                }
+                return CommandResponse{}, err
+            }
+            return CommandResponse{Success: p.Successful, Data: p}, nil
+        },
+    }
+}
+
+// pingSchema describes the ping request with the configured limits
+func pingSchema(limits PingLimits) map[string]interface{} {
+    duration := func(description string) map[string]interface{} {
+        return map[string]interface{}{
+            "type":        []string{"string", "integer"},
+            "description": description + ", as a duration string or nanoseconds",
+        }
+    }
+    return map[string]interface{}{
+        "type":     "object",
+        "required": []string{"type", "payload"},
+        "properties": map[string]interface{}{
+            "type":    map[string]interface{}{"const": "ping"},
+            "payload": map[string]interface{}{"type": "string", "description": "Host name or IP address to ping"},
+            "options": map[string]interface{}{
+                "type": "object",
+                "properties": map[string]interface{}{
+                    "count":          map[string]interface{}{"type": "integer", "minimum": 1, "maximum": limits.MaxCount},
+                    "interval":       duration("Time between echo requests, at least " + time.Duration(limits.MinInterval).String()),
+                    "timeout":        duration("Maximum time for the whole run, at most " + time.Duration(limits.MaxTimeout).String()),
+                    "packet_timeout": duration("Time to wait for the reply to the last echo request"),
+                    "size":           map[string]interface{}{"type": "integer", "minimum": minPingSize, "maximum": limits.MaxSize},
+                    "ttl":            map[string]interface{}{"type": "integer", "minimum": limits.MinTTL, "maximum": limits.MaxTTL},
+                    "source":         map[string]interface{}{"type": "string", "description": "Source IP address"},
+                    "privileged":     map[string]interface{}{"type": "boolean"},
+                    "family":         map[string]interface{}{"enum": []string{FamilyIPv4, FamilyIPv6, FamilyAny}},
+                    "all_addresses":  map[string]interface{}{"type": "boolean", "description": "Ping every resolved address of the host"},
+                },
+            },
+        },
+    }
+}
+
+// sweepCommand pings every address in the CIDR or range in the payload
+func sweepCommand(cmdr Commander, limits SweepLimits, pingLimits PingLimits) Command {
+    return Command{
+        Name:        "sweep",
+        Description: "Find which addresses in a CIDR or address range respond to ping",
+        Schema: map[string]interface{}{
+            "type":     "object",
+            "required": []string{"type", "payload"},
+            "properties": map[string]interface{}{
+                "type": map[string]interface{}{"const": "sweep"},
+                "payload": map[string]interface{}{
+                    "type":        "string",
+                    "description": fmt.Sprintf("CIDR such as 192.168.1.0/24 or range such as 192.168.1.10-192.168.1.50, at most %d addresses", limits.MaxHosts),
+                },
+                "options": map[string]interface{}{
+                    "type": "object",
+                    "properties": map[string]interface{}{
+                        "concurrency": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": limits.MaxConcurrency},
+                        "timeout": map[string]interface{}{
+                            "type":        []string{"string", "integer"},
+                            "description": "Time to wait for each host, at most " + time.Duration(limits.MaxTimeout).String() + ", as a duration string or nanoseconds",
+                        },
+                        "count":      map[string]interface{}{"type": "integer", "minimum": 1, "maximum": pingLimits.MaxCount},
+                        "privileged": map[string]interface{}{"type": "boolean"},
+                    },
+                },
+            },
+        },
+        Timeout:    sweepTimeout,
+        Permission: PermissionNetwork,
+        Handler: func(ctx context.Context, req CommandRequest) (CommandResponse, error) {
+            r, err := parseAddressRange(req.Payload)
+            if err != nil {
+                return CommandResponse{}, NewCommandError(ErrCodeInvalidRequest, err)
+            }
+            addrs, err := r.addresses(limits.MaxHosts)
+            if err != nil {
+                return CommandResponse{}, NewCommandError(ErrCodeInvalidRequest, err)
+            }
+            var opts SweepOptions
+            if err := decodeOptions(req, &opts); err != nil {
+                return CommandResponse{}, err
+            }
+            if err := opts.Validate(limits, pingLimits); err != nil {
+                return CommandResponse{}, NewCommandError(ErrCodeInvalidRequest, err)
+            }
+            result, err := sweep(ctx, cmdr, r, addrs, opts.withDefaults(), pingLimits)
+            if err != nil {
+                if result.Status == PingStatusTimedOut || result.Status == PingStatusCancelled {
+                    return CommandResponse{Data: result}, err
+                }
+                return CommandResponse{}, err
+            }
+            return CommandResponse{Success: true, Data: result}, nil
+        },
+    }
+}
+
+// tracerouteCommand traces the route to the host in the payload
+func tracerouteCommand(cmdr Commander, limits TracerouteLimits, pingLimits PingLimits) Command {
+    return Command{
+        Name:        "traceroute",
+        Description: "Find the hops on the route to a remote host",
+        Schema: map[string]interface{}{
+            "type":     "object",
+            "required": []string{"type", "payload"},
+            "properties": map[string]interface{}{
+                "type":    map[string]interface{}{"const": "traceroute"},
+                "payload": map[string]interface{}{"type": "string", "description": "Host name or IP address to trace the route to"},
+                "options": map[string]interface{}{
+                    "type": "object",
+                    "properties": map[string]interface{}{
+                        "mode":     map[string]interface{}{"enum": []string{TracerouteICMP, TracerouteUDP}},
+                        "max_hops": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": limits.MaxHops},
+                        "timeout": map[string]interface{}{
+                            "type":        []string{"string", "integer"},
+                            "description": "Time to wait for the replies to each hop, at most " + time.Duration(limits.MaxTimeout).String() + ", as a duration string or nanoseconds",
+                        },
+                        "probes": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": limits.MaxProbes},
+                        "port":   map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 65535, "description": "First destination port of UDP probes"},
+                        "family": map[string]interface{}{"enum": []string{FamilyIPv4, FamilyIPv6, FamilyAny}},
+                    },
+                },
+            },
+        },
+        Timeout:    limits.runTimeout() + 30*time.Second,
+        Permission: PermissionNetwork,
+        Handler: func(ctx context.Context, req CommandRequest) (CommandResponse, error) {
+            if req.Payload == "" {
+                return CommandResponse{}, NewCommandError(ErrCodeInvalidRequest, errors.New("payload must be a host"))
+            }
+            var opts TracerouteOptions
+            if err := decodeOptions(req, &opts); err != nil {
+                return CommandResponse{}, err
+            }
+            if err := opts.Validate(limits, pingLimits); err != nil {
+                return CommandResponse{}, NewCommandError(ErrCodeInvalidRequest, err)
+            }
+            result, err := cmdr.Traceroute(ctx, req.Payload, opts)
+            if err != nil {
+                if result.Status == PingStatusTimedOut || result.Status == PingStatusCancelled {
+                    // the hops found so far are still useful
+                    return CommandResponse{Data: result}, err
+                }
+                return CommandResponse{}, err
+            }
+            // a route that ends before the host is still a result, reached
+            // tells the two apart
+            return CommandResponse{Success: true, Data: result}, nil
+        },
+    }
+}
+
+// sysinfoCommand reports information about the host system
+func sysinfoCommand(cmdr Commander) Command {
+    return Command{
+        Name:        "sysinfo",
+        Description: "Reports basic information about the host system",
+        Schema: map[string]interface{}{
+            "type":     "object",
+            "required": []string{"type"},
+            "properties": map[string]interface{}{
+                "type": map[string]interface{}{"const": "sysinfo"},
+            },
+        },
+        Timeout:    10 * time.Second,
+        Permission: PermissionRead,
+        Handler: func(ctx context.Context, req CommandRequest) (CommandResponse, error) {
+            s, err := cmdr.GetSystemInfo(ctx)
+            if err != nil {
+                return CommandResponse{}, err
+            }
+            return CommandResponse{Success: true, Data: s}, nil
+        },
+    }
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+)
+
+// Config struct for the daemon settings
+//
+// Settings are applied in order of precedence, later sources win:
+// built-in defaults, the JSON config file, ESPRESSO_* environment
+// variables and finally command line flags.
+type Config struct {
+    Listen           string           `json:"listen"`
+    TLS              TLSConfig        `json:"tls"`
+    Auth             AuthConfig       `json:"auth"`
+    Policy           PolicyConfig     `json:"policy"`
+    EnabledCommands  []string         `json:"enabled_commands"`
+    Targets          TargetsConfig    `json:"targets"`
+    Limits           LimitsConfig     `json:"limits"`
+    Monitors         []MonitorConfig  `json:"monitors"`
+    Alerts           AlertsConfig     `json:"alerts"`
+    PingLimits       PingLimits       `json:"ping_limits"`
+    SweepLimits      SweepLimits      `json:"sweep_limits"`
+    TracerouteLimits TracerouteLimits `json:"traceroute_limits"`
+    Metrics          MetricsConfig    `json:"metrics"`
+    History          HistoryConfig    `json:"history"`
+    Jobs             JobsConfig       `json:"jobs"`
+    Batch            BatchConfig      `json:"batch"`
+    Log              LogConfig        `json:"log"`
+}
+
+// LogConfig struct for logging
+type LogConfig struct {
+    Level string `json:"level"`
+    File  string `json:"file"`
+}
+
+// DefaultConfig returns the settings used when nothing is configured
+func DefaultConfig() Config {
+    return Config{
+        Listen: ":8080",
+        Auth: AuthConfig{
+            Keys: []APIKey{},
+        },
+        Policy: PolicyConfig{
+            Default: PolicyAllow,
+            Rules:   []PolicyRule{},
+        },
+        EnabledCommands: []string{},
+        Targets: TargetsConfig{
+            Allow: []string{},
+            Deny:  []string{},
+        },
+        Limits: LimitsConfig{
+            MaxConcurrent:           DefaultLimits.MaxConcurrent,
+            MaxConcurrentPerCommand: map[string]int{},
+        },
+        Monitors: []MonitorConfig{},
+        Alerts: AlertsConfig{
+            Webhooks: []WebhookConfig{},
+            Rules:    []AlertRule{},
+        },
+        PingLimits:       DefaultPingLimits,
+        SweepLimits:      DefaultSweepLimits,
+        TracerouteLimits: DefaultTracerouteLimits,
+        Metrics:          MetricsConfig{Enabled: true},
+        History: HistoryConfig{
+            Retention:  Duration(DefaultHistoryRetention),
+            MaxEntries: DefaultHistoryMaxEntries,
+        },
+        Jobs:  DefaultJobs,
+        Batch: DefaultBatch,
+        Log: LogConfig{
+            Level: LogLevelInfo,
+        },
+    }
+}
+
+// setting maps a flag and an environment variable onto a config field
+type setting struct {
+    flag    string
+    env     string
+    usage   string
+    boolean bool // the flag may be given without a value
+    set     func(c *Config, value string) error
+}
+
+// boolFlag is a string flag that may be given without a value, like
+// flag.Bool, the value is parsed when the setting is applied
+type boolFlag string
+
+func (b *boolFlag) String() string { return string(*b) }
+
+func (b *boolFlag) Set(v string) error { *b = boolFlag(v); return nil }
+
+func (b *boolFlag) IsBoolFlag() bool { return true }
+
+// setBool parses v for a boolean setting
+func setBool(field func(c *Config) *bool) func(c *Config, v string) error {
+    return func(c *Config, v string) error {
+        enabled, err := strconv.ParseBool(v)
+        if err != nil {
+            return err
+        }
+        *field(c) = enabled
+        return nil
+    }
+}
+
+// settings are the config fields that can be set from flags and the
+// environment, everything else is only available in the config file
+var settings = []setting{
+    {
+        flag:  "listen",
+        env:   "ESPRESSO_LISTEN",
+        usage: "address to listen on, such as :8080",
+        set:   func(c *Config, v string) error { c.Listen = v; return nil },
+    },
+    {
+        flag:  "tls-cert",
+        env:   "ESPRESSO_TLS_CERT",
+        usage: "TLS certificate file",
+        set:   func(c *Config, v string) error { c.TLS.CertFile = v; return nil },
+    },
+    {
+        flag:  "tls-key",
+        env:   "ESPRESSO_TLS_KEY",
+        usage: "TLS private key file",
+        set:   func(c *Config, v string) error { c.TLS.KeyFile = v; return nil },
+    },
+    {
+        flag:  "tls-client-ca",
+        env:   "ESPRESSO_TLS_CLIENT_CA",
+        usage: "CA bundle client certificates must be signed by",
+        set:   func(c *Config, v string) error { c.TLS.ClientCAFile = v; return nil },
+    },
+    {
+        flag:    "tls-self-signed",
+        env:     "ESPRESSO_TLS_SELF_SIGNED",
+        usage:   "serve HTTPS with a generated certificate, for local testing",
+        boolean: true,
+        set:     setBool(func(c *Config) *bool { return &c.TLS.SelfSigned }),
+    },
+    {
+        flag:  "auth",
+        env:   "ESPRESSO_AUTH",
+        usage: "require an API key, true or false",
+        set:   setBool(func(c *Config) *bool { return &c.Auth.Enabled }),
+    },
+    {
+        flag:  "auth-key-file",
+        env:   "ESPRESSO_AUTH_KEY_FILE",
+        usage: "JSON file of API key hashes, reloaded when it changes",
+        set:   func(c *Config, v string) error { c.Auth.KeyFile = v; return nil },
+    },
+    {
+        flag:  "enabled-commands",
+        env:   "ESPRESSO_ENABLED_COMMANDS",
+        usage: "comma separated list of commands to enable, all when empty",
+        set:   func(c *Config, v string) error { c.EnabledCommands = splitList(v); return nil },
+    },
+    {
+        flag:    "metrics",
+        env:     "ESPRESSO_METRICS",
+        usage:   "serve Prometheus metrics at /metrics",
+        boolean: true,
+        set:     setBool(func(c *Config) *bool { return &c.Metrics.Enabled }),
+    },
+    {
+        flag:  "history-path",
+        env:   "ESPRESSO_HISTORY_PATH",
+        usage: "file to store the command history in, disabled when empty",
+        set:   func(c *Config, v string) error { c.History.Path = v; return nil },
+    },
+    {
+        flag:  "log-level",
+        env:   "ESPRESSO_LOG_LEVEL",
+        usage: "log level, debug or info",
+        set:   func(c *Config, v string) error { c.Log.Level = v; return nil },
+    },
+    {
+        flag:  "log-file",
+        env:   "ESPRESSO_LOG_FILE",
+        usage: "file to append logs to instead of stderr",
+        set:   func(c *Config, v string) error { c.Log.File = v; return nil },
+    },
+}
+
+// configFileEnv names the config file when --config is not given
+const configFileEnv = "ESPRESSO_CONFIG"
+
+// LoadConfig merges the defaults, config file, environment and flags, the
+// returned bool is true when --print-config was given
+func LoadConfig(args []string, getenv func(string) string) (Config, bool, error) {
+    fs := flag.NewFlagSet("espresso-commander", flag.ContinueOnError)
+    configPath := fs.String("config", "", "JSON config file, also read from "+configFileEnv)
+    printConfig := fs.Bool("print-config", false, "print the effective config and exit")
+    values := make(map[string]*string)
+    for _, s := range settings {
+        usage := s.usage + ", also read from " + s.env
+        if s.boolean {
+            values[s.flag] = new(string)
+            fs.Var((*boolFlag)(values[s.flag]), s.flag, usage)
+        } else {
+            values[s.flag] = fs.String(s.flag, "", usage)
+        }
+    }
+    err := fs.Parse(args)
+    if err != nil {
+        return Config{}, false, err
+    }
+    if fs.NArg() > 0 {
+        return Config{}, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+    }
+
+    cfg := DefaultConfig()
+
+    path := getenv(configFileEnv)
+    if *configPath != "" {
+        path = *configPath
+    }
+    if path != "" {
+        err = loadConfigFile(path, &cfg)
+        if err != nil {
+            return Config{}, false, err
+        }
+    }
+
+    for _, s := range settings {
+        if value := getenv(s.env); value != "" {
+            if err := s.set(&cfg, value); err != nil {
+                return Config{}, false, fmt.Errorf("%s: %w", s.env, err)
+            }
+        }
+    }
+
+    // only flags that were given override the earlier sources
+    fs.Visit(func(f *flag.Flag) {
+        for _, s := range settings {
+            if s.flag == f.Name && err == nil {
+                if setErr := s.set(&cfg, *values[s.flag]); setErr != nil {
+                    err = fmt.Errorf("--%s: %w", s.flag, setErr)
+                }
+            }
+        }
+    })
+    if err != nil {
+        return Config{}, false, err
+    }
+
+    err = cfg.Validate()
+    if err != nil {
+        return Config{}, false, fmt.Errorf("invalid config: %w", err)
+    }
+    return cfg, *printConfig, nil
+}
+
+// loadConfigFile decodes the JSON file at path over cfg, unknown fields are
+// rejected so typos do not go unnoticed
+func loadConfigFile(path string, cfg *Config) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return fmt.Errorf("reading config: %w", err)
+    }
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    err = decoder.Decode(cfg)
+    if err != nil {
+        return fmt.Errorf("parsing config %s: %w", path, err)
+    }
+    return nil
+}
+
+// Validate checks the config for mistakes that would only show up later
+func (c Config) Validate() error {
+    _, port, err := net.SplitHostPort(c.Listen)
+    if err != nil {
+        return fmt.Errorf("listen: %w", err)
+    }
+    if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+        return fmt.Errorf("listen: invalid port %q", port)
+    }
+
+    err = c.TLS.Validate()
+    if err != nil {
+        return fmt.Errorf("tls: %w", err)
+    }
+
+    err = c.Auth.Validate()
+    if err != nil {
+        return fmt.Errorf("auth: %w", err)
+    }
+
+    known := make(map[string]bool)
+    for _, cmd := range builtinCommands(nil, c) {
+        known[cmd.Name] = true
+    }
+    for _, name := range c.EnabledCommands {
+        if !known[name] {
+            return fmt.Errorf("enabled_commands: unknown command %q", name)
+        }
+    }
+
+    err = c.Policy.Validate()
+    if err != nil {
+        return fmt.Errorf("policy: %w", err)
+    }
+    for _, rule := range c.Policy.Rules {
+        for _, name := range rule.Commands {
+            if !known[name] {
+                return fmt.Errorf("policy: unknown command %q", name)
+            }
+        }
+    }
+
+    err = c.Targets.Validate()
+    if err != nil {
+        return fmt.Errorf("targets: %w", err)
+    }
+
+    err = c.Limits.Validate()
+    if err != nil {
+        return fmt.Errorf("limits: %w", err)
+    }
+    for name := range c.Limits.MaxConcurrentPerCommand {
+        if !known[name] {
+            return fmt.Errorf("limits: unknown command %q", name)
+        }
+    }
+
+    err = c.PingLimits.Validate()
+    if err != nil {
+        return fmt.Errorf("ping_limits: %w", err)
+    }
+
+    err = c.SweepLimits.Validate()
+    if err != nil {
+        return fmt.Errorf("sweep_limits: %w", err)
+    }
+
+    err = c.TracerouteLimits.Validate()
+    if err != nil {
+        return fmt.Errorf("traceroute_limits: %w", err)
+    }
+
+    names := make(map[string]bool)
+    for _, m := range c.Monitors {
+        if err := m.Validate(c.PingLimits); err != nil {
+            return fmt.Errorf("monitors: %w", err)
+        }
+        if names[m.Name] {
+            return fmt.Errorf("monitors: duplicate name %q", m.Name)
+        }
+        names[m.Name] = true
+    }
+
+    err = c.Alerts.Validate(c.Monitors)
+    if err != nil {
+        return fmt.Errorf("alerts: %w", err)
+    }
+
+    err = c.History.Validate()
+    if err != nil {
+        return fmt.Errorf("history: %w", err)
+    }
+
+    err = c.Jobs.Validate()
+    if err != nil {
+        return fmt.Errorf("jobs: %w", err)
+    }
+
+    err = c.Batch.Validate()
+    if err != nil {
+        return fmt.Errorf("batch: %w", err)
+    }
+
+    if _, ok := logLevels[c.Log.Level]; !ok {
+        return fmt.Errorf("log: unknown level %q", c.Log.Level)
+    }
+    return nil
+}
+
+// redacted replaces secrets in the printed config
+const redacted = "REDACTED"
+
+// Print writes the config as indented JSON, webhook secrets and API key
+// hashes are redacted
+func (c Config) Print(w io.Writer) error {
+    c.Auth.Keys = slices.Clone(c.Auth.Keys)
+    for i := range c.Auth.Keys {
+        c.Auth.Keys[i].Hash = redacted
+    }
+    c.Alerts.Webhooks = slices.Clone(c.Alerts.Webhooks)
+    for i := range c.Alerts.Webhooks {
+        if c.Alerts.Webhooks[i].Secret != "" {
+            c.Alerts.Webhooks[i].Secret = redacted
+        }
+    }
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(c)
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+    list := []string{}
+    for _, item := range strings.Split(s, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes content to a config file in a temp dir
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+// envMap returns a getenv function backed by env
+func envMap(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("default config is invalid: %v", err)
+	}
+	if cfg.Listen != ":8080" {
+		t.Errorf("expected default listen :8080, got %s", cfg.Listen)
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"listen": ":9000",
+		"enabled_commands": ["sysinfo"],
+		"ping_limits": {"max_count": 10, "min_interval": "500ms", "max_timeout": "20s", "max_size": 64, "min_ttl": 1, "max_ttl": 64},
+		"log": {"level": "debug"}
+	}`)
+
+	// file only
+	cfg, _, err := LoadConfig([]string{"--config", path}, envMap(nil))
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	if cfg.Listen != ":9000" || cfg.Log.Level != LogLevelDebug {
+		t.Errorf("expected file settings, got %+v", cfg)
+	}
+	if cfg.PingLimits.MaxCount != 10 || cfg.PingLimits.MinInterval != Duration(500*time.Millisecond) {
+		t.Errorf("expected file ping limits, got %+v", cfg.PingLimits)
+	}
+
+	// environment beats the file, and can name the file
+	env := map[string]string{"ESPRESSO_CONFIG": path, "ESPRESSO_LISTEN": ":9100", "ESPRESSO_ENABLED_COMMANDS": "ping, sysinfo"}
+	cfg, _, err = LoadConfig(nil, envMap(env))
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	if cfg.Listen != ":9100" {
+		t.Errorf("expected environment listen :9100, got %s", cfg.Listen)
+	}
+	if strings.Join(cfg.EnabledCommands, ",") != "ping,sysinfo" {
+		t.Errorf("expected environment commands, got %v", cfg.EnabledCommands)
+	}
+	if cfg.Log.Level != LogLevelDebug {
+		t.Errorf("expected file log level to be kept, got %s", cfg.Log.Level)
+	}
+
+	// flags beat everything
+	cfg, _, err = LoadConfig([]string{"--listen", "127.0.0.1:9200", "--log-level", "info"}, envMap(env))
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	if cfg.Listen != "127.0.0.1:9200" || cfg.Log.Level != LogLevelInfo {
+		t.Errorf("expected flag settings, got %+v", cfg)
+	}
+}
+
+func TestLoadConfig_PrintConfig(t *testing.T) {
+	cfg, printConfig, err := LoadConfig([]string{"--print-config"}, envMap(nil))
+	if err != nil {
+		t.Fatalf("LoadConfig() returned error: %v", err)
+	}
+	if !printConfig {
+		t.Error("expected --print-config to be reported")
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("Print() returned error: %v", err)
+	}
+	var printed Config
+	if err := json.Unmarshal(buf.Bytes(), &printed); err != nil {
+		t.Fatalf("printed config is not valid JSON: %v", err)
+	}
+	if printed.Listen != cfg.Listen || printed.PingLimits != cfg.PingLimits {
+		t.Errorf("printed config does not round trip: %+v", printed)
+	}
+}
+
+func TestConfig_PrintRedactsSecrets(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Auth.Keys = []APIKey{{Label: "admin", Hash: HashAPIKey("admin-secret")}}
+	cfg.Alerts.Webhooks = []WebhookConfig{{Name: "ops", URL: "https://example.com/hook", Secret: "hmac-secret"}}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("Print() returned error: %v", err)
+	}
+	for _, secret := range []string{"hmac-secret", HashAPIKey("admin-secret")} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("expected %s to be redacted, got %s", secret, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), `"label": "admin"`) || !strings.Contains(buf.String(), `"name": "ops"`) {
+		t.Errorf("expected the rest of the config to be printed, got %s", buf.String())
+	}
+	// the config itself is left alone
+	if cfg.Alerts.Webhooks[0].Secret != "hmac-secret" || cfg.Auth.Keys[0].Hash != HashAPIKey("admin-secret") {
+		t.Error("expected Print not to change the config")
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		file string
+		env  map[string]string
+	}{
+		{name: "missing file", args: []string{"--config", "/nonexistent/config.json"}},
+		{name: "unknown field", file: `{"listen": ":8080", "lsiten": ":9000"}`},
+		{name: "invalid json", file: `{"listen":`},
+		{name: "invalid port", args: []string{"--listen", ":http-alt"}},
+		{name: "port out of range", env: map[string]string{"ESPRESSO_LISTEN": ":70000"}},
+		{name: "missing port", args: []string{"--listen", "localhost"}},
+		{name: "tls without key", args: []string{"--tls-cert", "cert.pem"}},
+		{name: "tls files missing", args: []string{"--tls-cert", "/nonexistent/cert.pem", "--tls-key", "/nonexistent/key.pem"}},
+		{name: "unknown command", args: []string{"--enabled-commands", "ping,reboot"}},
+		{name: "self-signed with files", args: []string{"--tls-self-signed", "--tls-cert", "cert.pem", "--tls-key", "key.pem"}},
+		{name: "client ca without tls", args: []string{"--tls-client-ca", "ca.pem"}},
+		{name: "auth without keys", args: []string{"--auth", "true"}},
+		{name: "invalid auth flag", env: map[string]string{"ESPRESSO_AUTH": "maybe"}},
+		{name: "invalid key hash", file: `{"auth": {"keys": [{"label": "ci", "hash": "plaintext"}]}}`},
+		{name: "duplicate key label", file: `{"auth": {"keys": [{"label": "ci", "hash": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"}, {"label": "ci", "hash": "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"}]}}`},
+		{name: "key file missing", args: []string{"--auth-key-file", "/nonexistent/keys.json"}},
+		{name: "invalid policy effect", file: `{"policy": {"rules": [{"commands": ["ping"], "effect": "permit"}]}}`},
+		{name: "policy unknown command", file: `{"policy": {"rules": [{"commands": ["reboot"], "effect": "deny"}]}}`},
+		{name: "limits unknown command", file: `{"limits": {"max_concurrent_per_command": {"reboot": 1}}}`},
+		{name: "duplicate monitor", file: `{"monitors": [{"name": "gw", "target": "192.0.2.1", "interval": "1m"}, {"name": "gw", "target": "192.0.2.2", "interval": "1m"}]}`},
+		{name: "negative history retention", file: `{"history": {"path": "history.db", "retention": "-1h"}}`},
+		{name: "no job workers", file: `{"jobs": {"workers": 0, "queue_size": 10, "expiry": "1h"}}`},
+		{name: "no batch parallelism", file: `{"batch": {"max_parallel": 0, "max_requests": 10}}`},
+		{name: "too many traceroute hops", file: `{"traceroute_limits": {"max_hops": 300, "max_probes": 3, "max_timeout": "5s"}}`},
+		{name: "no sweep hosts", file: `{"sweep_limits": {"max_hosts": 0, "max_concurrency": 8, "max_timeout": "5s"}}`},
+		{name: "unknown log level", args: []string{"--log-level", "verbose"}},
+		{name: "limits below defaults", file: `{"ping_limits": {"max_count": 2, "max_timeout": "5s", "max_size": 64, "min_ttl": 1, "max_ttl": 64}}`},
+		{name: "invalid ttl limits", file: `{"ping_limits": {"max_count": 10, "max_timeout": "20s", "max_size": 64, "min_ttl": 64, "max_ttl": 1}}`},
+		{name: "unknown flag", args: []string{"--port", "8080"}},
+		{name: "extra arguments", args: []string{"serve"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"--config", writeConfigFile(t, tt.file)}, args...)
+			}
+			if _, _, err := LoadConfig(args, envMap(tt.env)); err == nil {
+				t.Error("expected LoadConfig() to fail")
+			}
+		})
+	}
+}
+
+func TestNewDefaultRegistry_EnabledCommands(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EnabledCommands = []string{"sysinfo"}
+
+	registry := NewDefaultRegistry(&mockCommander{}, cfg)
+
+	if _, ok := registry.Lookup("sysinfo"); !ok {
+		t.Error("expected sysinfo to be enabled")
+	}
+	if _, ok := registry.Lookup("ping"); ok {
+		t.Error("expected ping to be disabled")
+	}
+	if len(NewDefaultRegistry(&mockCommander{}, DefaultConfig()).Commands()) != 4 {
+		t.Error("expected every command to be enabled by default")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// ErrorCode is the machine-readable error identifier sent to clients
+type ErrorCode string
+
+// Error codes returned in CommandResponse.Code
+const (
+    ErrCodeInvalidJSON      ErrorCode = "invalid_json"
+    ErrCodeInvalidRequest   ErrorCode = "invalid_request"
+    ErrCodeUnknownCommand   ErrorCode = "unknown_command"
+    ErrCodeUnauthorized     ErrorCode = "unauthorized"
+    ErrCodeForbidden        ErrorCode = "forbidden"
+    ErrCodeTargetRefused    ErrorCode = "target_refused"
+    ErrCodeNotFound         ErrorCode = "not_found"
+    ErrCodeMethodNotAllowed ErrorCode = "method_not_allowed"
+    ErrCodeBodyTooLarge     ErrorCode = "body_too_large"
+    ErrCodeUnsupportedMedia ErrorCode = "unsupported_media_type"
+    ErrCodeUnresolvableHost ErrorCode = "unresolvable_host"
+    ErrCodeRateLimited      ErrorCode = "rate_limited"
+    ErrCodeTooBusy          ErrorCode = "too_busy"
+    ErrCodeTimeout          ErrorCode = "timeout"
+    ErrCodeCancelled        ErrorCode = "cancelled"
+    ErrCodeInternal         ErrorCode = "internal"
+)
+
+// StatusClientClosedRequest is used when the client went away before the
+// command finished, nobody reads it but it keeps the logs honest
+const StatusClientClosedRequest = 499
+
+// errorStatus maps each error code onto an HTTP status
+var errorStatus = map[ErrorCode]int{
+    ErrCodeInvalidJSON:      http.StatusBadRequest,
+    ErrCodeInvalidRequest:   http.StatusBadRequest,
+    ErrCodeUnknownCommand:   http.StatusBadRequest,
+    ErrCodeUnauthorized:     http.StatusUnauthorized,
+    ErrCodeForbidden:        http.StatusForbidden,
+    ErrCodeTargetRefused:    http.StatusForbidden,
+    ErrCodeNotFound:         http.StatusNotFound,
+    ErrCodeMethodNotAllowed: http.StatusMethodNotAllowed,
+    ErrCodeBodyTooLarge:     http.StatusRequestEntityTooLarge,
+    ErrCodeUnsupportedMedia: http.StatusUnsupportedMediaType,
+    ErrCodeUnresolvableHost: http.StatusUnprocessableEntity,
+    ErrCodeRateLimited:      http.StatusTooManyRequests,
+    ErrCodeTooBusy:          http.StatusTooManyRequests,
+    ErrCodeTimeout:          http.StatusGatewayTimeout,
+    ErrCodeCancelled:        StatusClientClosedRequest,
+    ErrCodeInternal:         http.StatusInternalServerError,
+}
+
+// CommandError is an error with a code and HTTP status for the client
+type CommandError struct {
+    Code    ErrorCode
+    Message string
+    Err     error
+    // RetryAfter is sent as the Retry-After header when set
+    RetryAfter time.Duration
+}
+
+// NewCommandError creates a CommandError, the message defaults to err's text
+func NewCommandError(code ErrorCode, err error) *CommandError {
+    e := &CommandError{Code: code, Err: err}
+    if err != nil {
+        e.Message = err.Error()
+    }
+    return e
+}
+
+func (e *CommandError) Error() string {
+    return e.Message
+}
+
+func (e *CommandError) Unwrap() error {
+    return e.Err
+}
+
+// Status returns the HTTP status for the error code
+func (e *CommandError) Status() int {
+    if status, ok := errorStatus[e.Code]; ok {
+        return status
+    }
+    return http.StatusInternalServerError
+}
+
+// asCommandError classifies any error returned while handling a command
+func asCommandError(err error) *CommandError {
+    var cmdErr *CommandError
+    var dnsErr *net.DNSError
+    var maxBytesErr *http.MaxBytesError
+    switch {
+    case errors.As(err, &cmdErr):
+        return cmdErr
+    case errors.As(err, &maxBytesErr):
+        return NewCommandError(ErrCodeBodyTooLarge, err)
+    case errors.Is(err, context.DeadlineExceeded):
+        return NewCommandError(ErrCodeTimeout, err)
+    case errors.Is(err, context.Canceled):
+        return NewCommandError(ErrCodeCancelled, err)
+    case errors.Is(err, ErrTargetRefused):
+        return NewCommandError(ErrCodeTargetRefused, err)
+    case errors.Is(err, ErrUnresolvableHost), errors.As(err, &dnsErr):
+        return NewCommandError(ErrCodeUnresolvableHost, err)
+    default:
+        return NewCommandError(ErrCodeInternal, err)
+    }
+}
+
+// writeResponse encodes res as the JSON body with the given status
+func writeResponse(w http.ResponseWriter, status int, res CommandResponse) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    err := json.NewEncoder(w).Encode(res)
+    if err != nil {
+        log.Printf("Failed to write response: %v\n", err)
+    }
+}
+
+// writeError sends err as a CommandResponse, data is included so partial
+// results such as a timed out ping still reach the client
+func writeError(w http.ResponseWriter, err error, data interface{}) {
+    cmdErr := asCommandError(err)
+    if cmdErr.RetryAfter > 0 {
+        seconds := int(math.Ceil(cmdErr.RetryAfter.Seconds()))
+        w.Header().Set("Retry-After", strconv.Itoa(seconds))
+    }
+    writeResponse(w, cmdErr.Status(), errorResponse(cmdErr, data))
+}
+
+// errorResponse builds the CommandResponse for err, for responses that are
+// not written on their own such as streamed or batched ones
+func errorResponse(err error, data interface{}) CommandResponse {
+    cmdErr := asCommandError(err)
+    return CommandResponse{
+        Success: false,
+        Data:    data,
+        Code:    cmdErr.Code,
+        Error:   cmdErr.Error(),
+    }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAsCommandError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedCode   ErrorCode
+		expectedStatus int
+	}{
+		{
+			name:           "command error",
+			err:            NewCommandError(ErrCodeInvalidJSON, errors.New("bad json")),
+			expectedCode:   ErrCodeInvalidJSON,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "wrapped command error",
+			err:            fmt.Errorf("handling: %w", NewCommandError(ErrCodeNotFound, errors.New("missing"))),
+			expectedCode:   ErrCodeNotFound,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "deadline exceeded",
+			err:            fmt.Errorf("ping: %w", context.DeadlineExceeded),
+			expectedCode:   ErrCodeTimeout,
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:           "cancelled",
+			err:            context.Canceled,
+			expectedCode:   ErrCodeCancelled,
+			expectedStatus: StatusClientClosedRequest,
+		},
+		{
+			name:           "unresolvable host",
+			err:            fmt.Errorf("%w example.invalid", ErrUnresolvableHost),
+			expectedCode:   ErrCodeUnresolvableHost,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "target refused",
+			err:            fmt.Errorf("%w: 224.0.0.1 is a multicast address", ErrTargetRefused),
+			expectedCode:   ErrCodeTargetRefused,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "dns error",
+			err:            &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true},
+			expectedCode:   ErrCodeUnresolvableHost,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "anything else",
+			err:            errors.New("boom"),
+			expectedCode:   ErrCodeInternal,
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmdErr := asCommandError(tt.err)
+			if cmdErr.Code != tt.expectedCode {
+				t.Errorf("expected code %s, got %s", tt.expectedCode, cmdErr.Code)
+			}
+			if cmdErr.Status() != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, cmdErr.Status())
+			}
+			if !errors.Is(cmdErr, tt.err) && !errors.Is(tt.err, cmdErr) {
+				t.Errorf("expected %v to wrap %v", cmdErr, tt.err)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	writeError(rec, NewCommandError(ErrCodeInvalidRequest, errors.New("payload must be a host")), nil)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %s", ct)
+	}
+	var res CommandResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if res.Success || res.Code != ErrCodeInvalidRequest || res.Error != "payload must be a host" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "time"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+// History defaults
+const (
+    DefaultHistoryRetention  = 30 * 24 * time.Hour
+    DefaultHistoryMaxEntries = 100000
+    DefaultHistoryPageSize   = 50
+    MaxHistoryPageSize       = 500
+    historyPruneInterval     = time.Hour
+)
+
+// historyBucket holds the entries keyed by their big-endian ID
+var historyBucket = []byte("history")
+
+// HistoryConfig struct for the on-disk command history, it is disabled
+// when Path is empty
+type HistoryConfig struct {
+    Path       string   `json:"path"`
+    Retention  Duration `json:"retention"`
+    MaxEntries int      `json:"max_entries"`
+}
+
+// Validate checks the retention limits
+func (h HistoryConfig) Validate() error {
+    if h.Retention < 0 {
+        return errors.New("retention must not be negative")
+    }
+    if h.MaxEntries < 0 {
+        return errors.New("max_entries must not be negative")
+    }
+    return nil
+}
+
+// HistoryEntry struct for one executed command, durations are in
+// nanoseconds like PingResult
+type HistoryEntry struct {
+    ID         uint64          `json:"id"`
+    Type       string          `json:"type"`
+    Payload    string          `json:"payload"`
+    Options    json.RawMessage `json:"options,omitempty"`
+    Caller     string          `json:"caller"`
+    ClientIP   string          `json:"client_ip,omitempty"`
+    StartedAt  time.Time       `json:"started_at"`
+    FinishedAt time.Time       `json:"finished_at"`
+    Duration   time.Duration   `json:"duration"`
+    Success    bool            `json:"success"`
+    Code       ErrorCode       `json:"code,omitempty"`
+    Error      string          `json:"error,omitempty"`
+    Result     json.RawMessage `json:"result"`
+}
+
+// HistoryQuery struct for filtering and paging the history, zero values
+// match everything
+type HistoryQuery struct {
+    Type    string
+    Target  string
+    Caller  string
+    Since   time.Time
+    Until   time.Time
+    Success *bool
+    Before  uint64 // only entries with a lower ID, for paging
+    Limit   int
+}
+
+// matches reports whether e passes the query's filters
+func (q HistoryQuery) matches(e HistoryEntry) bool {
+    switch {
+    case q.Type != "" && e.Type != q.Type:
+        return false
+    case q.Target != "" && e.Payload != q.Target:
+        return false
+    case q.Caller != "" && e.Caller != q.Caller:
+        return false
+    case !q.Since.IsZero() && e.StartedAt.Before(q.Since):
+        return false
+    case !q.Until.IsZero() && e.StartedAt.After(q.Until):
+        return false
+    case q.Success != nil && e.Success != *q.Success:
+        return false
+    }
+    return true
+}
+
+// HistoryPage struct for one page of query results, newest first
+type HistoryPage struct {
+    Entries []HistoryEntry `json:"entries"`
+    // Next is the before value for the following page, 0 on the last page
+    Next uint64 `json:"next,omitempty"`
+}
+
+// History struct for the embedded store of executed commands
+type History struct {
+    cfg HistoryConfig
+    db  *bolt.DB
+    now func() time.Time
+
+    stop chan struct{}
+    once sync.Once
+    wg   sync.WaitGroup
+}
+
+// OpenHistory opens or creates the store at cfg.Path and starts pruning
+// entries past the retention limits
+func OpenHistory(cfg HistoryConfig) (*History, error) {
+    if cfg.Retention == 0 {
+        cfg.Retention = Duration(DefaultHistoryRetention)
+    }
+    if cfg.MaxEntries == 0 {
+        cfg.MaxEntries = DefaultHistoryMaxEntries
+    }
+    err := os.MkdirAll(filepath.Dir(cfg.Path), 0755)
+    if err != nil {
+        return nil, fmt.Errorf("creating history directory: %w", err)
+    }
+    // the timeout stops a second daemon from hanging on the file lock
+    db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second})
+    if err != nil {
+        return nil, fmt.Errorf("opening history %s: %w", cfg.Path, err)
+    }
+    err = db.Update(func(tx *bolt.Tx) error {
+        _, err := tx.CreateBucketIfNotExists(historyBucket)
+        return err
+    })
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("opening history %s: %w", cfg.Path, err)
+    }
+
+    h := &History{cfg: cfg, db: db, now: time.Now, stop: make(chan struct{})}
+    err = h.Prune()
+    if err != nil {
+        db.Close()
+        return nil, fmt.Errorf("pruning history %s: %w", cfg.Path, err)
+    }
+    h.wg.Add(1)
+    go func() {
+        defer h.wg.Done()
+        ticker := time.NewTicker(historyPruneInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-h.stop:
+                return
+            case <-ticker.C:
+                if err := h.Prune(); err != nil {
+                    log.Printf("Failed to prune history: %v\n", err)
+                }
+            }
+        }
+    }()
+    return h, nil
+}
+
+// Record stores e, assigning its ID
+func (h *History) Record(e HistoryEntry) error {
+    return h.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(historyBucket)
+        id, err := b.NextSequence()
+        if err != nil {
+            return err
+        }
+        e.ID = id
+        data, err := json.Marshal(e)
+        if err != nil {
+            return err
+        }
+        return b.Put(historyKey(id), data)
+    })
+}
+
+// Query returns the newest entries matching q
+func (h *History) Query(q HistoryQuery) (HistoryPage, error) {
+    if q.Limit <= 0 {
+        q.Limit = DefaultHistoryPageSize
+    }
+    page := HistoryPage{Entries: []HistoryEntry{}}
+    err := h.db.View(func(tx *bolt.Tx) error {
+        c := tx.Bucket(historyBucket).Cursor()
+        var k, v []byte
+        if q.Before > 0 {
+            // position on the first key before q.Before
+            k, v = c.Seek(historyKey(q.Before))
+            if k == nil {
+                k, v = c.Last()
+            } else {
+                k, v = c.Prev()
+            }
+        } else {
+            k, v = c.Last()
+        }
+        for ; k != nil; k, v = c.Prev() {
+            var e HistoryEntry
+            if err := json.Unmarshal(v, &e); err != nil {
+                return fmt.Errorf("decoding history entry %d: %w", binary.BigEndian.Uint64(k), err)
+            }
+            // entries are stored as they finish, nothing older can match
+            if !q.Since.IsZero() && e.FinishedAt.Before(q.Since) {
+                break
+            }
+            if !q.matches(e) {
+                continue
+            }
+            if len(page.Entries) == q.Limit {
+                page.Next = page.Entries[len(page.Entries)-1].ID
+                break
+            }
+            page.Entries = append(page.Entries, e)
+        }
+        return nil
+    })
+    return page, err
+}
+
+// Prune deletes entries older than the retention period and the oldest
+// entries over the maximum count
+func (h *History) Prune() error {
+    cutoff := h.now().Add(-time.Duration(h.cfg.Retention))
+    return h.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket(historyBucket)
+        excess := b.Stats().KeyN - h.cfg.MaxEntries
+        c := b.Cursor()
+        for k, v := c.First(); k != nil; k, v = c.Next() {
+            var e HistoryEntry
+            if excess <= 0 {
+                if err := json.Unmarshal(v, &e); err == nil && !e.FinishedAt.Before(cutoff) {
+                    return nil
+                }
+            }
+            if err := c.Delete(); err != nil {
+                return err
+            }
+            excess--
+        }
+        return nil
+    })
+}
+
+// Close stops pruning and closes the store
+func (h *History) Close() error {
+    h.once.Do(func() { close(h.stop) })
+    h.wg.Wait()
+    return h.db.Close()
+}
+
+// historyKey encodes id so keys sort in the order they were recorded
+func historyKey(id uint64) []byte {
+    key := make([]byte, 8)
+    binary.BigEndian.PutUint64(key, id)
+    return key
+}
+
+// handleHistory lists recorded commands filtered by the query parameters
+// type, target, caller, since, until, success, before and limit, callers
+// without PermissionHistory only see their own commands
+func handleHistory(h *History) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        q, err := parseHistoryQuery(r)
+        if err != nil {
+            writeError(w, NewCommandError(ErrCodeInvalidRequest, err), nil)
+            return
+        }
+        if principal := principalFrom(r.Context()); !principal.Can(PermissionHistory) {
+            if q.Caller != "" && q.Caller != principal.Label {
+                writeError(w, NewCommandError(ErrCodeForbidden, fmt.Errorf("%s permission required", PermissionHistory)), nil)
+                return
+            }
+            q.Caller = principal.Label
+        }
+        page, err := h.Query(q)
+        if err != nil {
+            writeError(w, err, nil)
+            return
+        }
+        writeResponse(w, http.StatusOK, CommandResponse{Success: true, Data: page})
+    }
+}
+
+// parseHistoryQuery reads a HistoryQuery from the URL query
+func parseHistoryQuery(r *http.Request) (HistoryQuery, error) {
+    values := r.URL.Query()
+    q := HistoryQuery{
+        Type:   values.Get("type"),
+        Target: values.Get("target"),
+        Caller: values.Get("caller"),
+        Limit:  DefaultHistoryPageSize,
+    }
+    var err error
+    for name, field := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+        if v := values.Get(name); v != "" {
+            if *field, err = time.Parse(time.RFC3339, v); err != nil {
+                return HistoryQuery{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+            }
+        }
+    }
+    if v := values.Get("success"); v != "" {
+        success, err := strconv.ParseBool(v)
+        if err != nil {
+            return HistoryQuery{}, errors.New("success must be true or false")
+        }
+        q.Success = &success
+    }
+    if v := values.Get("before"); v != "" {
+        if q.Before, err = strconv.ParseUint(v, 10, 64); err != nil {
+            return HistoryQuery{}, errors.New("before must be an entry id")
+        }
+    }
+    if v := values.Get("limit"); v != "" {
+        if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > MaxHistoryPageSize {
+            return HistoryQuery{}, fmt.Errorf("limit must be between 1 and %d", MaxHistoryPageSize)
+        }
+    }
+    return q, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestHistory opens a history in a temporary directory that is closed
+// when the test ends
+func openTestHistory(t *testing.T, cfg HistoryConfig) *History {
+	t.Helper()
+	if cfg.Path == "" {
+		cfg.Path = filepath.Join(t.TempDir(), "history.db")
+	}
+	h, err := OpenHistory(cfg)
+	if err != nil {
+		t.Fatalf("OpenHistory: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// queryHistory decodes GET /history?query from handler
+func queryHistory(t *testing.T, handler http.Handler, query string) (int, HistoryPage) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/history?"+query, nil))
+	var res struct {
+		Data HistoryPage `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return rec.Code, res.Data
+}
+
+func TestHistory_RecordedByExecute(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.History.Path = filepath.Join(t.TempDir(), "history.db")
+	cmdr := &mockCommander{pingResult: PingResult{Successful: true, Host: "example.com", PacketsSent: 4, PacketsRecv: 4}}
+	handler := handleRequests(newTestServer(t, cmdr, cfg))
+
+	for _, body := range []string{
+		`{"type":"ping","payload":"example.com","options":{"count":4}}`,
+		`{"type":"sysinfo"}`,
+		`{"type":"ping","payload":""}`,
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/execute", strings.NewReader(body)))
+	}
+
+	code, page := queryHistory(t, handler, "")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if len(page.Entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(page.Entries))
+	}
+	failed, sysinfo, ping := page.Entries[0], page.Entries[1], page.Entries[2]
+	if ping.Type != "ping" || ping.Payload != "example.com" || ping.Caller != "anonymous" || !ping.Success {
+		t.Errorf("unexpected ping entry %+v", ping)
+	}
+	if string(ping.Options) != `{"count":4}` {
+		t.Errorf("expected the options to be kept, got %s", ping.Options)
+	}
+	if ping.ClientIP != "192.0.2.1" {
+		t.Errorf("expected the client IP, got %q", ping.ClientIP)
+	}
+	if ping.StartedAt.IsZero() || ping.FinishedAt.Before(ping.StartedAt) || ping.Duration < 0 {
+		t.Errorf("unexpected timestamps %v %v %v", ping.StartedAt, ping.FinishedAt, ping.Duration)
+	}
+	var result PingResult
+	if err := json.Unmarshal(ping.Result, &result); err != nil || result.PacketsRecv != 4 {
+		t.Errorf("expected the full ping result, got %s", ping.Result)
+	}
+	if sysinfo.Type != "sysinfo" || !sysinfo.Success {
+		t.Errorf("unexpected sysinfo entry %+v", sysinfo)
+	}
+	if failed.Success || failed.Code != ErrCodeInvalidRequest || failed.Error == "" {
+		t.Errorf("expected the failure to be recorded, got %+v", failed)
+	}
+}
+
+func TestHistory_OtherCallers(t *testing.T) {
+	cfg := authConfig()
+	cfg.History.Path = filepath.Join(t.TempDir(), "history.db")
+	handler := handleRequests(newTestServer(t, &mockCommander{}, cfg))
+
+	for key, body := range map[string]string{
+		"admin-secret":   `{"type":"ping","payload":"example.com"}`,
+		"monitor-secret": `{"type":"sysinfo"}`,
+	} {
+		req := httptest.NewRequest("POST", "/execute", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	query := func(key, query string) (int, HistoryPage) {
+		req := httptest.NewRequest("GET", "/history?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var res struct {
+			Data HistoryPage `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&res)
+		return rec.Code, res.Data
+	}
+
+	// the monitoring key only sees its own commands
+	code, page := query("monitor-secret", "")
+	if code != http.StatusOK || len(page.Entries) != 1 || page.Entries[0].Caller != "monitor" {
+		t.Errorf("expected only the monitor's entry, got %d %+v", code, page.Entries)
+	}
+	if code, _ := query("monitor-secret", "caller=admin"); code != http.StatusForbidden {
+		t.Errorf("expected status 403 for another caller's history, got %d", code)
+	}
+	// a key with every permission sees everyone's
+	code, page = query("admin-secret", "")
+	if code != http.StatusOK || len(page.Entries) != 2 {
+		t.Errorf("expected both entries, got %d %+v", code, page.Entries)
+	}
+}
+
+func TestHistory_Query(t *testing.T) {
+	h := openTestHistory(t, HistoryConfig{})
+	base := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	for i, e := range []HistoryEntry{
+		{Type: "ping", Payload: "a.example", Caller: "admin", Success: true},
+		{Type: "ping", Payload: "b.example", Caller: "admin", Success: false},
+		{Type: "sysinfo", Caller: "monitor", Success: true},
+		{Type: "ping", Payload: "a.example", Caller: "monitor", Success: false},
+	} {
+		e.StartedAt = base.Add(time.Duration(i) * time.Hour)
+		e.FinishedAt = e.StartedAt.Add(time.Second)
+		if err := h.Record(e); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	no := false
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  []uint64
+	}{
+		{"all", HistoryQuery{}, []uint64{4, 3, 2, 1}},
+		{"type", HistoryQuery{Type: "ping"}, []uint64{4, 2, 1}},
+		{"target", HistoryQuery{Target: "a.example"}, []uint64{4, 1}},
+		{"caller", HistoryQuery{Caller: "monitor"}, []uint64{4, 3}},
+		{"failed", HistoryQuery{Success: &no}, []uint64{4, 2}},
+		{"since", HistoryQuery{Since: base.Add(2 * time.Hour)}, []uint64{4, 3}},
+		{"until", HistoryQuery{Until: base.Add(time.Hour)}, []uint64{2, 1}},
+		{"before", HistoryQuery{Before: 3}, []uint64{2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := h.Query(tt.query)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			var got []uint64
+			for _, e := range page.Entries {
+				got = append(got, e.ID)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected entries %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("expected entries %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestHistory_Pagination(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.History.Path = filepath.Join(t.TempDir(), "history.db")
+	s := newTestServer(t, &mockCommander{}, cfg)
+	for i := 0; i < 5; i++ {
+		if err := s.history.Record(HistoryEntry{Type: "sysinfo", FinishedAt: time.Now()}); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	handler := handleRequests(s)
+
+	var ids []uint64
+	query := "limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("expected pagination to end")
+		}
+		code, page := queryHistory(t, handler, query)
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+		for _, e := range page.Entries {
+			ids = append(ids, e.ID)
+		}
+		if page.Next == 0 {
+			break
+		}
+		query = "limit=2&before=" + jsonString(t, page.Next)
+	}
+	if len(ids) != 5 || ids[0] != 5 || ids[4] != 1 {
+		t.Errorf("expected ids 5 to 1, got %v", ids)
+	}
+}
+
+func TestHistory_InvalidQuery(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.History.Path = filepath.Join(t.TempDir(), "history.db")
+	handler := handleRequests(newTestServer(t, &mockCommander{}, cfg))
+
+	for _, query := range []string{
+		"since=yesterday",
+		"until=1700000000",
+		"success=maybe",
+		"before=-1",
+		"limit=0",
+		"limit=100000",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/history?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestHistory_Disabled(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &mockCommander{}, DefaultConfig()))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/history", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+}
+
+func TestHistory_Retention(t *testing.T) {
+	h := openTestHistory(t, HistoryConfig{Retention: Duration(24 * time.Hour), MaxEntries: 3})
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	for _, age := range []time.Duration{72 * time.Hour, 48 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour, 0} {
+		if err := h.Record(HistoryEntry{Type: "ping", FinishedAt: now.Add(-age)}); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+
+	if err := h.Prune(); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	page, err := h.Query(HistoryQuery{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	// the two expired entries go, then the oldest over the maximum
+	if len(page.Entries) != 3 || page.Entries[2].ID != 4 {
+		t.Errorf("expected entries 6 to 4 to be kept, got %+v", page.Entries)
+	}
+}
+
+func TestHistory_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := OpenHistory(HistoryConfig{Path: path})
+	if err != nil {
+		t.Fatalf("OpenHistory: %v", err)
+	}
+	if err := h.Record(HistoryEntry{Type: "ping", Payload: "example.com", FinishedAt: time.Now()}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	h.Close()
+
+	h = openTestHistory(t, HistoryConfig{Path: path})
+	if err := h.Record(HistoryEntry{Type: "sysinfo", FinishedAt: time.Now()}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	page, err := h.Query(HistoryQuery{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(page.Entries) != 2 || page.Entries[1].Payload != "example.com" || page.Entries[0].ID != 2 {
+		t.Errorf("expected the entry to survive a restart, got %+v", page.Entries)
+	}
+}
+
+// jsonString formats v as it appears in JSON
+func jsonString(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -49,11 +49,16 @@ echo "Creating package structure..."
 # Create directories in package root
 mkdir -p "$PKG_ROOT/usr/local/bin"
 mkdir -p "$PKG_ROOT/Library/LaunchDaemons"
+mkdir -p "$PKG_ROOT/usr/local/etc"
 
 # Copy binary
 cp "$PROJECT_DIR/bin/$BINARY_NAME" "$PKG_ROOT/usr/local/bin/"
 chmod 755 "$PKG_ROOT/usr/local/bin/$BINARY_NAME"
 
+# Copy the default config, postinstall only uses it when none exists
+cp "$SCRIPT_DIR/config.json" "$PKG_ROOT/usr/local/etc/espresso-commander.json.default"
+chmod 644 "$PKG_ROOT/usr/local/etc/espresso-commander.json.default"
+
 # Copy LaunchDaemon plist
 cp "$SCRIPT_DIR/io.mcred.espresso-commander.plist" "$PKG_ROOT/Library/LaunchDaemons/"
 chmod 644 "$PKG_ROOT/Library/LaunchDaemons/io.mcred.espresso-commander.plist"
@@ -64,6 +69,12 @@ cat > "$PKG_SCRIPTS/postinstall" << 'EOF'
 
 # Post-installation script for Espresso Commander
 
+# Install the default config unless one already exists
+if [ ! -f /usr/local/etc/espresso-commander.json ]; then
+    cp /usr/local/etc/espresso-commander.json.default /usr/local/etc/espresso-commander.json
+    chmod 644 /usr/local/etc/espresso-commander.json
+fi
+
 # Create log files
 touch /var/log/espresso-commander.log
 touch /var/log/espresso-commander.error.log
@@ -10,6 +10,8 @@ INSTALL_DIR="/usr/local/bin"
 LAUNCHD_DIR="/Library/LaunchDaemons"
 PLIST_NAME="io.mcred.espresso-commander.plist"
 LOG_DIR="/var/log"
+CONFIG_DIR="/usr/local/etc"
+CONFIG_NAME="espresso-commander.json"
 
 # Colors for output
 RED='\033[0;31m'
@@ -37,6 +39,7 @@ echo -e "${GREEN}Installing Espresso Commander...${NC}"
 # Create directories if they don't exist
 mkdir -p "$INSTALL_DIR"
 mkdir -p "$LOG_DIR"
+mkdir -p "$CONFIG_DIR"
 
 # Stop existing service if running
 if launchctl list | grep -q "io.mcred.espresso-commander"; then
@@ -49,6 +52,15 @@ echo "Installing binary to $INSTALL_DIR..."
 cp "./bin/$BINARY_NAME" "$INSTALL_DIR/$BINARY_NAME"
 chmod 755 "$INSTALL_DIR/$BINARY_NAME"
 
+# Copy the default config, keeping any existing one
+if [ ! -f "$CONFIG_DIR/$CONFIG_NAME" ]; then
+    echo "Installing config to $CONFIG_DIR..."
+    cp "./installer/config.json" "$CONFIG_DIR/$CONFIG_NAME"
+    chmod 644 "$CONFIG_DIR/$CONFIG_NAME"
+else
+    echo "Keeping existing config at $CONFIG_DIR/$CONFIG_NAME"
+fi
+
 # Copy LaunchDaemon plist
 echo "Installing LaunchDaemon..."
 cp "./installer/$PLIST_NAME" "$LAUNCHD_DIR/$PLIST_NAME"
@@ -71,6 +83,7 @@ if launchctl list | grep -q "io.mcred.espresso-commander"; then
     echo ""
     echo "Service Information:"
     echo "  - Binary: $INSTALL_DIR/$BINARY_NAME"
+    echo "  - Config: $CONFIG_DIR/$CONFIG_NAME"
     echo "  - Service: io.mcred.espresso-commander"
     echo "  - Logs: $LOG_DIR/espresso-commander.log"
     echo "  - Errors: $LOG_DIR/espresso-commander.error.log"
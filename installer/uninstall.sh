@@ -10,6 +10,8 @@ INSTALL_DIR="/usr/local/bin"
 LAUNCHD_DIR="/Library/LaunchDaemons"
 PLIST_NAME="io.mcred.espresso-commander.plist"
 LOG_DIR="/var/log"
+CONFIG_DIR="/usr/local/etc"
+CONFIG_NAME="espresso-commander.json"
 
 # Colors for output
 RED='\033[0;31m'
@@ -54,6 +56,19 @@ if [ -f "$INSTALL_DIR/$BINARY_NAME" ]; then
     rm -f "$INSTALL_DIR/$BINARY_NAME"
 fi
 
+# Ask about the config file
+if [ -f "$CONFIG_DIR/$CONFIG_NAME" ]; then
+    echo -e "${YELLOW}Do you want to remove the config file?${NC}"
+    read -p "Remove config? (y/N): " -n 1 -r
+    echo
+    if [[ $REPLY =~ ^[Yy]$ ]]; then
+        echo "Removing config file..."
+        rm -f "$CONFIG_DIR/$CONFIG_NAME"
+    else
+        echo "Config file preserved at $CONFIG_DIR/$CONFIG_NAME"
+    fi
+fi
+
 # Ask about log files
 echo -e "${YELLOW}Do you want to remove log files?${NC}"
 read -p "Remove logs? (y/N): " -n 1 -r
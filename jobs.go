@@ -0,0 +1,339 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+// JobState is the lifecycle stage of an asynchronous job
+type JobState string
+
+// Job states, a job finishes in one of the last three
+const (
+    JobQueued    JobState = "queued"
+    JobRunning   JobState = "running"
+    JobSucceeded JobState = "succeeded"
+    JobFailed    JobState = "failed"
+    JobCancelled JobState = "cancelled"
+)
+
+// finished reports whether the job has stopped for good
+func (s JobState) finished() bool {
+    return s == JobSucceeded || s == JobFailed || s == JobCancelled
+}
+
+// DefaultJobs are the job settings used when nothing is configured
+var DefaultJobs = JobsConfig{
+    Workers:   4,
+    QueueSize: 100,
+    Expiry:    Duration(time.Hour),
+}
+
+// JobsConfig struct for the asynchronous job worker pool
+type JobsConfig struct {
+    Workers   int `json:"workers"`
+    QueueSize int `json:"queue_size"`
+    // Expiry is how long a finished job can still be fetched
+    Expiry Duration `json:"expiry"`
+}
+
+// Validate checks the pool has workers and somewhere to queue jobs
+func (c JobsConfig) Validate() error {
+    if c.Workers < 1 {
+        return errors.New("workers must be at least 1")
+    }
+    if c.QueueSize < 1 {
+        return errors.New("queue_size must be at least 1")
+    }
+    if c.Expiry <= 0 {
+        return errors.New("expiry must be positive")
+    }
+    return nil
+}
+
+// JobStatus struct for the state and result of a job, result holds the
+// command's data once it finishes
+type JobStatus struct {
+    ID         string          `json:"id"`
+    State      JobState        `json:"state"`
+    Type       string          `json:"type"`
+    Payload    string          `json:"payload"`
+    Options    json.RawMessage `json:"options,omitempty"`
+    Caller     string          `json:"caller"`
+    CreatedAt  time.Time       `json:"created_at"`
+    StartedAt  *time.Time      `json:"started_at,omitempty"`
+    FinishedAt *time.Time      `json:"finished_at,omitempty"`
+    Result     interface{}     `json:"result"`
+    Code       ErrorCode       `json:"code,omitempty"`
+    Error      string          `json:"error,omitempty"`
+}
+
+// executor runs commands for the jobs, Server in the daemon
+type executor interface {
+    Admit(ctx context.Context, req CommandRequest) (context.Context, error)
+    Execute(ctx context.Context, req CommandRequest) (CommandResponse, error)
+}
+
+// job is a submitted command, status is guarded by the Jobs mutex
+type job struct {
+    status    JobStatus
+    req       CommandRequest
+    ctx       context.Context
+    cancel    context.CancelFunc
+    cancelled bool // DELETE was called while running
+}
+
+// Jobs struct for the queue of asynchronous commands and the workers
+// running them
+type Jobs struct {
+    cfg  JobsConfig
+    exec executor
+    now  func() time.Time
+
+    mu    sync.Mutex
+    jobs  map[string]*job
+    queue chan *job
+
+    stop chan struct{}
+    once sync.Once
+    wg   sync.WaitGroup
+}
+
+// NewJobs starts cfg.Workers workers running jobs through exec
+func NewJobs(exec executor, cfg JobsConfig) *Jobs {
+    js := &Jobs{
+        cfg:   cfg,
+        exec:  exec,
+        now:   time.Now,
+        jobs:  make(map[string]*job),
+        queue: make(chan *job, cfg.QueueSize),
+        stop:  make(chan struct{}),
+    }
+    for i := 0; i < cfg.Workers; i++ {
+        js.wg.Add(1)
+        go func() {
+            defer js.wg.Done()
+            for {
+                select {
+                case <-js.stop:
+                    return
+                case j := <-js.queue:
+                    js.run(j)
+                }
+            }
+        }()
+    }
+    return js
+}
+
+// Submit queues req for the caller in ctx, the job keeps the caller and
+// client address but is not cancelled when ctx is. The caller's rate
+// limits apply when the job is submitted, the concurrency caps when it runs
+func (js *Jobs) Submit(ctx context.Context, req CommandRequest) (JobStatus, error) {
+    id, err := newJobID()
+    if err != nil {
+        return JobStatus{}, err
+    }
+
+    js.mu.Lock()
+    defer js.mu.Unlock()
+    js.expire()
+    // only Submit adds to the queue and it holds the lock, so a job that
+    // fits now still fits once admitted
+    if len(js.queue) == cap(js.queue) {
+        err := NewCommandError(ErrCodeTooBusy, errors.New("too many jobs queued"))
+        err.RetryAfter = busyRetryAfter
+        return JobStatus{}, err
+    }
+    ctx, err = js.exec.Admit(ctx, req)
+    if err != nil {
+        return JobStatus{}, err
+    }
+    jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+    j := &job{
+        status: JobStatus{
+            ID:        id,
+            State:     JobQueued,
+            Type:      req.Type,
+            Payload:   req.Payload,
+            Options:   req.Options,
+            Caller:    principalFrom(ctx).Label,
+            CreatedAt: js.now(),
+        },
+        req:    req,
+        ctx:    jobCtx,
+        cancel: cancel,
+    }
+    // workers wait for the lock before looking the job up
+    js.queue <- j
+    js.jobs[id] = j
+    log.Printf("Queued job %s: %s for %s\n", id, req.Type, j.status.Caller)
+    return j.status, nil
+}
+
+// run executes a queued job unless it was cancelled first
+func (js *Jobs) run(j *job) {
+    js.mu.Lock()
+    if j.status.State != JobQueued {
+        js.mu.Unlock()
+        return
+    }
+    started := js.now()
+    j.status.State = JobRunning
+    j.status.StartedAt = &started
+    js.mu.Unlock()
+
+    var res CommandResponse
+    var err error
+    defer func() {
+        if rec := recover(); rec != nil {
+            panicsRecovered.Add(1)
+            log.Printf("Recovered from panic in job %s: %v\n", j.status.ID, rec)
+            err = NewCommandError(ErrCodeInternal, fmt.Errorf("%v", rec))
+        }
+        j.cancel()
+        js.finish(j, res, err)
+    }()
+    res, err = js.exec.Execute(j.ctx, j.req)
+}
+
+// finish records the outcome of a job that ran
+func (js *Jobs) finish(j *job, res CommandResponse, err error) {
+    js.mu.Lock()
+    defer js.mu.Unlock()
+    finished := js.now()
+    j.status.FinishedAt = &finished
+    j.status.Result = res.Data
+    switch {
+    case err == nil:
+        j.status.State = JobSucceeded
+    case j.cancelled:
+        j.status.State = JobCancelled
+    default:
+        j.status.State = JobFailed
+    }
+    if err != nil {
+        cmdErr := asCommandError(err)
+        j.status.Code = cmdErr.Code
+        j.status.Error = cmdErr.Message
+    }
+    log.Printf("Job %s %s\n", j.status.ID, j.status.State)
+}
+
+// Get returns the job with id if it belongs to principal
+func (js *Jobs) Get(id string, principal Principal) (JobStatus, bool) {
+    js.mu.Lock()
+    defer js.mu.Unlock()
+    js.expire()
+    j, ok := js.jobs[id]
+    if !ok || j.status.Caller != principal.Label {
+        return JobStatus{}, false
+    }
+    return j.status, true
+}
+
+// Cancel stops the job with id if it belongs to principal, a queued job is
+// cancelled straight away and a running one once its command stops
+func (js *Jobs) Cancel(id string, principal Principal) (JobStatus, bool) {
+    js.mu.Lock()
+    defer js.mu.Unlock()
+    js.expire()
+    j, ok := js.jobs[id]
+    if !ok || j.status.Caller != principal.Label {
+        return JobStatus{}, false
+    }
+    switch j.status.State {
+    case JobQueued:
+        finished := js.now()
+        j.status.State = JobCancelled
+        j.status.FinishedAt = &finished
+        j.status.Code = ErrCodeCancelled
+        j.status.Error = "job cancelled before it started"
+        j.cancel()
+        log.Printf("Job %s cancelled\n", id)
+    case JobRunning:
+        j.cancelled = true
+        j.cancel()
+    }
+    return j.status, true
+}
+
+// expire forgets finished jobs older than the expiry, the lock must be held
+func (js *Jobs) expire() {
+    cutoff := js.now().Add(-time.Duration(js.cfg.Expiry))
+    for id, j := range js.jobs {
+        if j.status.State.finished() && j.status.FinishedAt.Before(cutoff) {
+            delete(js.jobs, id)
+        }
+    }
+}
+
+// Close cancels every job and stops the workers
+func (js *Jobs) Close() {
+    js.once.Do(func() { close(js.stop) })
+    js.mu.Lock()
+    for _, j := range js.jobs {
+        j.cancel()
+    }
+    js.mu.Unlock()
+    js.wg.Wait()
+}
+
+// newJobID returns a random, unguessable job ID
+func newJobID() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", fmt.Errorf("generating job id: %w", err)
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// handleSubmitJob queues the CommandRequest in the body and answers 202
+// with the job's status
+func handleSubmitJob(js *Jobs) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        req, err := decodeCommandRequest(r)
+        if err != nil {
+            writeError(w, err, nil)
+            return
+        }
+        status, err := js.Submit(r.Context(), req)
+        if err != nil {
+            writeError(w, err, nil)
+            return
+        }
+        w.Header().Set("Location", "/jobs/"+status.ID)
+        writeResponse(w, http.StatusAccepted, CommandResponse{Success: true, Data: status})
+    }
+}
+
+// handleJob serves GET and DELETE /jobs/{id}, jobs of other callers are
+// reported as not found
+func handleJob(js *Jobs) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+        var status JobStatus
+        var ok bool
+        if id != "" && !strings.Contains(id, "/") {
+            if r.Method == http.MethodDelete {
+                status, ok = js.Cancel(id, principalFrom(r.Context()))
+            } else {
+                status, ok = js.Get(id, principalFrom(r.Context()))
+            }
+        }
+        if !ok {
+            writeError(w, NewCommandError(ErrCodeNotFound, fmt.Errorf("job not found: %s", id)), nil)
+            return
+        }
+        writeResponse(w, http.StatusOK, CommandResponse{Success: true, Data: status})
+    }
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cancellableCommander holds every ping until release is closed or ctx is
+// done
+type cancellableCommander struct {
+	mockCommander
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *cancellableCommander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+	c.started <- struct{}{}
+	select {
+	case <-ctx.Done():
+		return PingResult{Host: host, Status: pingStatus(ctx.Err())}, ctx.Err()
+	case <-c.release:
+		return PingResult{Successful: true, Host: host, Status: PingStatusCompleted}, nil
+	}
+}
+
+// jobRequest sends method path with an optional body and decodes the job
+func jobRequest(t *testing.T, handler http.Handler, method, path, body, key string) (*httptest.ResponseRecorder, JobStatus) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var res struct {
+		Data JobStatus `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return rec, res.Data
+}
+
+// waitForJob polls the job until it reaches state
+func waitForJob(t *testing.T, handler http.Handler, id string, state JobState) JobStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, status := jobRequest(t, handler, "GET", "/jobs/"+id, "", "")
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected job %s to be %s, got %s", id, state, status.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobs_Lifecycle(t *testing.T) {
+	cmdr := &cancellableCommander{started: make(chan struct{}), release: make(chan struct{})}
+	handler := handleRequests(newTestServer(t, cmdr, DefaultConfig()))
+
+	rec, status := jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rec.Code, rec.Body)
+	}
+	if len(status.ID) != 32 || status.Type != "ping" || status.Caller != "anonymous" {
+		t.Errorf("unexpected job %+v", status)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/jobs/"+status.ID {
+		t.Errorf("expected Location /jobs/%s, got %q", status.ID, loc)
+	}
+
+	<-cmdr.started
+	running := waitForJob(t, handler, status.ID, JobRunning)
+	if running.StartedAt == nil || running.FinishedAt != nil {
+		t.Errorf("unexpected timestamps for a running job %+v", running)
+	}
+	close(cmdr.release)
+	done := waitForJob(t, handler, status.ID, JobSucceeded)
+	if done.FinishedAt == nil || done.Code != "" {
+		t.Errorf("unexpected finished job %+v", done)
+	}
+	result, _ := done.Result.(map[string]interface{})
+	if result["successful"] != true {
+		t.Errorf("expected the ping result, got %v", done.Result)
+	}
+}
+
+func TestJobs_CancelRunning(t *testing.T) {
+	cmdr := &cancellableCommander{started: make(chan struct{}), release: make(chan struct{})}
+	handler := handleRequests(newTestServer(t, cmdr, DefaultConfig()))
+
+	_, status := jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "")
+	<-cmdr.started
+	rec, _ := jobRequest(t, handler, "DELETE", "/jobs/"+status.ID, "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	cancelled := waitForJob(t, handler, status.ID, JobCancelled)
+	if cancelled.Code != ErrCodeCancelled {
+		t.Errorf("expected code cancelled, got %q", cancelled.Code)
+	}
+}
+
+func TestJobs_CancelQueued(t *testing.T) {
+	cmdr := &cancellableCommander{started: make(chan struct{}, 2), release: make(chan struct{})}
+	cfg := DefaultConfig()
+	cfg.Jobs.Workers = 1
+	handler := handleRequests(newTestServer(t, cmdr, cfg))
+
+	_, first := jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "")
+	<-cmdr.started
+	_, second := jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.2"}`, "")
+	if second.State != JobQueued {
+		t.Fatalf("expected the second job to be queued, got %s", second.State)
+	}
+
+	_, cancelled := jobRequest(t, handler, "DELETE", "/jobs/"+second.ID, "", "")
+	if cancelled.State != JobCancelled || cancelled.StartedAt != nil {
+		t.Errorf("expected the queued job to be cancelled straight away, got %+v", cancelled)
+	}
+	close(cmdr.release)
+	waitForJob(t, handler, first.ID, JobSucceeded)
+	select {
+	case <-cmdr.started:
+		t.Error("expected the cancelled job not to run")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestJobs_QueueFull(t *testing.T) {
+	cmdr := &cancellableCommander{started: make(chan struct{}, 2), release: make(chan struct{})}
+	defer close(cmdr.release)
+	cfg := DefaultConfig()
+	cfg.Jobs.Workers = 1
+	cfg.Jobs.QueueSize = 1
+	handler := handleRequests(newTestServer(t, cmdr, cfg))
+
+	jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "")
+	<-cmdr.started
+	rec, _ := jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected the second job to be queued, got %d", rec.Code)
+	}
+	rec, _ = jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected Retry-After 1, got %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestJobs_RateLimited(t *testing.T) {
+	cmdr := &cancellableCommander{started: make(chan struct{}, 2), release: make(chan struct{})}
+	defer close(cmdr.release)
+	cfg := DefaultConfig()
+	cfg.Limits.PerIP = RateConfig{Rate: 0.01, Burst: 2}
+	cfg.Limits.MaxConcurrentPerCommand = map[string]int{"ping": 1}
+	handler := handleRequests(newTestServer(t, cmdr, cfg))
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		rec, status := jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected job %d to be queued, got %d", i, rec.Code)
+		}
+		ids = append(ids, status.ID)
+	}
+	rec, _ := jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), string(ErrCodeRateLimited)) {
+		t.Fatalf("expected the submitter to be rate limited, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// the second job waits for the first to free the ping slot
+	<-cmdr.started
+	time.Sleep(50 * time.Millisecond)
+	if _, status := jobRequest(t, handler, "GET", "/jobs/"+ids[1], "", ""); status.State != JobRunning {
+		t.Errorf("expected the waiting job to be running, got %s", status.State)
+	}
+	cmdr.release <- struct{}{}
+	<-cmdr.started
+	waitForJob(t, handler, ids[0], JobSucceeded)
+}
+
+func TestJobs_Failed(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &mockCommander{}, DefaultConfig()))
+
+	_, status := jobRequest(t, handler, "POST", "/jobs", `{"type":"ping","payload":""}`, "")
+	failed := waitForJob(t, handler, status.ID, JobFailed)
+	if failed.Code != ErrCodeInvalidRequest || failed.Error == "" {
+		t.Errorf("expected the command error, got %+v", failed)
+	}
+}
+
+func TestJobs_Rejected(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &mockCommander{}, authConfig()))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		key    string
+		status int
+	}{
+		{"unknown command", "POST", "/jobs", `{"type":"reboot"}`, "admin-secret", http.StatusBadRequest},
+		{"invalid json", "POST", "/jobs", `{"type":`, "admin-secret", http.StatusBadRequest},
+		{"no key", "POST", "/jobs", `{"type":"sysinfo"}`, "", http.StatusUnauthorized},
+		{"missing permission", "POST", "/jobs", `{"type":"ping","payload":"127.0.0.1"}`, "monitor-secret", http.StatusForbidden},
+		{"wrong method", "GET", "/jobs", "", "admin-secret", http.StatusMethodNotAllowed},
+		{"unknown job", "GET", "/jobs/0123", "", "admin-secret", http.StatusNotFound},
+		{"no id", "DELETE", "/jobs/", "", "admin-secret", http.StatusNotFound},
+		{"put", "PUT", "/jobs/0123", "", "admin-secret", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _ := jobRequest(t, handler, tt.method, tt.path, tt.body, tt.key)
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestJobs_OtherCallers(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &mockCommander{}, authConfig()))
+
+	_, status := jobRequest(t, handler, "POST", "/jobs", `{"type":"sysinfo"}`, "admin-secret")
+	for _, method := range []string{"GET", "DELETE"} {
+		rec, _ := jobRequest(t, handler, method, "/jobs/"+status.ID, "", "monitor-secret")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404 for another caller's job, got %d", method, rec.Code)
+		}
+	}
+	rec, _ := jobRequest(t, handler, "GET", "/jobs/"+status.ID, "", "admin-secret")
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the owner to see the job, got %d", rec.Code)
+	}
+}
+
+func TestJobs_Expiry(t *testing.T) {
+	s := newTestServer(t, &mockCommander{}, DefaultConfig())
+	js := NewJobs(s, JobsConfig{Workers: 1, QueueSize: 1, Expiry: Duration(time.Minute)})
+	defer js.Close()
+	now := time.Now()
+	js.mu.Lock()
+	js.now = func() time.Time { return now }
+	js.mu.Unlock()
+
+	status, err := js.Submit(context.Background(), CommandRequest{Type: "sysinfo"})
+	if err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	for {
+		got, _ := js.Get(status.ID, anonymous)
+		if got.State == JobSucceeded {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	js.mu.Lock()
+	now = now.Add(2 * time.Minute)
+	js.mu.Unlock()
+	if _, ok := js.Get(status.ID, anonymous); ok {
+		t.Error("expected the finished job to expire")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "sync"
+    "time"
+
+    "golang.org/x/time/rate"
+)
+
+// busyRetryAfter is the Retry-After sent when a concurrency limit is full
+const busyRetryAfter = time.Second
+
+// idleBucketTTL is how long an unused rate limit bucket is kept
+const idleBucketTTL = 10 * time.Minute
+
+// RateConfig struct for a token bucket, a zero rate disables it
+type RateConfig struct {
+    Rate  float64 `json:"rate"` // commands per second
+    Burst int     `json:"burst"`
+}
+
+// Validate checks the bucket can ever allow a command
+func (r RateConfig) Validate() error {
+    if r.Rate < 0 {
+        return fmt.Errorf("rate must not be negative, got %v", r.Rate)
+    }
+    if r.Rate > 0 && r.Burst < 1 {
+        return fmt.Errorf("burst must be at least 1, got %d", r.Burst)
+    }
+    return nil
+}
+
+// LimitsConfig struct for rate limits and concurrency caps on commands,
+// zero values disable a limit
+type LimitsConfig struct {
+    PerIdentity             RateConfig     `json:"per_identity"`
+    PerIP                   RateConfig     `json:"per_ip"`
+    MaxConcurrent           int            `json:"max_concurrent"`
+    MaxConcurrentPerCommand map[string]int `json:"max_concurrent_per_command"`
+}
+
+// DefaultLimits caps the number of commands running at once, rates are
+// left to the config as they depend on the callers
+var DefaultLimits = LimitsConfig{
+    MaxConcurrent:           64,
+    MaxConcurrentPerCommand: map[string]int{},
+}
+
+// Validate checks the buckets and caps
+func (l LimitsConfig) Validate() error {
+    if err := l.PerIdentity.Validate(); err != nil {
+        return fmt.Errorf("per_identity: %w", err)
+    }
+    if err := l.PerIP.Validate(); err != nil {
+        return fmt.Errorf("per_ip: %w", err)
+    }
+    if l.MaxConcurrent < 0 {
+        return errors.New("max_concurrent must not be negative")
+    }
+    for name, n := range l.MaxConcurrentPerCommand {
+        if n < 0 {
+            return fmt.Errorf("max_concurrent_per_command: %s must not be negative", name)
+        }
+    }
+    return nil
+}
+
+// bucketSet struct for the token buckets of one kind of caller
+type bucketSet struct {
+    cfg       RateConfig
+    mu        sync.Mutex
+    buckets   map[string]*bucket
+    lastPrune time.Time
+}
+
+type bucket struct {
+    limiter  *rate.Limiter
+    lastSeen time.Time
+}
+
+func newBucketSet(cfg RateConfig) *bucketSet {
+    if cfg.Rate == 0 {
+        return nil
+    }
+    return &bucketSet{cfg: cfg, buckets: make(map[string]*bucket)}
+}
+
+// reserve takes a token from key's bucket, when none is available the
+// reservation is cancelled and the wait until the next token returned
+func (b *bucketSet) reserve(key string, now time.Time) (*rate.Reservation, time.Duration) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    // forget callers that have been idle long enough for a full bucket
+    if now.Sub(b.lastPrune) > time.Minute {
+        for k, bk := range b.buckets {
+            if now.Sub(bk.lastSeen) > idleBucketTTL {
+                delete(b.buckets, k)
+            }
+        }
+        b.lastPrune = now
+    }
+
+    bk, ok := b.buckets[key]
+    if !ok {
+        bk = &bucket{limiter: rate.NewLimiter(rate.Limit(b.cfg.Rate), b.cfg.Burst)}
+        b.buckets[key] = bk
+    }
+    bk.lastSeen = now
+    r := bk.limiter.ReserveN(now, 1)
+    if delay := r.DelayFrom(now); delay > 0 {
+        r.CancelAt(now)
+        return nil, delay
+    }
+    return r, 0
+}
+
+// Limiter struct for enforcing LimitsConfig
+type Limiter struct {
+    identities *bucketSet
+    ips        *bucketSet
+    global     chan struct{}
+    commands   map[string]chan struct{}
+
+    mu       sync.Mutex
+    inFlight map[string]int
+    rejected map[string]map[ErrorCode]uint64
+}
+
+// NewLimiter create a limiter from a validated config
+func NewLimiter(cfg LimitsConfig) *Limiter {
+    l := &Limiter{
+        identities: newBucketSet(cfg.PerIdentity),
+        ips:        newBucketSet(cfg.PerIP),
+        commands:   make(map[string]chan struct{}),
+        inFlight:   make(map[string]int),
+        rejected:   make(map[string]map[ErrorCode]uint64),
+    }
+    if cfg.MaxConcurrent > 0 {
+        l.global = make(chan struct{}, cfg.MaxConcurrent)
+    }
+    for name, n := range cfg.MaxConcurrentPerCommand {
+        if n > 0 {
+            l.commands[name] = make(chan struct{}, n)
+        }
+    }
+    return l
+}
+
+// Acquire admits one run of command for the caller, release must be
+// called when the command finishes
+func (l *Limiter) Acquire(command string, principal Principal, ip string) (func(), error) {
+    now := time.Now()
+    reservations, err := l.reserve(command, principal, ip, now)
+    if err != nil {
+        return nil, err
+    }
+    cancel := func() {
+        for _, r := range reservations {
+            r.CancelAt(now)
+        }
+    }
+
+    if !tryAcquire(l.global) {
+        cancel()
+        return nil, l.reject(command, ErrCodeTooBusy, busyRetryAfter, "too many commands running")
+    }
+    if !tryAcquire(l.commands[command]) {
+        release(l.global)
+        cancel()
+        return nil, l.reject(command, ErrCodeTooBusy, busyRetryAfter, "too many %s commands running", command)
+    }
+    return l.running(command), nil
+}
+
+// Admit takes the rate limit tokens of one run of command for the caller
+// without taking a concurrency slot, for commands that are queued and
+// later run through Wait
+func (l *Limiter) Admit(command string, principal Principal, ip string) error {
+    _, err := l.reserve(command, principal, ip, time.Now())
+    return err
+}
+
+// Wait waits for the concurrency slots of one run of command that Admit
+// let in, release must be called when the command finishes
+func (l *Limiter) Wait(ctx context.Context, command string) (func(), error) {
+    if err := acquire(ctx, l.global); err != nil {
+        return nil, err
+    }
+    if err := acquire(ctx, l.commands[command]); err != nil {
+        release(l.global)
+        return nil, err
+    }
+    return l.running(command), nil
+}
+
+// reserve takes a token from the caller's identity and address buckets,
+// either both or neither
+func (l *Limiter) reserve(command string, principal Principal, ip string, now time.Time) ([]*rate.Reservation, error) {
+    var reservations []*rate.Reservation
+    // anonymous callers are only told apart by their address
+    if l.identities != nil && principal.Label != anonymous.Label {
+        r, wait := l.identities.reserve(principal.Label, now)
+        if r == nil {
+            return nil, l.reject(command, ErrCodeRateLimited, wait, "rate limit for %s exceeded", principal.Label)
+        }
+        reservations = append(reservations, r)
+    }
+    if l.ips != nil && ip != "" {
+        r, wait := l.ips.reserve(ip, now)
+        if r == nil {
+            for _, r := range reservations {
+                r.CancelAt(now)
+            }
+            return nil, l.reject(command, ErrCodeRateLimited, wait, "rate limit for %s exceeded", ip)
+        }
+        reservations = append(reservations, r)
+    }
+    return reservations, nil
+}
+
+// running counts a run of command holding its concurrency slots and
+// returns the function giving them back
+func (l *Limiter) running(command string) func() {
+    l.mu.Lock()
+    l.inFlight[command]++
+    l.mu.Unlock()
+
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            l.mu.Lock()
+            l.inFlight[command]--
+            l.mu.Unlock()
+            release(l.commands[command])
+            release(l.global)
+        })
+    }
+}
+
+// reject counts the rejection and builds the error for the client
+func (l *Limiter) reject(command string, code ErrorCode, wait time.Duration, format string, args ...interface{}) error {
+    l.mu.Lock()
+    if l.rejected[command] == nil {
+        l.rejected[command] = make(map[ErrorCode]uint64)
+    }
+    l.rejected[command][code]++
+    l.mu.Unlock()
+
+    err := NewCommandError(code, fmt.Errorf(format, args...))
+    err.RetryAfter = wait
+    return err
+}
+
+// InFlight returns the number of running commands of each type
+func (l *Limiter) InFlight() map[string]int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    counts := make(map[string]int, len(l.inFlight))
+    for name, n := range l.inFlight {
+        counts[name] = n
+    }
+    return counts
+}
+
+// Rejected returns the number of rejected commands by type and error code
+func (l *Limiter) Rejected() map[string]map[ErrorCode]uint64 {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    counts := make(map[string]map[ErrorCode]uint64, len(l.rejected))
+    for name, byCode := range l.rejected {
+        counts[name] = make(map[ErrorCode]uint64, len(byCode))
+        for code, n := range byCode {
+            counts[name][code] = n
+        }
+    }
+    return counts
+}
+
+// tryAcquire takes a slot from sem without waiting, a nil sem is unlimited
+func tryAcquire(sem chan struct{}) bool {
+    if sem == nil {
+        return true
+    }
+    select {
+    case sem <- struct{}{}:
+        return true
+    default:
+        return false
+    }
+}
+
+// acquire takes a slot from sem, waiting until one is free or ctx is done
+func acquire(ctx context.Context, sem chan struct{}) error {
+    if sem == nil {
+        return nil
+    }
+    select {
+    case sem <- struct{}{}:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// release returns a slot taken by tryAcquire or acquire
+func release(sem chan struct{}) {
+    if sem != nil {
+        <-sem
+    }
+}
+
+type clientIPKey struct{}
+
+// clientIPFrom returns the address of the client that made the request
+func clientIPFrom(ctx context.Context) string {
+    ip, _ := ctx.Value(clientIPKey{}).(string)
+    return ip
+}
+
+// trackClient stores the client's IP address in the request context
+func trackClient(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ip, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+            ip = r.RemoteAddr
+        }
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+    })
+}
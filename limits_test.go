@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingCommander holds every ping until release is closed
+type blockingCommander struct {
+	mockCommander
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingCommander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return PingResult{Successful: true}, nil
+}
+
+func TestLimiter_RatePerIdentity(t *testing.T) {
+	l := NewLimiter(LimitsConfig{PerIdentity: RateConfig{Rate: 1, Burst: 2}})
+	alice := Principal{Label: "alice"}
+
+	for i := 0; i < 2; i++ {
+		done, err := l.Acquire("sysinfo", alice, "192.0.2.1")
+		if err != nil {
+			t.Fatalf("request %d: unexpected error %v", i, err)
+		}
+		done()
+	}
+	_, err := l.Acquire("sysinfo", alice, "192.0.2.1")
+	cmdErr := asCommandError(err)
+	if err == nil || cmdErr.Code != ErrCodeRateLimited {
+		t.Fatalf("expected rate_limited, got %v", err)
+	}
+	if cmdErr.RetryAfter <= 0 || cmdErr.RetryAfter > time.Second {
+		t.Errorf("expected a retry after of up to 1s, got %v", cmdErr.RetryAfter)
+	}
+
+	// other callers have their own bucket
+	if _, err := l.Acquire("sysinfo", Principal{Label: "bob"}, "192.0.2.1"); err != nil {
+		t.Errorf("expected bob to be allowed, got %v", err)
+	}
+	if got := l.Rejected()["sysinfo"][ErrCodeRateLimited]; got != 1 {
+		t.Errorf("expected 1 rejection, got %d", got)
+	}
+}
+
+func TestLimiter_RatePerIP(t *testing.T) {
+	l := NewLimiter(LimitsConfig{
+		PerIdentity: RateConfig{Rate: 1, Burst: 1},
+		PerIP:       RateConfig{Rate: 1, Burst: 1},
+	})
+	if _, err := l.Acquire("ping", anonymous, "192.0.2.1"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// anonymous callers are limited by address only
+	if _, err := l.Acquire("ping", anonymous, "192.0.2.2"); err != nil {
+		t.Errorf("expected another address to be allowed, got %v", err)
+	}
+	if _, err := l.Acquire("ping", anonymous, "192.0.2.1"); asCommandError(err).Code != ErrCodeRateLimited {
+		t.Errorf("expected rate_limited, got %v", err)
+	}
+
+	// a rejection by address gives back the identity's token
+	if _, err := l.Acquire("ping", Principal{Label: "alice"}, "192.0.2.1"); err == nil {
+		t.Fatal("expected the address limit to apply")
+	}
+	if _, err := l.Acquire("ping", Principal{Label: "alice"}, "192.0.2.3"); err != nil {
+		t.Errorf("expected alice's token to be returned, got %v", err)
+	}
+}
+
+func TestLimiter_Concurrency(t *testing.T) {
+	l := NewLimiter(LimitsConfig{MaxConcurrent: 2, MaxConcurrentPerCommand: map[string]int{"ping": 1}})
+
+	donePing, err := l.Acquire("ping", anonymous, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	_, err = l.Acquire("ping", anonymous, "")
+	if cmdErr := asCommandError(err); err == nil || cmdErr.Code != ErrCodeTooBusy || cmdErr.RetryAfter != busyRetryAfter {
+		t.Fatalf("expected too_busy for a second ping, got %v", err)
+	}
+
+	doneSys, err := l.Acquire("sysinfo", anonymous, "")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := l.Acquire("sysinfo", anonymous, ""); asCommandError(err).Code != ErrCodeTooBusy {
+		t.Fatalf("expected the global cap to apply, got %v", err)
+	}
+	if got := l.InFlight(); got["ping"] != 1 || got["sysinfo"] != 1 {
+		t.Errorf("unexpected in flight counts %v", got)
+	}
+
+	donePing()
+	donePing()
+	doneSys()
+	if got := l.InFlight(); got["ping"] != 0 || got["sysinfo"] != 0 {
+		t.Errorf("expected nothing in flight, got %v", got)
+	}
+	if _, err := l.Acquire("ping", anonymous, ""); err != nil {
+		t.Errorf("expected a ping to be allowed after release, got %v", err)
+	}
+}
+
+func TestHandleCommand_TooBusy(t *testing.T) {
+	cmdr := &blockingCommander{started: make(chan struct{}), release: make(chan struct{})}
+	cfg := DefaultConfig()
+	cfg.Limits.MaxConcurrentPerCommand = map[string]int{"ping": 1}
+	handler := handleRequests(newTestServer(t, cmdr, cfg))
+
+	execute := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/execute", strings.NewReader(`{"type":"ping","payload":"127.0.0.1"}`)))
+		return rec
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- execute() }()
+	<-cmdr.started
+
+	rec := execute()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rec.Code)
+	}
+	if retry, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retry < 1 {
+		t.Errorf("expected a Retry-After header, got %q", rec.Header().Get("Retry-After"))
+	}
+	if res := decodeResponse(t, rec); res.Code != ErrCodeTooBusy {
+		t.Errorf("expected code too_busy, got %s", res.Code)
+	}
+
+	close(cmdr.release)
+	if rec := <-first; rec.Code != http.StatusOK {
+		t.Errorf("expected the first ping to succeed, got %d", rec.Code)
+	}
+}
+
+func TestLimitsConfig_Validate(t *testing.T) {
+	invalid := []LimitsConfig{
+		{PerIP: RateConfig{Rate: -1}},
+		{PerIdentity: RateConfig{Rate: 5}},
+		{MaxConcurrent: -1},
+		{MaxConcurrentPerCommand: map[string]int{"ping": -1}},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "io"
+    "log"
+    "os"
+)
+
+// Log levels
+const (
+    LogLevelDebug = "debug"
+    LogLevelInfo  = "info"
+)
+
+// logLevels orders the levels from most to least verbose
+var logLevels = map[string]int{
+    LogLevelDebug: 0,
+    LogLevelInfo:  1,
+}
+
+// logLevel is the configured level, debug messages are dropped above it
+var logLevel = logLevels[LogLevelInfo]
+
+// setupLogging applies the log config, the returned closer releases the
+// log file if one was opened
+func setupLogging(cfg LogConfig) (io.Closer, error) {
+    logLevel = logLevels[cfg.Level]
+    if cfg.File == "" {
+        log.SetOutput(os.Stderr)
+        return io.NopCloser(nil), nil
+    }
+    f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    log.SetOutput(f)
+    return f, nil
+}
+
+// debugf logs only when the level is debug
+func debugf(format string, v ...interface{}) {
+    if logLevel <= logLevels[LogLevelDebug] {
+        log.Printf(format, v...)
+    }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	defer func(level int) { logLevel = level }(logLevel)
+
+	path := filepath.Join(t.TempDir(), "espresso.log")
+	closer, err := setupLogging(LogConfig{Level: LogLevelInfo, File: path})
+	if err != nil {
+		t.Fatalf("setupLogging() returned error: %v", err)
+	}
+
+	log.Printf("info message")
+	debugf("debug message")
+	closer.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	if !strings.Contains(string(data), "info message") {
+		t.Error("expected info message in the log file")
+	}
+	if strings.Contains(string(data), "debug message") {
+		t.Error("expected debug message to be dropped at info level")
+	}
+
+	closer, err = setupLogging(LogConfig{Level: LogLevelDebug, File: path})
+	if err != nil {
+		t.Fatalf("setupLogging() returned error: %v", err)
+	}
+	debugf("debug message")
+	closer.Close()
+
+	data, _ = os.ReadFile(path)
+	if !strings.Contains(string(data), "debug message") {
+		t.Error("expected debug message at debug level")
+	}
+}
@@ -2,111 +2,230 @@ package main
 
 import (
     "encoding/json"
-    "fmt"
+    "errors"
+    "flag"
+    "io"
     "log"
     "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+)
+
+// Version and BuildDate are set at build time by the Makefile
+var (
+    Version   = "dev"
+    BuildDate = ""
 )
 
 func main() {
-    commander := NewCommander()
+    cfg, printConfig, err := LoadConfig(os.Args[1:], os.Getenv)
+    if errors.Is(err, flag.ErrHelp) {
+        return
+    } else if err != nil {
+        log.Fatal(err)
+    }
+    if printConfig {
+        err = cfg.Print(os.Stdout)
+        if err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+
+    logFile, err := setupLogging(cfg.Log)
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer logFile.Close()
+
+    commander := NewCommander(WithTargetFilter(NewTargetFilter(cfg.Targets)))
+    srv, err := NewServer(commander, cfg)
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer srv.Close()
+
+    // SIGHUP reloads the API keys and certificates
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            if err := srv.Reload(); err != nil {
+                log.Printf("Reload failed: %v\n", err)
+                continue
+            }
+            log.Println("Reloaded")
+        }
+    }()
+
     server := &http.Server{
-        Addr:    ":8080",
-        Handler: handleRequests(commander),
+        Addr:      cfg.Listen,
+        Handler:   handleRequests(srv),
+        TLSConfig: srv.TLSConfig(),
+    }
+    log.Printf("Listening on %s\n", cfg.Listen)
+    if server.TLSConfig != nil {
+        // the certificates come from TLSConfig so they can be reloaded
+        log.Fatal(server.ListenAndServeTLS("", ""))
     }
     log.Fatal(server.ListenAndServe())
 }
 
-func handleRequests(cmdr Commander) http.Handler {
+func handleRequests(s *Server) http.Handler {
     mux := http.NewServeMux()
-    mux.HandleFunc("/execute", handleCommand(cmdr))
+    mux.Handle("/execute", chain(handleCommand(s),
+        recoverPanics,
+        trackClient,
+        authenticate(s.keys),
+    ))
+    mux.Handle("/execute/stream", chain(handleStreamCommand(s),
+        recoverPanics,
+        trackClient,
+        authenticate(s.keys),
+        allowPath("/execute/stream"),
+        allowMethods(http.MethodPost),
+        requireJSON,
+        limitBody(MaxBodyBytes),
+    ))
+    mux.Handle("/ws", chain(handleWebSocket(s),
+        recoverPanics,
+        trackClient,
+        authenticate(s.keys),
+        allowPath("/ws"),
+        allowMethods(http.MethodGet),
+    ))
+    mux.Handle("/jobs", chain(handleSubmitJob(s.jobs),
+        recoverPanics,
+        trackClient,
+        authenticate(s.keys),
+        allowPath("/jobs"),
+        allowMethods(http.MethodPost),
+        requireJSON,
+        limitBody(MaxBodyBytes),
+    ))
+    mux.Handle("/jobs/", chain(handleJob(s.jobs),
+        recoverPanics,
+        authenticate(s.keys),
+        allowMethods(http.MethodGet, http.MethodDelete),
+    ))
+    mux.Handle("/commands", chain(handleListCommands(s.registry),
+        recoverPanics,
+        authenticate(s.keys),
+        allowPath("/commands"),
+        allowMethods(http.MethodGet),
+    ))
+    mux.Handle("/monitors", chain(handleMonitors(s.monitors),
+        recoverPanics,
+        authenticate(s.keys),
+        allowPath("/monitors"),
+        allowMethods(http.MethodGet),
+    ))
+    if s.cfg.Metrics.Enabled {
+        mux.Handle("/metrics", chain(s.metrics.Handler(),
+            recoverPanics,
+            authenticate(s.keys),
+            allowPath("/metrics"),
+            allowMethods(http.MethodGet),
+        ))
+    }
+    if s.history != nil {
+        mux.Handle("/history", chain(handleHistory(s.history),
+            recoverPanics,
+            authenticate(s.keys),
+            allowPath("/history"),
+            allowMethods(http.MethodGet),
+        ))
+    }
     return mux
 }
 
 // CommandRequest struct for incoming request
 type CommandRequest struct {
-    Type    string `json:"type"`    // "ping" or "sysinfo"
-    Payload string `json:"payload"` // For ping, this is the host
+    Type    string          `json:"type"`              // see GET /commands
+    Payload string          `json:"payload"`           // For ping, this is the host
+    Options json.RawMessage `json:"options,omitempty"` // Command specific options
 }
 
 // CommandResponse struct for outgoing resposne
 type CommandResponse struct {
     Success bool        `json:"success"`
     Data    interface{} `json:"data"`
+    Code    ErrorCode   `json:"code,omitempty"`
     Error   string      `json:"error,omitempty"`
 }
 
-func handleCommand(cmdr Commander) http.HandlerFunc {
+func handleCommand(s *Server) http.HandlerFunc {
     return middleware(func(w http.ResponseWriter, r *http.Request) {
         // get request struct from body
-        var req CommandRequest
-        body := json.NewDecoder(r.Body)
-        err := body.Decode(&req)
+        body, err := readBody(r)
         if err != nil {
-            panic(err)
+            writeError(w, err, nil)
+            return
         }
-        defer r.Body.Close()
-
-        // prepare response struct
-        var res CommandResponse
-        switch req.Type {
-        case "ping":
-            p, err := cmdr.Ping(req.Payload)
-            if err != nil {
-                panic(err)
-            }
-            res.Success = p.Successful
-            res.Data = p.Time
-            break
-        case "sysinfo":
-            s, err := cmdr.GetSystemInfo()
-            if err != nil {
-                panic(err)
-            }
-            res.Success = true
-            res.Data = s
-            break
-        default:
-            panic("invalid request type")
+        if isBatch(body) {
+            handleBatch(s, w, r, body)
+            return
         }
-
-        // encode and send response
-        w.Header().Set("Content-Type", "application/json")
-        resJSON, err := json.Marshal(res)
+        var req CommandRequest
+        err = json.Unmarshal(body, &req)
         if err != nil {
-            panic(err)
+            writeError(w, NewCommandError(ErrCodeInvalidJSON, err), nil)
+            return
         }
-        _, err = w.Write(resJSON)
+
+        if wantsEventStream(r) {
+            streamCommand(s, w, r, req)
+            return
+        }
+
+        // stop the command when the client disconnects or the deadline passes
+        res, err := s.Execute(r.Context(), req)
         if err != nil {
-            panic(err)
+            writeError(w, err, res.Data)
+            return
         }
+
+        // encode and send response
+        writeResponse(w, http.StatusOK, res)
     })
 }
 
-func middleware(next http.HandlerFunc) http.HandlerFunc {
+// decodeCommandRequest reads the CommandRequest in the request body
+func decodeCommandRequest(r *http.Request) (CommandRequest, error) {
+    body, err := readBody(r)
+    if err != nil {
+        return CommandRequest{}, err
+    }
+    var req CommandRequest
+    err = json.Unmarshal(body, &req)
+    if err != nil {
+        return CommandRequest{}, NewCommandError(ErrCodeInvalidJSON, err)
+    }
+    return req, nil
+}
+
+// readBody reads the whole request body, a body over the limit set by
+// limitBody is reported as body_too_large
+func readBody(r *http.Request) ([]byte, error) {
+    defer r.Body.Close()
+    body, err := io.ReadAll(r.Body)
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(err, &maxBytesErr) {
+        return nil, err
+    } else if err != nil {
+        return nil, NewCommandError(ErrCodeInvalidJSON, err)
+    }
+    return body, nil
+}
+
+// handleListCommands describes every registered command
+func handleListCommands(registry *Registry) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
-        var response CommandResponse
-        defer func() {
-            // Catch all Panics and throw a 500
-            if r := recover(); r != nil {
-                log.Printf("Recovered from panic: %v\n", r)
-                response.Success = false
-                response.Error = fmt.Sprintf("%v", r)
-                w.WriteHeader(http.StatusInternalServerError)
-            }
-        }()
-        // disallow paths other than /execute
-        if r.URL.Path != "/execute" {
-            response.Success = false
-            response.Error = "invalid path"
-            w.WriteHeader(http.StatusNotFound)
-        }
-        // disallow methods other than POST
-        if r.Method != "POST" {
-            response.Success = false
-            response.Error = "invalid method"
-            w.WriteHeader(http.StatusMethodNotAllowed)
+        var infos []CommandInfo
+        for _, cmd := range registry.Commands() {
+            infos = append(infos, cmd.Info())
         }
-        // pass through to handler
-        next(w, r)
+        writeResponse(w, http.StatusOK, CommandResponse{Success: true, Data: infos})
     }
 }
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -11,30 +14,52 @@ import (
 
 // Mock Commander for testing
 type mockCommander struct {
-	pingResult PingResult
-	pingError  error
-	sysInfo    SystemInfo
-	sysError   error
+	pingResult   PingResult
+	pingError    error
+	pingOptions  PingOptions
+	pingHost     string
+	traceResult  TracerouteResult
+	traceError   error
+	traceOptions TracerouteOptions
+	traceHost    string
+	sysInfo      SystemInfo
+	sysError     error
 }
 
-func (m *mockCommander) Ping(host string) (PingResult, error) {
-	if m.pingError != nil {
-		return PingResult{}, m.pingError
-	}
-	return m.pingResult, nil
+func (m *mockCommander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+	m.pingHost = host
+	m.pingOptions = opts
+	return m.pingResult, m.pingError
+}
+
+func (m *mockCommander) Traceroute(ctx context.Context, host string, opts TracerouteOptions) (TracerouteResult, error) {
+	m.traceHost = host
+	m.traceOptions = opts
+	return m.traceResult, m.traceError
 }
 
-func (m *mockCommander) GetSystemInfo() (SystemInfo, error) {
+func (m *mockCommander) GetSystemInfo(ctx context.Context) (SystemInfo, error) {
 	if m.sysError != nil {
 		return SystemInfo{}, m.sysError
 	}
 	return m.sysInfo, nil
 }
 
+// newTestServer creates a Server for cfg that is closed when the test ends
+func newTestServer(t testing.TB, cmdr Commander, cfg Config) *Server {
+	t.Helper()
+	s, err := NewServer(cmdr, cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
 func TestHandleRequests(t *testing.T) {
 	// Test that handleRequests creates a proper handler
 	cmdr := &mockCommander{}
-	handler := handleRequests(cmdr)
+	handler := handleRequests(newTestServer(t, cmdr, DefaultConfig()))
 	
 	if handler == nil {
 		t.Fatal("handleRequests returned nil handler")
@@ -67,8 +92,10 @@ func TestHandleCommand_Ping(t *testing.T) {
 				Payload: "google.com",
 			},
 			mockResult: PingResult{
-				Successful: true,
-				Time:       100 * time.Millisecond,
+				Successful:  true,
+				PacketsSent: 4,
+				PacketsRecv: 4,
+				MaxRtt:      100 * time.Millisecond,
 			},
 			expectedStatus: http.StatusOK,
 			checkResponse: func(t *testing.T, res CommandResponse) {
@@ -78,9 +105,14 @@ func TestHandleCommand_Ping(t *testing.T) {
 				if res.Error != "" {
 					t.Errorf("unexpected error: %s", res.Error)
 				}
-				// Check that Data contains the time duration
-				if res.Data == nil {
-					t.Error("expected Data to contain time duration")
+				// Check that Data contains the ping statistics
+				dataBytes, _ := json.Marshal(res.Data)
+				var p PingResult
+				if err := json.Unmarshal(dataBytes, &p); err != nil {
+					t.Fatalf("failed to parse ping result: %v", err)
+				}
+				if p.PacketsRecv != 4 || p.MaxRtt != 100*time.Millisecond {
+					t.Errorf("unexpected ping statistics: %+v", p)
 				}
 			},
 		},
@@ -92,7 +124,7 @@ func TestHandleCommand_Ping(t *testing.T) {
 			},
 			mockResult: PingResult{
 				Successful: false,
-				Time:       0,
+				PacketLoss: 100,
 			},
 			expectedStatus: http.StatusOK,
 			checkResponse: func(t *testing.T, res CommandResponse) {
@@ -120,7 +152,7 @@ func TestHandleCommand_Ping(t *testing.T) {
 			rec := httptest.NewRecorder()
 
 			// Call handler
-			handler := handleCommand(cmdr)
+			handler := handleCommand(newTestServer(t, cmdr, DefaultConfig()))
 			handler(rec, req)
 
 			// Check status code
@@ -142,6 +174,155 @@ func TestHandleCommand_Ping(t *testing.T) {
 	}
 }
 
+func TestHandleCommand_PingOptions(t *testing.T) {
+	cmdr := &mockCommander{pingResult: PingResult{Successful: true}}
+
+	body := []byte(`{"type":"ping","payload":"example.com","options":{"count":2,"interval":"500ms","timeout":"5s","ttl":32,"privileged":true}}`)
+	req := httptest.NewRequest("POST", "/execute", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	handleCommand(newTestServer(t, cmdr, DefaultConfig()))(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	want := PingOptions{
+		Count:      2,
+		Interval:   Duration(500 * time.Millisecond),
+		Timeout:    Duration(5 * time.Second),
+		TTL:        32,
+		Privileged: true,
+	}
+	if cmdr.pingOptions != want {
+		t.Errorf("expected options %+v, got %+v", want, cmdr.pingOptions)
+	}
+}
+
+func TestHandleCommand_PingOptionsOutOfLimits(t *testing.T) {
+	cmdr := &mockCommander{pingResult: PingResult{Successful: true}}
+
+	body := []byte(`{"type":"ping","payload":"example.com","options":{"count":100000}}`)
+	req := httptest.NewRequest("POST", "/execute", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+
+	handleCommand(newTestServer(t, cmdr, DefaultConfig()))(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+}
+
+func TestHandleCommand_PingTimedOut(t *testing.T) {
+	cmdr := &mockCommander{
+		pingResult: PingResult{Successful: true, Status: PingStatusTimedOut, PacketsSent: 2, PacketsRecv: 1},
+		pingError:  context.DeadlineExceeded,
+	}
+
+	body := []byte(`{"type":"ping","payload":"example.com"}`)
+	req := httptest.NewRequest("POST", "/execute", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+
+	handleCommand(newTestServer(t, cmdr, DefaultConfig()))(rec, req)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected status 504, got %d", rec.Code)
+	}
+	var res CommandResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if res.Success {
+		t.Error("expected success=false for a timed out ping")
+	}
+	if res.Code != ErrCodeTimeout {
+		t.Errorf("expected code %s, got %q", ErrCodeTimeout, res.Code)
+	}
+	if res.Data == nil {
+		t.Error("expected partial statistics in Data")
+	}
+}
+
+func TestHandleCommand_PingErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		pingError      error
+		expectedStatus int
+		expectedCode   ErrorCode
+	}{
+		{
+			name:           "missing host",
+			body:           `{"type":"ping"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   ErrCodeInvalidRequest,
+		},
+		{
+			name:           "unresolvable host",
+			body:           `{"type":"ping","payload":"nonexistent.invalid"}`,
+			pingError:      fmt.Errorf("%w nonexistent.invalid", ErrUnresolvableHost),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedCode:   ErrCodeUnresolvableHost,
+		},
+		{
+			name:           "pinger failure",
+			body:           `{"type":"ping","payload":"example.com"}`,
+			pingError:      errors.New("socket: permission denied"),
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   ErrCodeInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmdr := &mockCommander{pingError: tt.pingError}
+			req := httptest.NewRequest("POST", "/execute", bytes.NewBufferString(tt.body))
+			rec := httptest.NewRecorder()
+
+			handleCommand(newTestServer(t, cmdr, DefaultConfig()))(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rec.Code)
+			}
+			var res CommandResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to parse response: %v", err)
+			}
+			if res.Success || res.Code != tt.expectedCode || res.Error == "" {
+				t.Errorf("expected error code %s, got %+v", tt.expectedCode, res)
+			}
+		})
+	}
+}
+
+func TestHandleCommand_ContextFromRequest(t *testing.T) {
+	cmdr := &ctxCommander{}
+
+	body := []byte(`{"type":"ping","payload":"example.com"}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("POST", "/execute", bytes.NewBuffer(body)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+
+	handleCommand(newTestServer(t, cmdr, DefaultConfig()))(rec, req)
+
+	if cmdr.err != context.Canceled {
+		t.Errorf("expected the command context to be cancelled with the request, got %v", cmdr.err)
+	}
+}
+
+// ctxCommander records the state of the context it was called with
+type ctxCommander struct {
+	mockCommander
+	err error
+}
+
+func (c *ctxCommander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+	c.err = ctx.Err()
+	return PingResult{Status: pingStatus(c.err)}, c.err
+}
+
 func TestHandleCommand_SysInfo(t *testing.T) {
 	// Setup mock commander
 	expectedSysInfo := SystemInfo{
@@ -165,7 +346,7 @@ func TestHandleCommand_SysInfo(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// Call handler
-	handler := handleCommand(cmdr)
+	handler := handleCommand(newTestServer(t, cmdr, DefaultConfig()))
 	handler(rec, httpReq)
 
 	// Check status code
@@ -216,12 +397,19 @@ func TestHandleCommand_InvalidType(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// Call handler
-	handler := handleCommand(cmdr)
+	handler := handleCommand(newTestServer(t, cmdr, DefaultConfig()))
 	handler(rec, httpReq)
 
-	// Should return 500 due to panic recovery
-	if rec.Code != http.StatusInternalServerError {
-		t.Errorf("expected status 500, got %d", rec.Code)
+	// Should return 400 with a machine-readable code
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+	var res CommandResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if res.Code != ErrCodeUnknownCommand {
+		t.Errorf("expected code %s, got %q", ErrCodeUnknownCommand, res.Code)
 	}
 }
 
@@ -236,12 +424,19 @@ func TestHandleCommand_InvalidJSON(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// Call handler
-	handler := handleCommand(cmdr)
+	handler := handleCommand(newTestServer(t, cmdr, DefaultConfig()))
 	handler(rec, httpReq)
 
-	// Should return 500 due to panic recovery
-	if rec.Code != http.StatusInternalServerError {
-		t.Errorf("expected status 500, got %d", rec.Code)
+	// Should return 400 with a machine-readable code
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+	var res CommandResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if res.Code != ErrCodeInvalidJSON {
+		t.Errorf("expected code %s, got %q", ErrCodeInvalidJSON, res.Code)
 	}
 }
 
@@ -304,6 +499,15 @@ func TestMiddleware_PanicRecovery(t *testing.T) {
 	if rec.Code != http.StatusInternalServerError {
 		t.Errorf("expected status 500, got %d", rec.Code)
 	}
+
+	// Should include the JSON body
+	var res CommandResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if res.Success || res.Code != ErrCodeInternal || res.Error != "test panic" {
+		t.Errorf("unexpected panic response: %+v", res)
+	}
 }
 
 func TestCommandRequest(t *testing.T) {
@@ -381,7 +585,7 @@ func BenchmarkHandleCommand_Ping(b *testing.B) {
 	cmdr := &mockCommander{
 		pingResult: PingResult{
 			Successful: true,
-			Time:       100 * time.Millisecond,
+			MaxRtt:     100 * time.Millisecond,
 		},
 	}
 
@@ -391,7 +595,7 @@ func BenchmarkHandleCommand_Ping(b *testing.B) {
 	}
 	body, _ := json.Marshal(req)
 	
-	handler := handleCommand(cmdr)
+	handler := handleCommand(newTestServer(b, cmdr, DefaultConfig()))
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -416,7 +620,7 @@ func BenchmarkHandleCommand_SysInfo(b *testing.B) {
 	}
 	body, _ := json.Marshal(req)
 	
-	handler := handleCommand(cmdr)
+	handler := handleCommand(newTestServer(b, cmdr, DefaultConfig()))
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
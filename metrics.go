@@ -0,0 +1,218 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "sync/atomic"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/collectors"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes every metric name
+const metricsNamespace = "espresso_commander"
+
+// codeSuccess is the code label of commands that succeeded
+const codeSuccess = "ok"
+
+// panicsRecovered counts panics caught by recoverPanics and the background
+// workers, it lives outside Metrics as the middleware has no server
+var panicsRecovered atomic.Uint64
+
+// MetricsConfig struct for the /metrics endpoint
+type MetricsConfig struct {
+    Enabled bool `json:"enabled"`
+}
+
+// Metrics struct for the daemon's Prometheus metrics, each server has its
+// own registry
+type Metrics struct {
+    registry        *prometheus.Registry
+    commands        *prometheus.CounterVec
+    commandDuration *prometheus.HistogramVec
+    pingRtt         *prometheus.HistogramVec
+    pingLoss        *prometheus.GaugeVec
+    targets         map[string]bool // monitor targets, the only hosts used as labels
+}
+
+// NewMetrics create the metrics, limiter supplies the in flight and
+// rejected command counts and the targets of monitors label ping metrics
+func NewMetrics(limiter *Limiter, monitors []MonitorConfig) *Metrics {
+    m := &Metrics{
+        registry: prometheus.NewRegistry(),
+        commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Namespace: metricsNamespace,
+            Name:      "commands_total",
+            Help:      "Commands executed by type and result code.",
+        }, []string{"command", "code"}),
+        commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Namespace: metricsNamespace,
+            Name:      "command_duration_seconds",
+            Help:      "Time taken to execute commands by type and result code.",
+            Buckets:   []float64{.005, .01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60, 120},
+        }, []string{"command", "code"}),
+        pingRtt: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Namespace: metricsNamespace,
+            Name:      "ping_rtt_seconds",
+            Help:      "Round-trip time of echo replies by monitor target.",
+            Buckets:   prometheus.ExponentialBuckets(.0005, 2, 14),
+        }, []string{"target"}),
+        pingLoss: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Namespace: metricsNamespace,
+            Name:      "ping_packet_loss_ratio",
+            Help:      "Packet loss of the last ping of each monitor target, from 0 to 1.",
+        }, []string{"target"}),
+        targets: make(map[string]bool),
+    }
+    for _, mon := range monitors {
+        m.targets[mon.Target] = true
+    }
+    m.registry.MustRegister(
+        m.commands,
+        m.commandDuration,
+        m.pingRtt,
+        m.pingLoss,
+        prometheus.NewCounterFunc(prometheus.CounterOpts{
+            Namespace: metricsNamespace,
+            Name:      "panics_recovered_total",
+            Help:      "Panics recovered while handling requests.",
+        }, func() float64 { return float64(panicsRecovered.Load()) }),
+        limiterCollector{limiter},
+        collectors.NewGoCollector(),
+        collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+    )
+    return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeCommand records one executed command
+func (m *Metrics) observeCommand(command string, err error, took time.Duration) {
+    code := codeSuccess
+    if err != nil {
+        code = string(asCommandError(err).Code)
+    }
+    m.commands.WithLabelValues(command, code).Inc()
+    m.commandDuration.WithLabelValues(command, code).Observe(took.Seconds())
+}
+
+// observePing records the replies and loss of a ping run, pings of hosts
+// other than monitor targets share an empty target label so callers
+// cannot add label values
+func (m *Metrics) observePing(result PingResult) {
+    if result.PacketsSent == 0 {
+        return
+    }
+    target := ""
+    if m.targets[result.Host] {
+        target = result.Host
+    }
+    rtt := m.pingRtt.WithLabelValues(target)
+    for _, pkt := range result.Packets {
+        if !pkt.Duplicate {
+            rtt.Observe(pkt.Rtt.Seconds())
+        }
+    }
+    m.pingLoss.WithLabelValues(target).Set(result.PacketLoss / 100)
+}
+
+// Commander wraps cmdr so every ping is recorded, whoever started it
+func (m *Metrics) Commander(cmdr Commander) Commander {
+    return &instrumentedCommander{Commander: cmdr, metrics: m}
+}
+
+// instrumentedCommander struct for a Commander that records ping metrics
+type instrumentedCommander struct {
+    Commander
+    metrics *Metrics
+}
+
+func (c *instrumentedCommander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+    result, err := c.Commander.Ping(ctx, host, opts)
+    c.metrics.observePing(result)
+    return result, err
+}
+
+// limiterCollector struct for exporting the limiter's counts
+type limiterCollector struct {
+    limiter *Limiter
+}
+
+var (
+    inFlightDesc = prometheus.NewDesc(metricsNamespace+"_commands_in_flight",
+        "Commands currently running by type.", []string{"command"}, nil)
+    limitedDesc = prometheus.NewDesc(metricsNamespace+"_commands_limited_total",
+        "Commands rejected by rate limits and concurrency caps by type and code.", []string{"command", "code"}, nil)
+)
+
+func (c limiterCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- inFlightDesc
+    ch <- limitedDesc
+}
+
+func (c limiterCollector) Collect(ch chan<- prometheus.Metric) {
+    for command, n := range c.limiter.InFlight() {
+        ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(n), command)
+    }
+    for command, byCode := range c.limiter.Rejected() {
+        for code, n := range byCode {
+            ch <- prometheus.MustNewConstMetric(limitedDesc, prometheus.CounterValue, float64(n), command, string(code))
+        }
+    }
+}
+
+// monitorCollector struct for exporting the rolling statistics of monitors
+type monitorCollector struct {
+    monitors *Monitors
+}
+
+var (
+    monitorLabels = []string{"monitor", "target"}
+    monitorUpDesc = prometheus.NewDesc(metricsNamespace+"_monitor_up",
+        "Whether the last probe of the monitor got a reply.", monitorLabels, nil)
+    monitorLossDesc = prometheus.NewDesc(metricsNamespace+"_monitor_packet_loss_ratio",
+        "Packet loss over the monitor's window, from 0 to 1.", monitorLabels, nil)
+    monitorJitterDesc = prometheus.NewDesc(metricsNamespace+"_monitor_jitter_seconds",
+        "Mean difference between consecutive round-trip times over the monitor's window.", monitorLabels, nil)
+    monitorRttDesc = prometheus.NewDesc(metricsNamespace+"_monitor_rtt_seconds",
+        "Round-trip time percentiles over the monitor's window.", append(monitorLabels, "quantile"), nil)
+    monitorFailuresDesc = prometheus.NewDesc(metricsNamespace+"_monitor_consecutive_failures",
+        "Probes in a row that got no reply.", monitorLabels, nil)
+)
+
+func (c monitorCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- monitorUpDesc
+    ch <- monitorLossDesc
+    ch <- monitorJitterDesc
+    ch <- monitorRttDesc
+    ch <- monitorFailuresDesc
+}
+
+func (c monitorCollector) Collect(ch chan<- prometheus.Metric) {
+    for _, status := range c.monitors.Status() {
+        if status.Probes == 0 {
+            continue
+        }
+        up := 0.0
+        if status.Up {
+            up = 1
+        }
+        ch <- prometheus.MustNewConstMetric(monitorUpDesc, prometheus.GaugeValue, up, status.Name, status.Target)
+        ch <- prometheus.MustNewConstMetric(monitorLossDesc, prometheus.GaugeValue, status.PacketLoss/100, status.Name, status.Target)
+        ch <- prometheus.MustNewConstMetric(monitorJitterDesc, prometheus.GaugeValue, status.Jitter.Seconds(), status.Name, status.Target)
+        ch <- prometheus.MustNewConstMetric(monitorFailuresDesc, prometheus.GaugeValue, float64(status.ConsecutiveFailures), status.Name, status.Target)
+        for quantile, rtt := range map[string]time.Duration{
+            "0.5":  status.P50Rtt,
+            "0.9":  status.P90Rtt,
+            "0.95": status.P95Rtt,
+            "0.99": status.P99Rtt,
+        } {
+            ch <- prometheus.MustNewConstMetric(monitorRttDesc, prometheus.GaugeValue, rtt.Seconds(), status.Name, status.Target, quantile)
+        }
+    }
+}
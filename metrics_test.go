@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrapeMetrics returns the body of GET /metrics
+func scrapeMetrics(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+	return string(body)
+}
+
+func TestMetrics_Commands(t *testing.T) {
+	cmdr := &mockCommander{
+		pingResult: PingResult{
+			Successful:  true,
+			Host:        "example.com",
+			PacketsSent: 4,
+			PacketsRecv: 3,
+			PacketLoss:  25,
+			Packets: []PingPacket{
+				{Seq: 0, Rtt: 10 * time.Millisecond},
+				{Seq: 1, Rtt: 12 * time.Millisecond},
+				{Seq: 2, Rtt: 11 * time.Millisecond},
+				{Seq: 2, Rtt: 11 * time.Millisecond, Duplicate: true},
+			},
+		},
+	}
+	handler := handleRequests(newTestServer(t, cmdr, DefaultConfig()))
+
+	for _, body := range []string{
+		`{"type":"ping","payload":"example.com"}`,
+		`{"type":"sysinfo"}`,
+		`{"type":"ping","payload":""}`,
+		`{"type":"reboot"}`,
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/execute", strings.NewReader(body)))
+	}
+
+	metrics := scrapeMetrics(t, handler)
+	for _, want := range []string{
+		`espresso_commander_commands_total{code="ok",command="ping"} 1`,
+		`espresso_commander_commands_total{code="ok",command="sysinfo"} 1`,
+		`espresso_commander_commands_total{code="invalid_request",command="ping"} 1`,
+		`espresso_commander_command_duration_seconds_count{code="ok",command="ping"} 1`,
+		`espresso_commander_ping_rtt_seconds_count{target=""} 3`,
+		`espresso_commander_ping_packet_loss_ratio{target=""} 0.25`,
+		`espresso_commander_commands_in_flight{command="ping"} 0`,
+		`espresso_commander_panics_recovered_total`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+	// unknown commands and ad-hoc targets are not recorded so callers cannot
+	// add label values
+	if strings.Contains(metrics, `target="example.com"`) {
+		t.Error("expected the ad-hoc ping target not to be a label")
+	}
+	if strings.Contains(metrics, `command="reboot"`) {
+		t.Error("expected unknown commands to be left out")
+	}
+}
+
+func TestMetrics_Limited(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Limits.PerIP = RateConfig{Rate: 0.001, Burst: 1}
+	handler := handleRequests(newTestServer(t, &mockCommander{}, cfg))
+
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/execute", strings.NewReader(`{"type":"sysinfo"}`)))
+	}
+
+	metrics := scrapeMetrics(t, handler)
+	for _, want := range []string{
+		`espresso_commander_commands_limited_total{code="rate_limited",command="sysinfo"} 1`,
+		`espresso_commander_commands_total{code="rate_limited",command="sysinfo"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestMetrics_Panics(t *testing.T) {
+	before := panicsRecovered.Load()
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/execute", nil))
+	if got := panicsRecovered.Load(); got != before+1 {
+		t.Errorf("expected the panic to be counted, got %d after %d", got, before)
+	}
+}
+
+func TestMetrics_Disabled(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Metrics.Enabled = false
+	handler := handleRequests(newTestServer(t, &mockCommander{}, cfg))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+}
+
+func TestMetrics_RequiresAuth(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &mockCommander{}, authConfig()))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "mime"
+    "net/http"
+    "strings"
+)
+
+// MaxBodyBytes is the largest request body accepted by /execute
+var MaxBodyBytes int64 = 1 << 20
+
+// Middleware is a single stage of the request pipeline
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h with the given stages, the first stage runs first
+func chain(h http.Handler, stages ...Middleware) http.Handler {
+    for i := len(stages) - 1; i >= 0; i-- {
+        h = stages[i](h)
+    }
+    return h
+}
+
+// middleware wraps the /execute handler with the standard pipeline
+func middleware(next http.HandlerFunc) http.HandlerFunc {
+    return chain(next,
+        recoverPanics,
+        allowPath("/execute"),
+        allowMethods(http.MethodPost),
+        requireJSON,
+        limitBody(MaxBodyBytes),
+    ).ServeHTTP
+}
+
+// recoverPanics catches all panics and sends a 500 CommandResponse
+func recoverPanics(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        defer func() {
+            if rec := recover(); rec != nil {
+                panicsRecovered.Add(1)
+                log.Printf("Recovered from panic: %v\n", rec)
+                writeResponse(w, http.StatusInternalServerError, CommandResponse{
+                    Success: false,
+                    Code:    ErrCodeInternal,
+                    Error:   fmt.Sprintf("%v", rec),
+                })
+            }
+        }()
+        next.ServeHTTP(w, r)
+    })
+}
+
+// allowPath rejects requests for any path other than path
+func allowPath(path string) Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.URL.Path != path {
+                writeError(w, NewCommandError(ErrCodeNotFound, fmt.Errorf("invalid path: %s", r.URL.Path)), nil)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// allowMethods rejects requests with any method not listed
+func allowMethods(methods ...string) Middleware {
+    allowed := strings.Join(methods, ", ")
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            for _, method := range methods {
+                if r.Method == method {
+                    next.ServeHTTP(w, r)
+                    return
+                }
+            }
+            w.Header().Set("Allow", allowed)
+            writeError(w, NewCommandError(ErrCodeMethodNotAllowed, fmt.Errorf("invalid method: %s", r.Method)), nil)
+        })
+    }
+}
+
+// requireJSON rejects bodies that are declared as anything other than JSON,
+// a missing Content-Type is accepted
+func requireJSON(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        contentType := r.Header.Get("Content-Type")
+        if contentType != "" {
+            mediaType, _, err := mime.ParseMediaType(contentType)
+            if err != nil || mediaType != "application/json" {
+                writeError(w, NewCommandError(ErrCodeUnsupportedMedia, fmt.Errorf("unsupported content type: %s", contentType)), nil)
+                return
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// limitBody caps the number of bytes the handler can read from the body
+func limitBody(n int64) Middleware {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if r.ContentLength > n {
+                writeError(w, NewCommandError(ErrCodeBodyTooLarge, fmt.Errorf("request body exceeds %d bytes", n)), nil)
+                return
+            }
+            r.Body = http.MaxBytesReader(w, r.Body, n)
+            next.ServeHTTP(w, r)
+        })
+    }
+}
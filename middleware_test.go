@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// okHandler records whether it was reached
+type okHandler struct {
+	called bool
+}
+
+func (h *okHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.called = true
+	w.WriteHeader(http.StatusOK)
+}
+
+// decodeResponse parses the CommandResponse in rec
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder) CommandResponse {
+	t.Helper()
+	var res CommandResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to parse response %q: %v", rec.Body.String(), err)
+	}
+	return res
+}
+
+func TestChain_Order(t *testing.T) {
+	var order []string
+	stage := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	final := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	})
+
+	chain(final, stage("first"), stage("second")).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got := strings.Join(order, ","); got != "first,second,handler" {
+		t.Errorf("expected first,second,handler, got %s", got)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/execute", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", rec.Code)
+	}
+	res := decodeResponse(t, rec)
+	if res.Success || res.Code != ErrCodeInternal || res.Error != "boom" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+}
+
+func TestAllowPath(t *testing.T) {
+	next := &okHandler{}
+	handler := allowPath("/execute")(next)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/other", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+	if next.called {
+		t.Error("handler should not run for a rejected path")
+	}
+	if res := decodeResponse(t, rec); res.Code != ErrCodeNotFound {
+		t.Errorf("expected code %s, got %s", ErrCodeNotFound, res.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/execute", nil))
+	if !next.called {
+		t.Error("handler should run for an allowed path")
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	next := &okHandler{}
+	handler := allowMethods(http.MethodPost)(next)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/execute", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rec.Code)
+	}
+	if next.called {
+		t.Error("handler should not run for a rejected method")
+	}
+	if allow := rec.Header().Get("Allow"); allow != "POST" {
+		t.Errorf("expected Allow: POST, got %q", allow)
+	}
+	if res := decodeResponse(t, rec); res.Code != ErrCodeMethodNotAllowed {
+		t.Errorf("expected code %s, got %s", ErrCodeMethodNotAllowed, res.Code)
+	}
+}
+
+func TestRequireJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		allowed     bool
+	}{
+		{name: "missing", contentType: "", allowed: true},
+		{name: "json", contentType: "application/json", allowed: true},
+		{name: "json with charset", contentType: "application/json; charset=utf-8", allowed: true},
+		{name: "form", contentType: "application/x-www-form-urlencoded", allowed: false},
+		{name: "text", contentType: "text/plain", allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &okHandler{}
+			req := httptest.NewRequest("POST", "/execute", nil)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+
+			requireJSON(next).ServeHTTP(rec, req)
+
+			if next.called != tt.allowed {
+				t.Errorf("expected handler called=%v, got %v", tt.allowed, next.called)
+			}
+			if !tt.allowed && rec.Code != http.StatusUnsupportedMediaType {
+				t.Errorf("expected status 415, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	var readErr error
+	handler := limitBody(8)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+
+	// declared length over the limit is rejected up front
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/execute", strings.NewReader("0123456789")))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", rec.Code)
+	}
+
+	// undeclared length is cut off while reading
+	req := httptest.NewRequest("POST", "/execute", io.NopCloser(strings.NewReader("0123456789")))
+	req.ContentLength = -1
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if readErr == nil {
+		t.Error("expected reading past the limit to fail")
+	}
+}
+
+func TestMiddleware_RejectsBeforeHandler(t *testing.T) {
+	cmdr := &mockCommander{pingResult: PingResult{Successful: true}}
+	handler := handleCommand(newTestServer(t, cmdr, DefaultConfig()))
+
+	body := []byte(`{"type":"ping","payload":"example.com"}`)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/execute", bytes.NewBuffer(body)))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rec.Code)
+	}
+	if cmdr.pingHost != "" {
+		t.Error("command should not run for a rejected method")
+	}
+}
+
+func TestMiddleware_BodyTooLarge(t *testing.T) {
+	cmdr := &mockCommander{}
+	handler := handleCommand(newTestServer(t, cmdr, DefaultConfig()))
+
+	body := `{"type":"ping","payload":"` + strings.Repeat("a", int(MaxBodyBytes)) + `"}`
+	req := httptest.NewRequest("POST", "/execute", io.NopCloser(strings.NewReader(body)))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413, got %d", rec.Code)
+	}
+	if res := decodeResponse(t, rec); res.Code != ErrCodeBodyTooLarge {
+		t.Errorf("expected code %s, got %s", ErrCodeBodyTooLarge, res.Code)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// DefaultMonitorWindow is the number of probes statistics are kept over
+const DefaultMonitorWindow = 60
+
+// minMonitorInterval stops a monitor from pinging continuously
+const minMonitorInterval = time.Second
+
+// MonitorConfig struct for a target that is pinged on a schedule
+type MonitorConfig struct {
+    Name     string      `json:"name"`
+    Target   string      `json:"target"`
+    Interval Duration    `json:"interval"`
+    Window   int         `json:"window,omitempty"` // probes kept for the statistics
+    Options  PingOptions `json:"options"`
+}
+
+// Validate checks the monitor against the ping limits
+func (m MonitorConfig) Validate(limits PingLimits) error {
+    if m.Name == "" {
+        return errors.New("name is required")
+    }
+    if m.Target == "" {
+        return fmt.Errorf("%s: target is required", m.Name)
+    }
+    if time.Duration(m.Interval) < minMonitorInterval {
+        return fmt.Errorf("%s: interval must be at least %v", m.Name, minMonitorInterval)
+    }
+    if m.Window < 0 {
+        return fmt.Errorf("%s: window must not be negative", m.Name)
+    }
+    if err := m.Options.Validate(limits); err != nil {
+        return fmt.Errorf("%s: %w", m.Name, err)
+    }
+    return nil
+}
+
+// window returns the number of probes to keep
+func (m MonitorConfig) window() int {
+    if m.Window > 0 {
+        return m.Window
+    }
+    return DefaultMonitorWindow
+}
+
+// MonitorStatus struct for the rolling statistics of a monitor, durations
+// are in nanoseconds like PingResult
+type MonitorStatus struct {
+    Name                string        `json:"name"`
+    Target              string        `json:"target"`
+    Interval            Duration      `json:"interval"`
+    Up                  bool          `json:"up"`
+    Probes              int           `json:"probes"`
+    ConsecutiveFailures int           `json:"consecutive_failures"`
+    LastProbe           time.Time     `json:"last_probe"`
+    LastError           string        `json:"last_error,omitempty"`
+    PacketsSent         int           `json:"packets_sent"`
+    PacketsRecv         int           `json:"packets_recv"`
+    PacketLoss          float64       `json:"packet_loss"`
+    MinRtt              time.Duration `json:"min_rtt"`
+    AvgRtt              time.Duration `json:"avg_rtt"`
+    MaxRtt              time.Duration `json:"max_rtt"`
+    StdDevRtt           time.Duration `json:"stddev_rtt"`
+    Jitter              time.Duration `json:"jitter"`
+    P50Rtt              time.Duration `json:"p50_rtt"`
+    P90Rtt              time.Duration `json:"p90_rtt"`
+    P95Rtt              time.Duration `json:"p95_rtt"`
+    P99Rtt              time.Duration `json:"p99_rtt"`
+}
+
+// probe struct for one ping run of a monitor
+type probe struct {
+    at   time.Time
+    sent int
+    recv int
+    rtts []time.Duration
+    err  error
+}
+
+// monitor struct for one scheduled target
+type monitor struct {
+    cfg MonitorConfig
+
+    mu                  sync.Mutex
+    probes              []probe // oldest first, at most cfg.window()
+    consecutiveFailures int
+}
+
+// record adds the outcome of a ping run to the window
+func (m *monitor) record(at time.Time, result PingResult, err error) MonitorStatus {
+    p := probe{at: at, sent: result.PacketsSent, recv: result.PacketsRecv, err: err}
+    for _, pkt := range result.Packets {
+        if !pkt.Duplicate {
+            p.rtts = append(p.rtts, pkt.Rtt)
+        }
+    }
+    if err == nil && !result.Successful {
+        p.err = fmt.Errorf("no replies from %s", m.cfg.Target)
+    }
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.probes = append(m.probes, p)
+    if len(m.probes) > m.cfg.window() {
+        m.probes = m.probes[len(m.probes)-m.cfg.window():]
+    }
+    if p.err != nil {
+        m.consecutiveFailures++
+    } else {
+        m.consecutiveFailures = 0
+    }
+    return m.statusLocked()
+}
+
+// status returns the statistics over the current window
+func (m *monitor) status() MonitorStatus {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.statusLocked()
+}
+
+func (m *monitor) statusLocked() MonitorStatus {
+    status := MonitorStatus{
+        Name:                m.cfg.Name,
+        Target:              m.cfg.Target,
+        Interval:            m.cfg.Interval,
+        Probes:              len(m.probes),
+        ConsecutiveFailures: m.consecutiveFailures,
+    }
+    if len(m.probes) == 0 {
+        return status
+    }
+    last := m.probes[len(m.probes)-1]
+    status.Up = last.err == nil
+    status.LastProbe = last.at
+    if last.err != nil {
+        status.LastError = last.err.Error()
+    }
+
+    var rtts []time.Duration
+    for _, p := range m.probes {
+        status.PacketsSent += p.sent
+        status.PacketsRecv += p.recv
+        rtts = append(rtts, p.rtts...)
+    }
+    if status.PacketsSent > 0 {
+        status.PacketLoss = float64(status.PacketsSent-status.PacketsRecv) / float64(status.PacketsSent) * 100
+    }
+    status.MinRtt, status.AvgRtt, status.MaxRtt, status.StdDevRtt = rttStatistics(rtts)
+    status.Jitter = jitter(rtts)
+
+    sorted := append([]time.Duration{}, rtts...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+    status.P50Rtt = percentile(sorted, 50)
+    status.P90Rtt = percentile(sorted, 90)
+    status.P95Rtt = percentile(sorted, 95)
+    status.P99Rtt = percentile(sorted, 99)
+    return status
+}
+
+// jitter returns the mean difference between consecutive round-trip times
+func jitter(rtts []time.Duration) time.Duration {
+    if len(rtts) < 2 {
+        return 0
+    }
+    var total time.Duration
+    for i := 1; i < len(rtts); i++ {
+        diff := rtts[i] - rtts[i-1]
+        if diff < 0 {
+            diff = -diff
+        }
+        total += diff
+    }
+    return total / time.Duration(len(rtts)-1)
+}
+
+// percentile returns the nearest-rank percentile p of sorted
+func percentile(sorted []time.Duration, p float64) time.Duration {
+    if len(sorted) == 0 {
+        return 0
+    }
+    rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+    if rank < 1 {
+        rank = 1
+    }
+    return sorted[rank-1]
+}
+
+// Monitors struct for the scheduler pinging every configured target
+type Monitors struct {
+    cmdr     Commander
+    monitors []*monitor
+    // onProbe is called with the new status after every probe
+    onProbe func(MonitorStatus)
+
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+}
+
+// NewMonitors create a scheduler for validated monitor configs, nothing is
+// pinged until Start
+func NewMonitors(cmdr Commander, cfgs []MonitorConfig) *Monitors {
+    ms := &Monitors{cmdr: cmdr}
+    for _, cfg := range cfgs {
+        ms.monitors = append(ms.monitors, &monitor{cfg: cfg})
+    }
+    return ms
+}
+
+// Start pings every target straight away and then at its interval
+func (ms *Monitors) Start() {
+    ctx, cancel := context.WithCancel(context.Background())
+    ms.cancel = cancel
+    for _, m := range ms.monitors {
+        ms.wg.Add(1)
+        go func(m *monitor) {
+            defer ms.wg.Done()
+            ms.run(ctx, m)
+        }(m)
+    }
+}
+
+// run probes m until ctx is cancelled
+func (ms *Monitors) run(ctx context.Context, m *monitor) {
+    ticker := time.NewTicker(time.Duration(m.cfg.Interval))
+    defer ticker.Stop()
+    for {
+        ms.probe(ctx, m)
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// probe pings the monitor's target once
+func (ms *Monitors) probe(ctx context.Context, m *monitor) {
+    defer func() {
+        if rec := recover(); rec != nil {
+            panicsRecovered.Add(1)
+            log.Printf("Recovered from panic in monitor %s: %v\n", m.cfg.Name, rec)
+        }
+    }()
+    result, err := ms.cmdr.Ping(ctx, m.cfg.Target, m.cfg.Options)
+    if ctx.Err() != nil {
+        // shutting down, the probe did not finish
+        return
+    }
+    if err != nil {
+        log.Printf("Monitor %s failed to ping %s: %v\n", m.cfg.Name, m.cfg.Target, err)
+    }
+    status := m.record(time.Now(), result, err)
+    if ms.onProbe != nil {
+        ms.onProbe(status)
+    }
+}
+
+// Status returns the statistics of every monitor in config order
+func (ms *Monitors) Status() []MonitorStatus {
+    statuses := make([]MonitorStatus, 0, len(ms.monitors))
+    for _, m := range ms.monitors {
+        statuses = append(statuses, m.status())
+    }
+    return statuses
+}
+
+// Close stops the scheduler and waits for running probes to finish
+func (ms *Monitors) Close() error {
+    if ms.cancel != nil {
+        ms.cancel()
+    }
+    ms.wg.Wait()
+    return nil
+}
+
+// handleMonitors lists the statistics of every monitor
+func handleMonitors(ms *Monitors) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        writeResponse(w, http.StatusOK, CommandResponse{Success: true, Data: ms.Status()})
+    }
+}
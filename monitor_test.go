@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pingFunc is a Commander whose pings are answered by a function
+type pingFunc func(ctx context.Context, host string, opts PingOptions) (PingResult, error)
+
+func (f pingFunc) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+	return f(ctx, host, opts)
+}
+
+func (f pingFunc) Traceroute(ctx context.Context, host string, opts TracerouteOptions) (TracerouteResult, error) {
+	return TracerouteResult{}, errors.New("not implemented")
+}
+
+func (f pingFunc) GetSystemInfo(ctx context.Context) (SystemInfo, error) {
+	return SystemInfo{}, nil
+}
+
+// replies builds a ping result with one reply per rtt out of sent
+func replies(sent int, rtts ...time.Duration) PingResult {
+	result := PingResult{Host: "example.com", PacketsSent: sent, PacketsRecv: len(rtts), Successful: len(rtts) > 0}
+	for i, rtt := range rtts {
+		result.Packets = append(result.Packets, PingPacket{Seq: i, Rtt: rtt})
+	}
+	return result
+}
+
+func TestMonitor_Statistics(t *testing.T) {
+	m := &monitor{cfg: MonitorConfig{Name: "gateway", Target: "example.com", Window: 3}}
+	ms := time.Millisecond
+	now := time.Now()
+
+	m.record(now, replies(4, 10*ms, 20*ms, 10*ms, 20*ms), nil)
+	status := m.record(now.Add(time.Second), replies(4, 30*ms, 40*ms), nil)
+	if !status.Up || status.Probes != 2 || status.ConsecutiveFailures != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if status.PacketsSent != 8 || status.PacketsRecv != 6 || status.PacketLoss != 25 {
+		t.Errorf("expected 25%% loss over 8 packets, got %+v", status)
+	}
+	// 10 20 10 20 30 40: differences 10 10 10 10 10
+	if status.Jitter != 10*ms {
+		t.Errorf("expected jitter 10ms, got %v", status.Jitter)
+	}
+	if status.P50Rtt != 20*ms || status.P90Rtt != 40*ms || status.MinRtt != 10*ms || status.MaxRtt != 40*ms {
+		t.Errorf("unexpected percentiles %+v", status)
+	}
+
+	status = m.record(now.Add(2*time.Second), replies(4), nil)
+	status = m.record(now.Add(3*time.Second), PingResult{}, errors.New("unreachable"))
+	if status.Up || status.ConsecutiveFailures != 2 || status.LastError != "unreachable" {
+		t.Errorf("expected two failures in a row, got %+v", status)
+	}
+	// the first probe fell out of the window
+	if status.Probes != 3 || status.PacketsSent != 8 || status.PacketsRecv != 2 {
+		t.Errorf("expected the window to hold 3 probes, got %+v", status)
+	}
+
+	status = m.record(now.Add(4*time.Second), replies(1, 5*ms), nil)
+	if !status.Up || status.ConsecutiveFailures != 0 {
+		t.Errorf("expected a reply to reset the failures, got %+v", status)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	for p, want := range map[float64]time.Duration{0: 1, 50: 50, 95: 95, 99: 99, 100: 100} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("percentile(%v) = %v, want %v", p, got, want)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("expected 0 for no samples, got %v", got)
+	}
+}
+
+func TestMonitors_Schedule(t *testing.T) {
+	var probes atomic.Int32
+	cmdr := pingFunc(func(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+		probes.Add(1)
+		if opts.Count != 2 {
+			t.Errorf("expected the monitor's options, got %+v", opts)
+		}
+		result := replies(2, time.Millisecond, 3*time.Millisecond)
+		result.Host = host
+		return result, nil
+	})
+	cfg := DefaultConfig()
+	cfg.Monitors = []MonitorConfig{
+		{Name: "gateway", Target: "192.0.2.1", Interval: Duration(10 * time.Millisecond), Options: PingOptions{Count: 2}},
+	}
+	server := newTestServer(t, cmdr, cfg)
+	handler := handleRequests(server)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for probes.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("monitor did not keep probing")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/monitors", nil))
+	var res struct {
+		Success bool            `json:"success"`
+		Data    []MonitorStatus `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !res.Success || len(res.Data) != 1 {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	status := res.Data[0]
+	if status.Name != "gateway" || !status.Up || status.Probes < 3 || status.Jitter != 2*time.Millisecond {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	metrics := scrapeMetrics(t, handler)
+	for _, want := range []string{
+		`espresso_commander_monitor_up{monitor="gateway",target="192.0.2.1"} 1`,
+		`espresso_commander_monitor_rtt_seconds{monitor="gateway",quantile="0.95",target="192.0.2.1"} 0.003`,
+		`espresso_commander_ping_rtt_seconds_count{target="192.0.2.1"}`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected metrics to contain %s", want)
+		}
+	}
+
+	// no probes once the server is closed
+	server.Close()
+	stopped := probes.Load()
+	time.Sleep(50 * time.Millisecond)
+	if probes.Load() != stopped {
+		t.Error("expected probes to stop after Close")
+	}
+}
+
+func TestMonitorConfig_Validate(t *testing.T) {
+	valid := MonitorConfig{Name: "gateway", Target: "192.0.2.1", Interval: Duration(time.Minute)}
+	if err := valid.Validate(DefaultPingLimits); err != nil {
+		t.Fatalf("expected valid monitor, got %v", err)
+	}
+	invalid := []MonitorConfig{
+		{Target: "192.0.2.1", Interval: Duration(time.Minute)},
+		{Name: "gateway", Interval: Duration(time.Minute)},
+		{Name: "gateway", Target: "192.0.2.1", Interval: Duration(time.Millisecond)},
+		{Name: "gateway", Target: "192.0.2.1", Interval: Duration(time.Minute), Window: -1},
+		{Name: "gateway", Target: "192.0.2.1", Interval: Duration(time.Minute), Options: PingOptions{Count: 1000}},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(DefaultPingLimits); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+)
+
+// Address families
+const (
+    FamilyIPv4 = "ipv4"
+    FamilyIPv6 = "ipv6"
+    FamilyAny  = "any"
+)
+
+// lookupIP resolves host names, tests replace it to avoid real DNS
+var lookupIP = net.DefaultResolver.LookupIP
+
+// routeProbes are documentation addresses used to ask the kernel which
+// source address it would pick for the default route, nothing is sent
+var routeProbes = map[string]string{
+    FamilyIPv4: "192.0.2.1:9",
+    FamilyIPv6: "[2001:db8::1]:9",
+}
+
+// NetworkInfo struct for every interface and the primary addresses
+type NetworkInfo struct {
+    Primary    PrimaryAddress  `json:"primary"`
+    Interfaces []InterfaceInfo `json:"interfaces"`
+}
+
+// PrimaryAddress struct for the addresses used by the default routes
+type PrimaryAddress struct {
+    Interface string `json:"interface"`
+    IPv4      string `json:"ipv4"`
+    IPv6      string `json:"ipv6"`
+}
+
+// InterfaceInfo struct for a single network interface
+type InterfaceInfo struct {
+    Name      string        `json:"name"`
+    Index     int           `json:"index"`
+    MAC       string        `json:"mac"`
+    MTU       int           `json:"mtu"`
+    Flags     []string      `json:"flags"`
+    State     string        `json:"state"`
+    Addresses []AddressInfo `json:"addresses"`
+}
+
+// AddressInfo struct for an address assigned to an interface
+type AddressInfo struct {
+    Address      string `json:"address"`
+    PrefixLength int    `json:"prefix_length"`
+    Family       string `json:"family"`
+}
+
+// readNetworkInfo lists every interface and works out the primary addresses
+func readNetworkInfo() (NetworkInfo, error) {
+    interfaces, err := net.Interfaces()
+    if err != nil {
+        return NetworkInfo{}, err
+    }
+
+    var network NetworkInfo
+    for _, iface := range interfaces {
+        // an interface without readable addresses is still worth listing
+        addrs, _ := iface.Addrs()
+        network.Interfaces = append(network.Interfaces, newInterfaceInfo(iface, addrs))
+    }
+
+    network.Primary.IPv4 = routeSourceAddress(FamilyIPv4)
+    network.Primary.IPv6 = routeSourceAddress(FamilyIPv6)
+    network.Primary.Interface = network.interfaceFor(network.Primary.IPv4)
+    if network.Primary.Interface == "" {
+        network.Primary.Interface = network.interfaceFor(network.Primary.IPv6)
+    }
+    return network, nil
+}
+
+// newInterfaceInfo describes iface and its addresses
+func newInterfaceInfo(iface net.Interface, addrs []net.Addr) InterfaceInfo {
+    info := InterfaceInfo{
+        Name:      iface.Name,
+        Index:     iface.Index,
+        MAC:       iface.HardwareAddr.String(),
+        MTU:       iface.MTU,
+        Flags:     []string{},
+        State:     "down",
+        Addresses: []AddressInfo{},
+    }
+    if iface.Flags != 0 {
+        info.Flags = strings.Split(iface.Flags.String(), "|")
+    }
+    if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagRunning != 0 {
+        info.State = "up"
+    }
+
+    for _, addr := range addrs {
+        var ip net.IP
+        prefix := 0
+        // Extract IP from address based on type
+        switch v := addr.(type) {
+        case *net.IPNet:
+            ip = v.IP
+            prefix, _ = v.Mask.Size()
+        case *net.IPAddr:
+            ip = v.IP
+        }
+        if ip == nil {
+            continue
+        }
+        family := FamilyIPv6
+        if ip.To4() != nil {
+            family = FamilyIPv4
+        }
+        info.Addresses = append(info.Addresses, AddressInfo{
+            Address:      ip.String(),
+            PrefixLength: prefix,
+            Family:       family,
+        })
+    }
+    return info
+}
+
+// routeSourceAddress returns the local address the kernel would use to
+// reach the outside world, or "" when there is no default route
+func routeSourceAddress(family string) string {
+    network := "udp4"
+    if family == FamilyIPv6 {
+        network = "udp6"
+    }
+    // connecting a UDP socket only performs the route lookup
+    conn, err := net.Dial(network, routeProbes[family])
+    if err != nil {
+        return ""
+    }
+    defer conn.Close()
+    addr, ok := conn.LocalAddr().(*net.UDPAddr)
+    if !ok || addr.IP.IsUnspecified() {
+        return ""
+    }
+    return addr.IP.String()
+}
+
+// interfaceFor returns the name of the interface that has address
+func (n NetworkInfo) interfaceFor(address string) string {
+    if address == "" {
+        return ""
+    }
+    for _, iface := range n.Interfaces {
+        for _, addr := range iface.Addresses {
+            if addr.Address == address {
+                return iface.Name
+            }
+        }
+    }
+    return ""
+}
+
+// firstIPv4 returns the first IPv4 address on an active, non-loopback
+// interface in interface order
+func (n NetworkInfo) firstIPv4() string {
+    for _, iface := range n.Interfaces {
+        if iface.State != "up" || containsFlag(iface.Flags, net.FlagLoopback) {
+            continue
+        }
+        for _, addr := range iface.Addresses {
+            if addr.Family == FamilyIPv4 {
+                return addr.Address
+            }
+        }
+    }
+    return ""
+}
+
+// containsFlag reports whether flags includes flag
+func containsFlag(flags []string, flag net.Flags) bool {
+    for _, f := range flags {
+        if f == flag.String() {
+            return true
+        }
+    }
+    return false
+}
+
+// ipFamily returns the address family of ip
+func ipFamily(ip net.IP) string {
+    if ip.To4() != nil {
+        return FamilyIPv4
+    }
+    return FamilyIPv6
+}
+
+// resolveHost returns the addresses of host in the requested family, for
+// FamilyAny IPv4 addresses are listed first
+func resolveHost(ctx context.Context, host string, family string) ([]net.IP, error) {
+    if ip := net.ParseIP(host); ip != nil {
+        if family != FamilyAny && ipFamily(ip) != family {
+            return nil, fmt.Errorf("%s is not an %s address", host, family)
+        }
+        return []net.IP{ip}, nil
+    }
+
+    network := "ip"
+    switch family {
+    case FamilyIPv4:
+        network = "ip4"
+    case FamilyIPv6:
+        network = "ip6"
+    }
+    found, err := lookupIP(ctx, network, host)
+    if err != nil {
+        return nil, err
+    }
+
+    // drop duplicates and anything outside the requested family
+    var ips []net.IP
+    seen := make(map[string]bool)
+    for _, ip := range found {
+        if seen[ip.String()] || (family != FamilyAny && ipFamily(ip) != family) {
+            continue
+        }
+        seen[ip.String()] = true
+        ips = append(ips, ip)
+    }
+    if len(ips) == 0 {
+        return nil, fmt.Errorf("no %s addresses found for %s", family, host)
+    }
+    sort.SliceStable(ips, func(i, j int) bool {
+        return ipFamily(ips[i]) == FamilyIPv4 && ipFamily(ips[j]) == FamilyIPv6
+    })
+    return ips, nil
+}
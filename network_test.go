@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestNewInterfaceInfo(t *testing.T) {
+	mac, _ := net.ParseMAC("02:fc:00:00:00:01")
+	iface := net.Interface{
+		Index:        4,
+		MTU:          1500,
+		Name:         "eth0",
+		HardwareAddr: mac,
+		Flags:        net.FlagUp | net.FlagBroadcast | net.FlagRunning,
+	}
+	_, v4, _ := net.ParseCIDR("192.168.1.10/24")
+	v4.IP = net.ParseIP("192.168.1.10")
+	_, v6, _ := net.ParseCIDR("fe80::1/64")
+	v6.IP = net.ParseIP("fe80::1")
+
+	info := newInterfaceInfo(iface, []net.Addr{v4, v6, &net.IPAddr{IP: net.ParseIP("10.0.0.1")}})
+
+	if info.Name != "eth0" || info.Index != 4 || info.MTU != 1500 || info.MAC != "02:fc:00:00:00:01" {
+		t.Errorf("unexpected interface details: %+v", info)
+	}
+	if info.State != "up" {
+		t.Errorf("expected state up, got %s", info.State)
+	}
+	if len(info.Flags) != 3 || info.Flags[0] != "up" {
+		t.Errorf("unexpected flags: %v", info.Flags)
+	}
+	if len(info.Addresses) != 3 {
+		t.Fatalf("expected 3 addresses, got %d", len(info.Addresses))
+	}
+	want := []AddressInfo{
+		{Address: "192.168.1.10", PrefixLength: 24, Family: FamilyIPv4},
+		{Address: "fe80::1", PrefixLength: 64, Family: FamilyIPv6},
+		{Address: "10.0.0.1", PrefixLength: 0, Family: FamilyIPv4},
+	}
+	for i, addr := range want {
+		if info.Addresses[i] != addr {
+			t.Errorf("address %d: expected %+v, got %+v", i, addr, info.Addresses[i])
+		}
+	}
+
+	down := newInterfaceInfo(net.Interface{Name: "eth1", Flags: net.FlagUp}, nil)
+	if down.State != "down" {
+		t.Errorf("expected interface without carrier to be down, got %s", down.State)
+	}
+}
+
+func TestNetworkInfo_FirstIPv4(t *testing.T) {
+	network := NetworkInfo{
+		Interfaces: []InterfaceInfo{
+			{Name: "lo", Flags: []string{"up", "loopback", "running"}, State: "up",
+				Addresses: []AddressInfo{{Address: "127.0.0.1", Family: FamilyIPv4}}},
+			{Name: "eth0", Flags: []string{"broadcast"}, State: "down",
+				Addresses: []AddressInfo{{Address: "10.0.0.1", Family: FamilyIPv4}}},
+			{Name: "eth1", Flags: []string{"up", "running"}, State: "up",
+				Addresses: []AddressInfo{{Address: "fd00::2", Family: FamilyIPv6}, {Address: "10.0.1.1", Family: FamilyIPv4}}},
+		},
+	}
+
+	if got := network.firstIPv4(); got != "10.0.1.1" {
+		t.Errorf("expected 10.0.1.1, got %s", got)
+	}
+	if got := network.interfaceFor("fd00::2"); got != "eth1" {
+		t.Errorf("expected eth1, got %s", got)
+	}
+	if got := network.interfaceFor("192.0.2.1"); got != "" {
+		t.Errorf("expected no interface, got %s", got)
+	}
+}
+
+func TestReadNetworkInfo(t *testing.T) {
+	network, err := readNetworkInfo()
+	if err != nil {
+		t.Fatalf("readNetworkInfo() returned error: %v", err)
+	}
+	if len(network.Interfaces) == 0 {
+		t.Fatal("expected at least one interface")
+	}
+	if network.interfaceFor("127.0.0.1") == "" {
+		t.Error("expected the loopback address to be listed")
+	}
+	if network.Primary.IPv4 != "" && network.Primary.Interface == "" {
+		t.Errorf("expected the primary address %s to belong to an interface", network.Primary.IPv4)
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	defer func(orig func(context.Context, string, string) ([]net.IP, error)) { lookupIP = orig }(lookupIP)
+	var lookedUp string
+	lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		lookedUp = network
+		if host == "missing.test" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.1")}, nil
+	}
+
+	tests := []struct {
+		name        string
+		host        string
+		family      string
+		wantNetwork string
+		want        []string
+		wantErr     bool
+	}{
+		{name: "ipv4 literal", host: "127.0.0.1", family: FamilyAny, want: []string{"127.0.0.1"}},
+		{name: "ipv6 literal", host: "::1", family: FamilyIPv6, want: []string{"::1"}},
+		{name: "literal outside family", host: "::1", family: FamilyIPv4, wantErr: true},
+		{name: "any family", host: "dual.test", family: FamilyAny, wantNetwork: "ip", want: []string{"192.0.2.1", "2001:db8::1"}},
+		{name: "ipv4 only", host: "dual.test", family: FamilyIPv4, wantNetwork: "ip4", want: []string{"192.0.2.1"}},
+		{name: "ipv6 only", host: "dual.test", family: FamilyIPv6, wantNetwork: "ip6", want: []string{"2001:db8::1"}},
+		{name: "lookup failure", host: "missing.test", family: FamilyAny, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookedUp = ""
+			ips, err := resolveHost(context.Background(), tt.host, tt.family)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", ips)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveHost() returned error: %v", err)
+			}
+			if lookedUp != tt.wantNetwork {
+				t.Errorf("expected lookup on %q, got %q", tt.wantNetwork, lookedUp)
+			}
+			if len(ips) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, ips)
+			}
+			for i := range ips {
+				if ips[i].String() != tt.want[i] {
+					t.Errorf("expected %v, got %v", tt.want, ips)
+				}
+			}
+		})
+	}
+
+	var dnsErr *net.DNSError
+	if _, err := resolveHost(context.Background(), "missing.test", FamilyAny); !errors.As(err, &dnsErr) {
+		t.Errorf("expected the DNS error to be kept, got %v", err)
+	}
+}
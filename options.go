@@ -0,0 +1,204 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "time"
+)
+
+// Duration wraps time.Duration so options can be given as "1s" or as nanoseconds
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string such as "1.5s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON accepts either a duration string or a number of nanoseconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+    var v interface{}
+    if err := json.Unmarshal(b, &v); err != nil {
+        return err
+    }
+    switch value := v.(type) {
+    case float64:
+        *d = Duration(time.Duration(value))
+    case string:
+        parsed, err := time.ParseDuration(value)
+        if err != nil {
+            return err
+        }
+        *d = Duration(parsed)
+    default:
+        return fmt.Errorf("invalid duration: %s", string(b))
+    }
+    return nil
+}
+
+// PingOptions struct for per-request ping settings, zero values use the defaults
+type PingOptions struct {
+    Count         int      `json:"count,omitempty"`
+    Interval      Duration `json:"interval,omitempty"`
+    Timeout       Duration `json:"timeout,omitempty"`
+    PacketTimeout Duration `json:"packet_timeout,omitempty"`
+    Size          int      `json:"size,omitempty"`
+    TTL           int      `json:"ttl,omitempty"`
+    Source        string   `json:"source,omitempty"`
+    Privileged    bool     `json:"privileged,omitempty"`
+    Family        string   `json:"family,omitempty"`
+    AllAddresses  bool     `json:"all_addresses,omitempty"`
+}
+
+// minPingSize is the smallest payload pro-bing can track replies with
+const minPingSize = 24
+
+// DefaultPingOptions are the settings used when a request does not override them
+var DefaultPingOptions = PingOptions{
+    Count:    4,
+    Interval: Duration(time.Second),
+    Timeout:  Duration(10 * time.Second),
+    Size:     24,
+    TTL:      64,
+}
+
+// withDefaults fills any unset option from DefaultPingOptions
+func (o PingOptions) withDefaults() PingOptions {
+    if o.Count == 0 {
+        o.Count = DefaultPingOptions.Count
+    }
+    if o.Interval == 0 {
+        o.Interval = DefaultPingOptions.Interval
+    }
+    if o.Timeout == 0 {
+        o.Timeout = DefaultPingOptions.Timeout
+    }
+    if o.Size == 0 {
+        o.Size = DefaultPingOptions.Size
+    }
+    if o.TTL == 0 {
+        o.TTL = DefaultPingOptions.TTL
+    }
+    if o.Family == "" {
+        o.Family = FamilyAny
+    }
+    return o
+}
+
+// family returns the address family to resolve the host in, a source
+// address narrows FamilyAny down to its own family
+func (o PingOptions) family() string {
+    if (o.Family == "" || o.Family == FamilyAny) && o.Source != "" {
+        if ip := net.ParseIP(o.Source); ip != nil {
+            return ipFamily(ip)
+        }
+    }
+    if o.Family == "" {
+        return FamilyAny
+    }
+    return o.Family
+}
+
+// runTimeout returns how long the whole run may take, the per-packet
+// timeout bounds how long we wait for the reply to the last request
+func (o PingOptions) runTimeout() time.Duration {
+    timeout := time.Duration(o.Timeout)
+    if o.PacketTimeout > 0 && o.Count > 0 {
+        last := time.Duration(o.Interval)*time.Duration(o.Count-1) + time.Duration(o.PacketTimeout)
+        if last < timeout {
+            timeout = last
+        }
+    }
+    return timeout
+}
+
+// PingLimits struct for the server-side bounds on PingOptions
+type PingLimits struct {
+    MaxCount        int      `json:"max_count"`
+    MinInterval     Duration `json:"min_interval"`
+    MaxTimeout      Duration `json:"max_timeout"`
+    MaxSize         int      `json:"max_size"`
+    MinTTL          int      `json:"min_ttl"`
+    MaxTTL          int      `json:"max_ttl"`
+    AllowPrivileged bool     `json:"allow_privileged"`
+}
+
+// DefaultPingLimits are the bounds applied when none are configured
+var DefaultPingLimits = PingLimits{
+    MaxCount:        100,
+    MinInterval:     Duration(200 * time.Millisecond),
+    MaxTimeout:      Duration(60 * time.Second),
+    MaxSize:         1472,
+    MinTTL:          1,
+    MaxTTL:          255,
+    AllowPrivileged: true,
+}
+
+// Validate checks that the limits make sense and still allow the defaults
+func (l PingLimits) Validate() error {
+    if l.MaxCount < 1 {
+        return errors.New("max_count must be at least 1")
+    }
+    if l.MinInterval < 0 {
+        return errors.New("min_interval must not be negative")
+    }
+    if l.MaxTimeout <= 0 {
+        return errors.New("max_timeout must be positive")
+    }
+    if l.MaxSize < minPingSize {
+        return fmt.Errorf("max_size must be at least %d", minPingSize)
+    }
+    if l.MinTTL < 1 || l.MaxTTL > 255 || l.MinTTL > l.MaxTTL {
+        return errors.New("min_ttl and max_ttl must be between 1 and 255")
+    }
+    err := PingOptions{}.Validate(l)
+    if err != nil {
+        return fmt.Errorf("default ping options fall outside the limits: %w", err)
+    }
+    return nil
+}
+
+// Validate checks the options against the given limits, unset options are
+// validated with their default values
+func (o PingOptions) Validate(l PingLimits) error {
+    o = o.withDefaults()
+    if o.Count < 0 || o.Count > l.MaxCount {
+        return fmt.Errorf("count must be between 1 and %d", l.MaxCount)
+    }
+    if o.Interval < l.MinInterval {
+        return fmt.Errorf("interval must be at least %v", time.Duration(l.MinInterval))
+    }
+    if o.Timeout < 0 || o.Timeout > l.MaxTimeout {
+        return fmt.Errorf("timeout must be between 0s and %v", time.Duration(l.MaxTimeout))
+    }
+    if o.PacketTimeout < 0 || o.PacketTimeout > o.Timeout {
+        return errors.New("packet_timeout must be between 0s and timeout")
+    }
+    // the last request has to go out before the run is cut off
+    if sending := time.Duration(o.Interval) * time.Duration(o.Count-1); sending >= time.Duration(o.Timeout) {
+        return fmt.Errorf("timeout must be longer than the %v it takes to send %d requests", sending, o.Count)
+    }
+    if o.Size < minPingSize || o.Size > l.MaxSize {
+        return fmt.Errorf("size must be between %d and %d", minPingSize, l.MaxSize)
+    }
+    if o.TTL < l.MinTTL || o.TTL > l.MaxTTL {
+        return fmt.Errorf("ttl must be between %d and %d", l.MinTTL, l.MaxTTL)
+    }
+    if o.Family != FamilyAny && o.Family != FamilyIPv4 && o.Family != FamilyIPv6 {
+        return fmt.Errorf("family must be %s, %s or %s", FamilyIPv4, FamilyIPv6, FamilyAny)
+    }
+    if o.Source != "" {
+        source := net.ParseIP(o.Source)
+        if source == nil {
+            return fmt.Errorf("invalid source address: %s", o.Source)
+        }
+        if o.Family != FamilyAny && ipFamily(source) != o.Family {
+            return fmt.Errorf("source address %s is not an %s address", o.Source, o.Family)
+        }
+    }
+    if o.Privileged && !l.AllowPrivileged {
+        return errors.New("privileged mode is not allowed")
+    }
+    return nil
+}
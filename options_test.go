@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDuration_JSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Duration
+		wantErr bool
+	}{
+		{name: "string", input: `"1.5s"`, want: Duration(1500 * time.Millisecond)},
+		{name: "nanoseconds", input: `250000000`, want: Duration(250 * time.Millisecond)},
+		{name: "invalid string", input: `"soon"`, wantErr: true},
+		{name: "invalid type", input: `true`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d Duration
+			err := json.Unmarshal([]byte(tt.input), &d)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error for %s", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d != tt.want {
+				t.Errorf("expected %v, got %v", time.Duration(tt.want), time.Duration(d))
+			}
+		})
+	}
+
+	data, err := json.Marshal(Duration(2 * time.Second))
+	if err != nil {
+		t.Fatalf("failed to marshal Duration: %v", err)
+	}
+	if string(data) != `"2s"` {
+		t.Errorf("expected \"2s\", got %s", data)
+	}
+}
+
+func TestPingOptions_WithDefaults(t *testing.T) {
+	opts := PingOptions{Count: 2}.withDefaults()
+
+	if opts.Count != 2 {
+		t.Errorf("expected count 2, got %d", opts.Count)
+	}
+	if opts.Interval != DefaultPingOptions.Interval {
+		t.Errorf("expected default interval, got %v", time.Duration(opts.Interval))
+	}
+	if opts.Size != DefaultPingOptions.Size || opts.TTL != DefaultPingOptions.TTL {
+		t.Errorf("expected default size and ttl, got %d and %d", opts.Size, opts.TTL)
+	}
+}
+
+func TestPingOptions_Family(t *testing.T) {
+	tests := []struct {
+		opts PingOptions
+		want string
+	}{
+		{opts: PingOptions{}, want: FamilyAny},
+		{opts: PingOptions{Family: FamilyIPv6}, want: FamilyIPv6},
+		{opts: PingOptions{Source: "10.0.0.1"}, want: FamilyIPv4},
+		{opts: PingOptions{Family: FamilyAny, Source: "fd00::1"}, want: FamilyIPv6},
+	}
+
+	for _, tt := range tests {
+		if got := tt.opts.family(); got != tt.want {
+			t.Errorf("%+v: expected family %s, got %s", tt.opts, tt.want, got)
+		}
+	}
+}
+
+func TestPingOptions_RunTimeout(t *testing.T) {
+	opts := PingOptions{
+		Count:         3,
+		Interval:      Duration(time.Second),
+		Timeout:       Duration(30 * time.Second),
+		PacketTimeout: Duration(2 * time.Second),
+	}
+	if got := opts.runTimeout(); got != 4*time.Second {
+		t.Errorf("expected 4s, got %v", got)
+	}
+
+	opts.PacketTimeout = 0
+	if got := opts.runTimeout(); got != 30*time.Second {
+		t.Errorf("expected 30s, got %v", got)
+	}
+}
+
+func TestPingOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    PingOptions
+		limits  PingLimits
+		wantErr bool
+	}{
+		{name: "defaults", opts: PingOptions{}, limits: DefaultPingLimits},
+		{name: "within limits", opts: PingOptions{Count: 10, Size: 56, TTL: 128, Source: "10.0.0.1"}, limits: DefaultPingLimits},
+		{name: "negative count", opts: PingOptions{Count: -1}, limits: DefaultPingLimits, wantErr: true},
+		{name: "count too high", opts: PingOptions{Count: 1000}, limits: DefaultPingLimits, wantErr: true},
+		{name: "interval too short", opts: PingOptions{Interval: Duration(time.Millisecond)}, limits: DefaultPingLimits, wantErr: true},
+		{name: "timeout too long", opts: PingOptions{Timeout: Duration(time.Hour)}, limits: DefaultPingLimits, wantErr: true},
+		{name: "count does not fit in timeout", opts: PingOptions{Count: 100}, limits: DefaultPingLimits, wantErr: true},
+		{name: "count fits in timeout", opts: PingOptions{Count: 100, Interval: Duration(200 * time.Millisecond), Timeout: Duration(30 * time.Second)}, limits: DefaultPingLimits},
+		{name: "packet timeout longer than timeout", opts: PingOptions{PacketTimeout: Duration(time.Minute)}, limits: DefaultPingLimits, wantErr: true},
+		{name: "size too large", opts: PingOptions{Size: 9000}, limits: DefaultPingLimits, wantErr: true},
+		{name: "ttl too high", opts: PingOptions{TTL: 300}, limits: DefaultPingLimits, wantErr: true},
+		{name: "invalid source", opts: PingOptions{Source: "not-an-ip"}, limits: DefaultPingLimits, wantErr: true},
+		{name: "size too small", opts: PingOptions{Size: 8}, limits: DefaultPingLimits, wantErr: true},
+		{name: "ipv6 family", opts: PingOptions{Family: FamilyIPv6, Source: "::1"}, limits: DefaultPingLimits},
+		{name: "unknown family", opts: PingOptions{Family: "ipx"}, limits: DefaultPingLimits, wantErr: true},
+		{name: "source outside family", opts: PingOptions{Family: FamilyIPv6, Source: "10.0.0.1"}, limits: DefaultPingLimits, wantErr: true},
+		{name: "privileged not allowed", opts: PingOptions{Privileged: true}, limits: PingLimits{MaxCount: 10, MaxTimeout: Duration(time.Minute), MaxSize: 64, MinTTL: 1, MaxTTL: 64}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate(tt.limits)
+			if tt.wantErr && err == nil {
+				t.Error("expected validation error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected validation error: %v", err)
+			}
+		})
+	}
+}
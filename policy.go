@@ -0,0 +1,266 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/netip"
+    "path"
+    "strings"
+)
+
+// Policy effects
+const (
+    PolicyAllow = "allow"
+    PolicyDeny  = "deny"
+)
+
+// PolicyConfig struct for command authorization rules, the first rule
+// matching a request decides, Default applies when none match
+type PolicyConfig struct {
+    Default string       `json:"default"`
+    Rules   []PolicyRule `json:"rules"`
+}
+
+// PolicyRule struct for one authorization rule, empty lists match anything
+type PolicyRule struct {
+    Name       string   `json:"name,omitempty"`
+    Principals []string `json:"principals,omitempty"` // key labels, globs such as cert:* allowed
+    Roles      []string `json:"roles,omitempty"`
+    Commands   []string `json:"commands,omitempty"`
+    Targets    []string `json:"targets,omitempty"` // CIDRs or hostname globs the payload must match
+    Effect     string   `json:"effect"`
+}
+
+// Validate checks the effects and target patterns
+func (p PolicyConfig) Validate() error {
+    if p.Default != "" && p.Default != PolicyAllow && p.Default != PolicyDeny {
+        return fmt.Errorf("default must be %s or %s, got %q", PolicyAllow, PolicyDeny, p.Default)
+    }
+    for i, rule := range p.Rules {
+        if rule.Effect != PolicyAllow && rule.Effect != PolicyDeny {
+            return fmt.Errorf("%s: effect must be %s or %s, got %q", rule.name(i), PolicyAllow, PolicyDeny, rule.Effect)
+        }
+        for _, pattern := range rule.Principals {
+            if _, err := path.Match(pattern, ""); err != nil {
+                return fmt.Errorf("%s: principal %q: %w", rule.name(i), pattern, err)
+            }
+        }
+        for _, target := range rule.Targets {
+            if err := validateTargetPattern(target); err != nil {
+                return fmt.Errorf("%s: %w", rule.name(i), err)
+            }
+        }
+    }
+    return nil
+}
+
+// name identifies the rule in errors and logs
+func (r PolicyRule) name(i int) string {
+    if r.Name != "" {
+        return fmt.Sprintf("rule %q", r.Name)
+    }
+    return fmt.Sprintf("rule %d", i+1)
+}
+
+// matches reports whether the rule applies to the caller and request
+func (r PolicyRule) matches(p Principal, req CommandRequest) bool {
+    if !r.appliesTo(p, req) {
+        return false
+    }
+    if len(r.Targets) > 0 && !r.matchesPayload(req.Payload) {
+        return false
+    }
+    return true
+}
+
+// appliesTo reports whether the rule's principals and commands match,
+// leaving out the targets
+func (r PolicyRule) appliesTo(p Principal, req CommandRequest) bool {
+    if len(r.Principals) > 0 || len(r.Roles) > 0 {
+        if !matchesAny(r.Principals, p.Label) && !containsAny(r.Roles, p.Roles) {
+            return false
+        }
+    }
+    if len(r.Commands) > 0 && !containsAny(r.Commands, []string{req.Type}) {
+        return false
+    }
+    return true
+}
+
+// dependsOnAddress reports whether the rule could match the hostname
+// payload once it is resolved, a CIDR target can only be checked against
+// the addresses the name resolves to
+func (r PolicyRule) dependsOnAddress(payload string) bool {
+    if payload == "" || net.ParseIP(payload) != nil {
+        return false
+    }
+    if _, err := parseAddressRange(payload); err == nil {
+        return false
+    }
+    for _, target := range r.Targets {
+        if strings.Contains(target, "/") {
+            return true
+        }
+    }
+    return false
+}
+
+// matchesPayload reports whether the payload is one of the rule's targets,
+// a CIDR or address range payload matches a deny rule when any of its
+// addresses do and an allow rule only when one target holds all of them
+func (r PolicyRule) matchesPayload(payload string) bool {
+    if net.ParseIP(payload) != nil || !strings.ContainsAny(payload, "/-") {
+        return matchesTarget(r.Targets, payload)
+    }
+    addrs, err := parseAddressRange(payload)
+    if err != nil {
+        return matchesTarget(r.Targets, payload)
+    }
+    for _, target := range r.Targets {
+        prefix, err := netip.ParsePrefix(target)
+        if err != nil {
+            continue
+        }
+        prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits())
+        if r.Effect == PolicyDeny && addrs.overlaps(prefix) {
+            return true
+        }
+        if r.Effect == PolicyAllow && addrs.within(prefix) {
+            return true
+        }
+    }
+    return false
+}
+
+// Policy struct for evaluating PolicyConfig
+type Policy struct {
+    cfg PolicyConfig
+}
+
+// NewPolicy create a policy from validated rules
+func NewPolicy(cfg PolicyConfig) *Policy {
+    if cfg.Default == "" {
+        cfg.Default = PolicyAllow
+    }
+    return &Policy{cfg: cfg}
+}
+
+// Authorize returns a forbidden error when p may not run req, a hostname
+// payload reaching a rule with CIDR targets is left to CheckTarget once the
+// command has resolved it
+func (pol *Policy) Authorize(p Principal, req CommandRequest) error {
+    effect, reason := pol.cfg.Default, "default policy"
+    for i, rule := range pol.cfg.Rules {
+        if rule.matches(p, req) {
+            effect, reason = rule.Effect, "policy "+rule.name(i)
+            break
+        }
+        if rule.appliesTo(p, req) && rule.dependsOnAddress(req.Payload) {
+            return nil
+        }
+    }
+    if effect == PolicyDeny {
+        return NewCommandError(ErrCodeForbidden, fmt.Errorf("%s denied by %s", req.Type, reason))
+    }
+    return nil
+}
+
+// CheckTarget returns an error wrapping ErrTargetRefused when the policy
+// refuses p sending req's traffic to ip, one of the addresses host resolved
+// to, CIDR targets match ip and hostname globs match host
+func (pol *Policy) CheckTarget(p Principal, req CommandRequest, host string, ip net.IP) error {
+    effect, reason := pol.cfg.Default, "default policy"
+    for i, rule := range pol.cfg.Rules {
+        if !rule.appliesTo(p, req) {
+            continue
+        }
+        if len(rule.Targets) == 0 || matchesTarget(rule.Targets, host) || matchesTarget(rule.Targets, ip.String()) {
+            effect, reason = rule.Effect, "policy "+rule.name(i)
+            break
+        }
+    }
+    if effect == PolicyDeny {
+        return fmt.Errorf("%w: %s (%s) denied by %s", ErrTargetRefused, host, ip, reason)
+    }
+    return nil
+}
+
+// TargetCheck is called with every address a command resolved its target
+// to before sending it traffic
+type TargetCheck func(host string, ip net.IP) error
+
+type targetCheckKey struct{}
+
+// withTargetCheck returns a context that makes commands refuse the
+// addresses check returns an error for
+func withTargetCheck(ctx context.Context, check TargetCheck) context.Context {
+    return context.WithValue(ctx, targetCheckKey{}, check)
+}
+
+// targetCheckFrom returns the check stored in ctx, nil when there is none
+func targetCheckFrom(ctx context.Context) TargetCheck {
+    check, _ := ctx.Value(targetCheckKey{}).(TargetCheck)
+    return check
+}
+
+// validateTargetPattern checks a CIDR or hostname glob
+func validateTargetPattern(target string) error {
+    if strings.Contains(target, "/") {
+        if _, _, err := net.ParseCIDR(target); err != nil {
+            return fmt.Errorf("target %q: %w", target, err)
+        }
+        return nil
+    }
+    if target == "" {
+        return errors.New("target must not be empty")
+    }
+    if _, err := path.Match(target, ""); err != nil {
+        return fmt.Errorf("target %q: %w", target, err)
+    }
+    return nil
+}
+
+// matchesTarget reports whether host matches one of the CIDRs or hostname
+// globs in targets, IP addresses only match CIDRs and hostnames only globs
+func matchesTarget(targets []string, host string) bool {
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    ip := net.ParseIP(host)
+    for _, target := range targets {
+        if _, network, err := net.ParseCIDR(target); err == nil {
+            if ip != nil && network.Contains(ip) {
+                return true
+            }
+            continue
+        }
+        if ip == nil && host != "" {
+            if ok, _ := path.Match(strings.ToLower(target), host); ok {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// matchesAny reports whether value matches one of the glob patterns
+func matchesAny(patterns []string, value string) bool {
+    for _, pattern := range patterns {
+        if ok, _ := path.Match(pattern, value); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// containsAny reports whether list and values share an element
+func containsAny(list, values []string) bool {
+    for _, item := range list {
+        for _, value := range values {
+            if item == value {
+                return true
+            }
+        }
+    }
+    return false
+}
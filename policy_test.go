@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// examplePolicy lets admins do anything, monitoring only run sysinfo and
+// everyone else ping the internal network
+func examplePolicy() PolicyConfig {
+	return PolicyConfig{
+		Default: PolicyDeny,
+		Rules: []PolicyRule{
+			{Name: "admins", Roles: []string{"admin"}, Effect: PolicyAllow},
+			{Name: "monitoring", Principals: []string{"monitor-*"}, Commands: []string{"sysinfo"}, Effect: PolicyAllow},
+			{Name: "monitoring ping", Principals: []string{"monitor-*"}, Effect: PolicyDeny},
+			{Name: "internal", Commands: []string{"ping"}, Targets: []string{"10.0.0.0/8", "*.corp.example.com"}, Effect: PolicyAllow},
+		},
+	}
+}
+
+func TestPolicy_Authorize(t *testing.T) {
+	policy := NewPolicy(examplePolicy())
+	admin := Principal{Label: "alice", Roles: []string{"admin"}}
+	monitor := Principal{Label: "monitor-eu"}
+	controller := Principal{Label: "cert:controller-1"}
+
+	tests := []struct {
+		name      string
+		principal Principal
+		req       CommandRequest
+		allowed   bool
+	}{
+		{name: "admin ping anywhere", principal: admin, req: CommandRequest{Type: "ping", Payload: "8.8.8.8"}, allowed: true},
+		{name: "monitor sysinfo", principal: monitor, req: CommandRequest{Type: "sysinfo"}, allowed: true},
+		{name: "monitor ping internal", principal: monitor, req: CommandRequest{Type: "ping", Payload: "10.1.2.3"}},
+		{name: "controller ping internal address", principal: controller, req: CommandRequest{Type: "ping", Payload: "10.1.2.3"}, allowed: true},
+		{name: "controller ping internal host", principal: controller, req: CommandRequest{Type: "ping", Payload: "DB1.Corp.Example.com."}, allowed: true},
+		{name: "controller ping outside", principal: controller, req: CommandRequest{Type: "ping", Payload: "8.8.8.8"}},
+		{name: "controller sysinfo", principal: controller, req: CommandRequest{Type: "sysinfo"}},
+		{name: "anonymous", principal: anonymous, req: CommandRequest{Type: "sysinfo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Authorize(tt.principal, tt.req)
+			if tt.allowed && err != nil {
+				t.Errorf("expected request to be allowed, got %v", err)
+			}
+			if !tt.allowed {
+				if cmdErr := asCommandError(err); err == nil || cmdErr.Code != ErrCodeForbidden {
+					t.Errorf("expected forbidden, got %v", err)
+				}
+			}
+		})
+	}
+
+	// a hostname outside the globs is decided by what it resolves to
+	lookalike := CommandRequest{Type: "ping", Payload: "corp.example.com.evil.net"}
+	if err := policy.CheckTarget(controller, lookalike, lookalike.Payload, net.ParseIP("203.0.113.5")); !errors.Is(err, ErrTargetRefused) {
+		t.Errorf("expected lookalike host to be refused, got %v", err)
+	}
+	if err := policy.CheckTarget(controller, lookalike, lookalike.Payload, net.ParseIP("10.1.2.3")); err != nil {
+		t.Errorf("expected lookalike host resolving internally to be allowed, got %v", err)
+	}
+}
+
+func TestPolicy_AddressRanges(t *testing.T) {
+	policy := NewPolicy(PolicyConfig{
+		Default: PolicyDeny,
+		Rules: []PolicyRule{
+			{Name: "printers", Targets: []string{"192.168.9.0/24"}, Effect: PolicyDeny},
+			{Name: "office", Targets: []string{"192.168.0.0/16", "lab-*"}, Effect: PolicyAllow},
+		},
+	})
+
+	tests := []struct {
+		payload string
+		allowed bool
+	}{
+		{payload: "192.168.1.0/24", allowed: true},
+		{payload: "192.168.1.10-192.168.1.50", allowed: true},
+		{payload: "lab-switch", allowed: true},
+		// deny rules match any overlap
+		{payload: "192.168.8.0/23"},
+		{payload: "192.168.8.250-192.168.9.1"},
+		// allow rules need every address
+		{payload: "192.168.255.0-192.169.0.5"},
+		{payload: "192.0.0.0/8"},
+		{payload: "10.0.0.0/24"},
+	}
+	for _, tt := range tests {
+		err := policy.Authorize(anonymous, CommandRequest{Type: "sweep", Payload: tt.payload})
+		if tt.allowed != (err == nil) {
+			t.Errorf("%s: expected allowed %v, got %v", tt.payload, tt.allowed, err)
+		}
+	}
+}
+
+func TestPolicy_CheckTarget(t *testing.T) {
+	policy := NewPolicy(PolicyConfig{
+		Default: PolicyDeny,
+		Rules: []PolicyRule{
+			{Name: "internal", Targets: []string{"10.0.0.0/8"}, Effect: PolicyDeny},
+			{Name: "office", Targets: []string{"192.168.0.0/16", "*.example.com"}, Effect: PolicyAllow},
+		},
+	})
+	req := CommandRequest{Type: "ping", Payload: "printer.example.com"}
+
+	// the hostname is only decided once it is resolved
+	if err := policy.Authorize(anonymous, req); err != nil {
+		t.Fatalf("expected the hostname to be left to CheckTarget, got %v", err)
+	}
+	if err := policy.CheckTarget(anonymous, req, "printer.example.com", net.ParseIP("10.0.0.5")); !errors.Is(err, ErrTargetRefused) {
+		t.Errorf("expected an address in a denied CIDR to be refused, got %v", err)
+	}
+	if err := policy.CheckTarget(anonymous, req, "printer.example.com", net.ParseIP("203.0.113.5")); err != nil {
+		t.Errorf("expected the glob to allow the host, got %v", err)
+	}
+	req.Payload = "gw.lan"
+	if err := policy.CheckTarget(anonymous, req, "gw.lan", net.ParseIP("192.168.1.1")); err != nil {
+		t.Errorf("expected an address in an allowed CIDR to be allowed, got %v", err)
+	}
+	if err := policy.CheckTarget(anonymous, req, "gw.lan", net.ParseIP("203.0.113.5")); !errors.Is(err, ErrTargetRefused) {
+		t.Errorf("expected the default to refuse the address, got %v", err)
+	}
+}
+
+func TestHandleCommand_PolicyDeniedAfterResolution(t *testing.T) {
+	defer func(orig func(context.Context, string, string) ([]net.IP, error)) { lookupIP = orig }(lookupIP)
+	lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.5")}, nil
+	}
+	cfg := authConfig()
+	cfg.Policy = PolicyConfig{Rules: []PolicyRule{
+		{Name: "internal", Targets: []string{"10.0.0.0/8"}, Effect: PolicyDeny},
+	}}
+	handler := handleRequests(newTestServer(t, NewCommander(), cfg))
+
+	req := httptest.NewRequest("POST", "/execute", strings.NewReader(`{"type":"ping","payload":"printer.example.com"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", rec.Code)
+	}
+	if res := decodeResponse(t, rec); res.Code != ErrCodeTargetRefused || !strings.Contains(res.Error, `policy rule "internal"`) {
+		t.Errorf("unexpected response: %+v", res)
+	}
+}
+
+func TestPolicy_DefaultAllows(t *testing.T) {
+	policy := NewPolicy(PolicyConfig{})
+	if err := policy.Authorize(anonymous, CommandRequest{Type: "ping", Payload: "8.8.8.8"}); err != nil {
+		t.Errorf("expected an empty policy to allow everything, got %v", err)
+	}
+}
+
+func TestPolicyConfig_Validate(t *testing.T) {
+	if err := examplePolicy().Validate(); err != nil {
+		t.Fatalf("expected example policy to be valid: %v", err)
+	}
+	invalid := []PolicyConfig{
+		{Default: "maybe"},
+		{Rules: []PolicyRule{{Effect: "permit"}}},
+		{Rules: []PolicyRule{{Effect: PolicyAllow, Targets: []string{"10.0.0.0/33"}}}},
+		{Rules: []PolicyRule{{Effect: PolicyAllow, Targets: []string{"[a-"}}}},
+		{Rules: []PolicyRule{{Effect: PolicyAllow, Principals: []string{"[a-"}}}},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
+
+func TestHandleCommand_PolicyDenied(t *testing.T) {
+	cfg := authConfig()
+	cfg.Policy = PolicyConfig{Rules: []PolicyRule{
+		{Principals: []string{"admin"}, Commands: []string{"ping"}, Targets: []string{"127.0.0.0/8"}, Effect: PolicyDeny},
+	}}
+	handler := handleRequests(newTestServer(t, &mockCommander{}, cfg))
+
+	req := httptest.NewRequest("POST", "/execute", strings.NewReader(`{"type":"ping","payload":"127.0.0.1"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %d", rec.Code)
+	}
+	if res := decodeResponse(t, rec); res.Code != ErrCodeForbidden || !strings.Contains(res.Error, "policy rule 1") {
+		t.Errorf("unexpected response: %+v", res)
+	}
+}
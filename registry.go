@@ -0,0 +1,138 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+// CommandTimeout is the deadline for commands that do not set their own, the
+// command is also stopped when the client goes away
+var CommandTimeout = 90 * time.Second
+
+// Permissions a caller needs to run a command, PermissionHistory lets a
+// caller read the history of every other caller
+const (
+    PermissionRead    = "read"
+    PermissionNetwork = "network"
+    PermissionHistory = "history"
+)
+
+// CommandHandler runs a command, on error the returned response data is
+// still sent to the client so partial results are not lost
+type CommandHandler func(ctx context.Context, req CommandRequest) (CommandResponse, error)
+
+// Command struct for a registered command
+type Command struct {
+    Name        string
+    Description string
+    // Schema is a JSON schema describing the request, the handler is
+    // responsible for validating what it receives
+    Schema     map[string]interface{}
+    Timeout    time.Duration
+    Permission string
+    Handler    CommandHandler
+}
+
+// CommandInfo struct for the public description of a command
+type CommandInfo struct {
+    Name        string                 `json:"name"`
+    Description string                 `json:"description"`
+    Schema      map[string]interface{} `json:"schema"`
+    Timeout     Duration               `json:"timeout"`
+    Permission  string                 `json:"permission"`
+}
+
+// Info returns the public description of the command
+func (c Command) Info() CommandInfo {
+    return CommandInfo{
+        Name:        c.Name,
+        Description: c.Description,
+        Schema:      c.Schema,
+        Timeout:     Duration(c.timeout()),
+        Permission:  c.Permission,
+    }
+}
+
+// timeout returns the command deadline, falling back to CommandTimeout
+func (c Command) timeout() time.Duration {
+    if c.Timeout > 0 {
+        return c.Timeout
+    }
+    return CommandTimeout
+}
+
+// Run executes the command with its deadline applied to ctx
+func (c Command) Run(ctx context.Context, req CommandRequest) (CommandResponse, error) {
+    ctx, cancel := context.WithTimeout(ctx, c.timeout())
+    defer cancel()
+    return c.Handler(ctx, req)
+}
+
+// Registry struct for the set of commands the daemon can execute
+type Registry struct {
+    mu       sync.RWMutex
+    commands map[string]Command
+}
+
+// NewRegistry create an empty registry
+func NewRegistry() *Registry {
+    return &Registry{commands: make(map[string]Command)}
+}
+
+// Register adds a command, names must be unique
+func (r *Registry) Register(cmd Command) error {
+    if cmd.Name == "" {
+        return errors.New("command name is required")
+    }
+    if cmd.Handler == nil {
+        return fmt.Errorf("command %s has no handler", cmd.Name)
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, ok := r.commands[cmd.Name]; ok {
+        return fmt.Errorf("command %s is already registered", cmd.Name)
+    }
+    r.commands[cmd.Name] = cmd
+    return nil
+}
+
+// Lookup returns the command registered under name
+func (r *Registry) Lookup(name string) (Command, bool) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    cmd, ok := r.commands[name]
+    return cmd, ok
+}
+
+// Commands returns every registered command sorted by name
+func (r *Registry) Commands() []Command {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    commands := make([]Command, 0, len(r.commands))
+    for _, cmd := range r.commands {
+        commands = append(commands, cmd)
+    }
+    sort.Slice(commands, func(i, j int) bool {
+        return commands[i].Name < commands[j].Name
+    })
+    return commands
+}
+
+// decodeOptions unmarshals the request options into v, missing options
+// leave v untouched
+func decodeOptions(req CommandRequest, v interface{}) error {
+    if len(req.Options) == 0 || string(req.Options) == "null" {
+        return nil
+    }
+    err := json.Unmarshal(req.Options, v)
+    if err != nil {
+        return NewCommandError(ErrCodeInvalidRequest, fmt.Errorf("invalid options: %w", err))
+    }
+    return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoCommand returns the payload it was given
+func echoCommand(name string) Command {
+	return Command{
+		Name:        name,
+		Description: "Echo the payload",
+		Schema:      map[string]interface{}{"type": "object"},
+		Permission:  PermissionRead,
+		Handler: func(ctx context.Context, req CommandRequest) (CommandResponse, error) {
+			return CommandResponse{Success: true, Data: req.Payload}, nil
+		},
+	}
+}
+
+func TestRegistry_Register(t *testing.T) {
+	registry := NewRegistry()
+
+	if err := registry.Register(echoCommand("echo")); err != nil {
+		t.Fatalf("Register() returned error: %v", err)
+	}
+	if err := registry.Register(echoCommand("echo")); err == nil {
+		t.Error("expected duplicate registration to fail")
+	}
+	if err := registry.Register(echoCommand("")); err == nil {
+		t.Error("expected registration without a name to fail")
+	}
+	if err := registry.Register(Command{Name: "nohandler"}); err == nil {
+		t.Error("expected registration without a handler to fail")
+	}
+
+	if _, ok := registry.Lookup("echo"); !ok {
+		t.Error("expected echo to be registered")
+	}
+	if _, ok := registry.Lookup("missing"); ok {
+		t.Error("expected missing command lookup to fail")
+	}
+}
+
+func TestRegistry_Commands(t *testing.T) {
+	registry := NewRegistry()
+	for _, name := range []string{"zeta", "alpha", "mid"} {
+		if err := registry.Register(echoCommand(name)); err != nil {
+			t.Fatalf("Register() returned error: %v", err)
+		}
+	}
+
+	commands := registry.Commands()
+	if len(commands) != 3 {
+		t.Fatalf("expected 3 commands, got %d", len(commands))
+	}
+	if commands[0].Name != "alpha" || commands[1].Name != "mid" || commands[2].Name != "zeta" {
+		t.Errorf("expected commands sorted by name, got %s, %s, %s", commands[0].Name, commands[1].Name, commands[2].Name)
+	}
+}
+
+func TestCommand_RunTimeout(t *testing.T) {
+	cmd := Command{
+		Name:    "slow",
+		Timeout: 50 * time.Millisecond,
+		Handler: func(ctx context.Context, req CommandRequest) (CommandResponse, error) {
+			<-ctx.Done()
+			return CommandResponse{}, ctx.Err()
+		},
+	}
+
+	start := time.Now()
+	_, err := cmd.Run(context.Background(), CommandRequest{Type: "slow"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected command to stop at its timeout, took %v", elapsed)
+	}
+	if info := cmd.Info(); info.Timeout != Duration(50*time.Millisecond) {
+		t.Errorf("expected info timeout 50ms, got %v", time.Duration(info.Timeout))
+	}
+	if info := (Command{}).Info(); info.Timeout != Duration(CommandTimeout) {
+		t.Errorf("expected default timeout %v, got %v", CommandTimeout, time.Duration(info.Timeout))
+	}
+}
+
+func TestDecodeOptions(t *testing.T) {
+	var opts PingOptions
+	if err := decodeOptions(CommandRequest{}, &opts); err != nil {
+		t.Errorf("expected missing options to be accepted, got %v", err)
+	}
+	if err := decodeOptions(CommandRequest{Options: json.RawMessage(`{"count":3}`)}, &opts); err != nil || opts.Count != 3 {
+		t.Errorf("expected count 3, got %d (%v)", opts.Count, err)
+	}
+	err := decodeOptions(CommandRequest{Options: json.RawMessage(`{"count":"three"}`)}, &opts)
+	if cmdErr := asCommandError(err); cmdErr.Code != ErrCodeInvalidRequest {
+		t.Errorf("expected code %s, got %v", ErrCodeInvalidRequest, err)
+	}
+}
+
+func TestHandleCommand_RegisteredCommand(t *testing.T) {
+	registry := NewRegistry()
+	if err := registry.Register(echoCommand("echo")); err != nil {
+		t.Fatalf("Register() returned error: %v", err)
+	}
+
+	server := newTestServer(t, &mockCommander{}, DefaultConfig())
+	server.registry = registry
+
+	body, _ := json.Marshal(CommandRequest{Type: "echo", Payload: "hello"})
+	rec := httptest.NewRecorder()
+	handleCommand(server)(rec, httptest.NewRequest("POST", "/execute", bytes.NewBuffer(body)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if res := decodeResponse(t, rec); !res.Success || res.Data != "hello" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+}
+
+func TestHandleListCommands(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &mockCommander{}, DefaultConfig()))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/commands", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	var res struct {
+		Success bool          `json:"success"`
+		Data    []CommandInfo `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if !res.Success || len(res.Data) != 4 {
+		t.Fatalf("expected 4 commands, got %+v", res)
+	}
+	if res.Data[0].Name != "ping" || res.Data[0].Permission != PermissionNetwork || res.Data[0].Schema == nil {
+		t.Errorf("unexpected ping description: %+v", res.Data[0])
+	}
+	if res.Data[1].Name != "sweep" || res.Data[1].Permission != PermissionNetwork || res.Data[1].Schema == nil {
+		t.Errorf("unexpected sweep description: %+v", res.Data[1])
+	}
+	if res.Data[2].Name != "sysinfo" || res.Data[2].Permission != PermissionRead {
+		t.Errorf("unexpected sysinfo description: %+v", res.Data[2])
+	}
+	if res.Data[3].Name != "traceroute" || res.Data[3].Permission != PermissionNetwork || res.Data[3].Schema == nil {
+		t.Errorf("unexpected traceroute description: %+v", res.Data[3])
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/commands", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", rec.Code)
+	}
+}
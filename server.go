@@ -0,0 +1,238 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "time"
+)
+
+// Server struct for the state shared by the HTTP handlers
+type Server struct {
+    cfg      Config
+    registry *Registry
+    keys     *KeyStore
+    certs    *CertStore
+    policy   *Policy
+    limiter  *Limiter
+    metrics  *Metrics
+    monitors *Monitors
+    alerter  *Alerter
+    history  *History
+    jobs     *Jobs
+}
+
+// NewServer create the server for cfg, background work such as watching the
+// key file starts here and stops on Close
+func NewServer(cmdr Commander, cfg Config) (*Server, error) {
+    limiter := NewLimiter(cfg.Limits)
+    metrics := NewMetrics(limiter, cfg.Monitors)
+    cmdr = metrics.Commander(cmdr)
+    s := &Server{
+        cfg:      cfg,
+        registry: NewDefaultRegistry(cmdr, cfg),
+        policy:   NewPolicy(cfg.Policy),
+        limiter:  limiter,
+        metrics:  metrics,
+        monitors: NewMonitors(cmdr, cfg.Monitors),
+    }
+    metrics.registry.MustRegister(monitorCollector{s.monitors})
+    if cfg.Auth.Enabled {
+        keys, err := NewKeyStore(cfg.Auth)
+        if err != nil {
+            return nil, err
+        }
+        keys.Watch(KeyReloadInterval)
+        s.keys = keys
+    }
+    if cfg.TLS.Enabled() {
+        certs, err := NewCertStore(cfg.TLS)
+        if err != nil {
+            s.Close()
+            return nil, err
+        }
+        certs.Watch(CertReloadInterval)
+        s.certs = certs
+    }
+    if cfg.History.Path != "" {
+        history, err := OpenHistory(cfg.History)
+        if err != nil {
+            s.Close()
+            return nil, err
+        }
+        s.history = history
+    }
+    s.jobs = NewJobs(s, cfg.Jobs)
+    s.alerter = NewAlerter(cfg.Alerts)
+    s.monitors.onProbe = s.alerter.Evaluate
+    s.monitors.Start()
+    return s, nil
+}
+
+// TLSConfig returns the listener's TLS config, nil when serving plain HTTP
+func (s *Server) TLSConfig() *tls.Config {
+    if s.certs == nil {
+        return nil
+    }
+    return s.certs.TLSConfig()
+}
+
+// Reload re-reads anything that can change without a restart
+func (s *Server) Reload() error {
+    if s.keys != nil {
+        if err := s.keys.Reload(); err != nil {
+            return err
+        }
+    }
+    if s.certs != nil {
+        return s.certs.Reload()
+    }
+    return nil
+}
+
+// Close stops the server's background work
+func (s *Server) Close() error {
+    if s.jobs != nil {
+        s.jobs.Close()
+    }
+    s.monitors.Close()
+    if s.alerter != nil {
+        s.alerter.Close()
+    }
+    if s.keys != nil {
+        s.keys.Close()
+    }
+    if s.certs != nil {
+        s.certs.Close()
+    }
+    if s.history != nil {
+        return s.history.Close()
+    }
+    return nil
+}
+
+// Execute runs req for the caller in ctx once it is authorized, every way
+// of running a command goes through here
+func (s *Server) Execute(ctx context.Context, req CommandRequest) (res CommandResponse, err error) {
+    cmd, ok := s.registry.Lookup(req.Type)
+    if !ok {
+        return CommandResponse{}, NewCommandError(ErrCodeUnknownCommand, fmt.Errorf("invalid request type: %q", req.Type))
+    }
+    start := time.Now()
+    defer func() {
+        s.metrics.observeCommand(cmd.Name, err, time.Since(start))
+    }()
+
+    principal := principalFrom(ctx)
+    err = s.authorize(principal, cmd, req)
+    if err != nil {
+        return CommandResponse{}, err
+    }
+
+    var done func()
+    if admitted(ctx) {
+        // the rate limits were applied when the command was queued
+        done, err = s.limiter.Wait(ctx, cmd.Name)
+    } else {
+        done, err = s.limiter.Acquire(cmd.Name, principal, clientIPFrom(ctx))
+    }
+    if err != nil {
+        log.Printf("Rejected %s for %s: %v\n", cmd.Name, principal.Label, err)
+        return CommandResponse{}, err
+    }
+    defer done()
+    log.Printf("Executing %s for %s\n", cmd.Name, principal.Label)
+
+    // the policy sees what a hostname resolved to before traffic is sent
+    ctx = withTargetCheck(ctx, func(host string, ip net.IP) error {
+        err := s.policy.CheckTarget(principal, req, host, ip)
+        if err != nil {
+            log.Printf("Denied %s %q for %s: %v\n", cmd.Name, req.Payload, principal.Label, err)
+        }
+        return err
+    })
+    started := time.Now()
+    res, err = cmd.Run(ctx, req)
+    s.record(ctx, req, principal, started, res, err)
+    return res, err
+}
+
+// Admit checks the caller in ctx may run req and takes its rate limit
+// tokens without running it, so commands that run later are refused
+// straight away. Execute with the returned context waits for a
+// concurrency slot instead of charging the caller again
+func (s *Server) Admit(ctx context.Context, req CommandRequest) (context.Context, error) {
+    cmd, ok := s.registry.Lookup(req.Type)
+    if !ok {
+        return ctx, NewCommandError(ErrCodeUnknownCommand, fmt.Errorf("invalid request type: %q", req.Type))
+    }
+    principal := principalFrom(ctx)
+    err := s.authorize(principal, cmd, req)
+    if err != nil {
+        return ctx, err
+    }
+    err = s.limiter.Admit(cmd.Name, principal, clientIPFrom(ctx))
+    if err != nil {
+        log.Printf("Rejected %s for %s: %v\n", cmd.Name, principal.Label, err)
+        return ctx, err
+    }
+    return context.WithValue(ctx, admittedKey{}, true), nil
+}
+
+type admittedKey struct{}
+
+// admitted reports whether ctx came from Admit
+func admitted(ctx context.Context) bool {
+    ok, _ := ctx.Value(admittedKey{}).(bool)
+    return ok
+}
+
+// authorize checks principal holds the command's permission and the policy
+// allows the request
+func (s *Server) authorize(principal Principal, cmd Command, req CommandRequest) error {
+    if !principal.Can(cmd.Permission) {
+        log.Printf("Denied %s for %s: missing %s permission\n", cmd.Name, principal.Label, cmd.Permission)
+        return NewCommandError(ErrCodeForbidden, fmt.Errorf("%s permission required", cmd.Permission))
+    }
+    err := s.policy.Authorize(principal, req)
+    if err != nil {
+        log.Printf("Denied %s %q for %s: %v\n", cmd.Name, req.Payload, principal.Label, err)
+        return err
+    }
+    return nil
+}
+
+// record adds a command that ran to the history, failing to store it
+// does not fail the command
+func (s *Server) record(ctx context.Context, req CommandRequest, principal Principal, started time.Time, res CommandResponse, err error) {
+    if s.history == nil {
+        return
+    }
+    finished := time.Now()
+    entry := HistoryEntry{
+        Type:       req.Type,
+        Payload:    req.Payload,
+        Options:    req.Options,
+        Caller:     principal.Label,
+        ClientIP:   clientIPFrom(ctx),
+        StartedAt:  started,
+        FinishedAt: finished,
+        Duration:   finished.Sub(started),
+        Success:    err == nil && res.Success,
+    }
+    if err != nil {
+        cmdErr := asCommandError(err)
+        entry.Code = cmdErr.Code
+        entry.Error = cmdErr.Message
+    }
+    entry.Result, err = json.Marshal(res.Data)
+    if err == nil {
+        err = s.history.Record(entry)
+    }
+    if err != nil {
+        log.Printf("Failed to record %s in history: %v\n", req.Type, err)
+    }
+}
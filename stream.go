@@ -0,0 +1,292 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "mime"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Ping event types
+const (
+    PingEventReply     = "reply"
+    PingEventDuplicate = "duplicate"
+    PingEventTimeout   = "timeout"
+)
+
+// PingEvent struct for something that happened to one echo request while a
+// ping runs, rtt, ttl and bytes are only set for replies
+type PingEvent struct {
+    Type      string        `json:"type"`
+    Host      string        `json:"host"`
+    IPAddress string        `json:"ip_address"`
+    Seq       int           `json:"seq"`
+    Rtt       time.Duration `json:"rtt,omitempty"`
+    TTL       int           `json:"ttl,omitempty"`
+    Bytes     int           `json:"bytes,omitempty"`
+}
+
+// PingObserver is called with each PingEvent as it happens, possibly from
+// several goroutines at once
+type PingObserver func(PingEvent)
+
+type pingObserverKey struct{}
+
+// WithPingObserver returns a context that makes Ping report its events to
+// observe
+func WithPingObserver(ctx context.Context, observe PingObserver) context.Context {
+    return context.WithValue(ctx, pingObserverKey{}, observe)
+}
+
+// pingObserverFrom returns the observer stored in ctx, nil when there is none
+func pingObserverFrom(ctx context.Context) PingObserver {
+    observe, _ := ctx.Value(pingObserverKey{}).(PingObserver)
+    return observe
+}
+
+// pingEventBuffer is how many events can wait for a slow client before
+// further replies and timeouts are dropped
+const pingEventBuffer = 64
+
+// pingEvents tracks the echo requests of one address so a request that got
+// no reply can be reported as a timeout, a nil *pingEvents does nothing.
+// Events are handed to the observer by a goroutine of its own so a slow
+// client never holds up the pinger
+type pingEvents struct {
+    observe PingObserver
+    host    string
+    ip      string
+    timeout time.Duration
+    queue   chan PingEvent
+    drained chan struct{} // closed once every queued event was observed
+
+    mu      sync.Mutex
+    pending map[int]*time.Timer
+    done    bool
+}
+
+// newPingEvents returns the tracker for pinging ip, nil when nothing in ctx
+// is observing the ping
+func newPingEvents(ctx context.Context, host, ip string, opts PingOptions) *pingEvents {
+    observe := pingObserverFrom(ctx)
+    if observe == nil {
+        return nil
+    }
+    // without a packet timeout a request is given up on when the next one
+    // is due, as ping(8) does, so timeouts still show up while it runs
+    timeout := time.Duration(opts.PacketTimeout)
+    if timeout == 0 {
+        timeout = time.Duration(opts.Interval)
+    }
+    if timeout == 0 {
+        timeout = time.Duration(opts.Timeout)
+    }
+    e := &pingEvents{
+        observe: observe,
+        host:    host,
+        ip:      ip,
+        timeout: timeout,
+        queue:   make(chan PingEvent, pingEventBuffer),
+        drained: make(chan struct{}),
+        pending: make(map[int]*time.Timer),
+    }
+    go func() {
+        defer close(e.drained)
+        for event := range e.queue {
+            e.observe(event)
+        }
+    }()
+    return e
+}
+
+// emit queues event for the observer, dropping it when the client is too
+// far behind, e.mu must be held
+func (e *pingEvents) emit(event PingEvent) {
+    select {
+    case e.queue <- event:
+    default:
+        debugf("Dropped %s event for %s seq %d, the client is too slow\n", event.Type, e.ip, event.Seq)
+    }
+}
+
+// sent starts waiting for the reply to seq
+func (e *pingEvents) sent(seq int) {
+    if e == nil {
+        return
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    var timer *time.Timer
+    if e.timeout > 0 {
+        timer = time.AfterFunc(e.timeout, func() { e.expire(seq) })
+    }
+    e.pending[seq] = timer
+}
+
+// received reports a reply to seq
+func (e *pingEvents) received(pkt PingPacket) {
+    if e == nil {
+        return
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.done {
+        return
+    }
+    event := PingEvent{Type: PingEventReply, Host: e.host, IPAddress: e.ip, Seq: pkt.Seq, Rtt: pkt.Rtt, TTL: pkt.TTL, Bytes: pkt.Bytes}
+    if pkt.Duplicate {
+        event.Type = PingEventDuplicate
+    } else if timer, ok := e.pending[pkt.Seq]; ok {
+        if timer != nil {
+            timer.Stop()
+        }
+        delete(e.pending, pkt.Seq)
+    }
+    e.emit(event)
+}
+
+// expire reports seq as timed out if its reply has not arrived
+func (e *pingEvents) expire(seq int) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if _, ok := e.pending[seq]; !ok || e.done {
+        return
+    }
+    delete(e.pending, seq)
+    e.emit(PingEvent{Type: PingEventTimeout, Host: e.host, IPAddress: e.ip, Seq: seq})
+}
+
+// finish stops tracking once the ping ends, requests still waiting for a
+// reply time out unless the ping was cancelled. It returns once the
+// observer has seen every event, so the result always comes last
+func (e *pingEvents) finish(cancelled bool) {
+    if e == nil {
+        return
+    }
+    e.mu.Lock()
+    seqs := make([]int, 0, len(e.pending))
+    for seq, timer := range e.pending {
+        if timer != nil {
+            timer.Stop()
+        }
+        seqs = append(seqs, seq)
+    }
+    sort.Ints(seqs)
+    if !cancelled {
+        // the pinger is done, so these can wait for the client
+        for _, seq := range seqs {
+            e.queue <- PingEvent{Type: PingEventTimeout, Host: e.host, IPAddress: e.ip, Seq: seq}
+        }
+    }
+    e.pending = nil
+    e.done = true
+    close(e.queue)
+    e.mu.Unlock()
+    <-e.drained
+}
+
+// eventStream writes Server-Sent Events, the headers are only sent with
+// the first event so errors before then can still get a status code
+type eventStream struct {
+    mu      sync.Mutex
+    w       http.ResponseWriter
+    started bool
+    closed  bool
+}
+
+// send writes one event with data encoded as JSON
+func (s *eventStream) send(event string, data interface{}) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.closed {
+        return
+    }
+    body, err := json.Marshal(data)
+    if err != nil {
+        log.Printf("Failed to encode %s event: %v\n", event, err)
+        return
+    }
+    if !s.started {
+        s.w.Header().Set("Content-Type", "text/event-stream")
+        s.w.Header().Set("Cache-Control", "no-cache")
+        s.w.WriteHeader(http.StatusOK)
+        s.started = true
+    }
+    _, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, body)
+    if err != nil {
+        // the client went away, the request context stops the command
+        s.closed = true
+        return
+    }
+    if flusher, ok := s.w.(http.Flusher); ok {
+        flusher.Flush()
+    }
+}
+
+// begun reports whether an event has been sent
+func (s *eventStream) begun() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.started
+}
+
+// close stops any further events, the handler must not write after it
+// returns
+func (s *eventStream) close() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.closed = true
+}
+
+// wantsEventStream reports whether the client asked for Server-Sent Events
+func wantsEventStream(r *http.Request) bool {
+    for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+        mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+        if err == nil && mediaType == "text/event-stream" {
+            return true
+        }
+    }
+    return false
+}
+
+// streamCommand runs req sending every ping event as it happens, then the
+// CommandResponse as a result or error event, errors before the first event
+// are sent as a plain JSON response
+func streamCommand(s *Server, w http.ResponseWriter, r *http.Request, req CommandRequest) {
+    stream := &eventStream{w: w}
+    ctx := WithPingObserver(r.Context(), func(e PingEvent) {
+        stream.send(e.Type, e)
+    })
+    res, err := s.Execute(ctx, req)
+    if err == nil {
+        stream.send("result", res)
+        stream.close()
+        return
+    }
+    if !stream.begun() {
+        // nothing was streamed, send the error with its status instead
+        stream.close()
+        writeError(w, err, res.Data)
+        return
+    }
+    stream.send("error", errorResponse(err, res.Data))
+    stream.close()
+}
+
+// handleStreamCommand serves /execute/stream, which always streams
+func handleStreamCommand(s *Server) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        req, err := decodeCommandRequest(r)
+        if err != nil {
+            writeError(w, err, nil)
+            return
+        }
+        streamCommand(s, w, r, req)
+    }
+}
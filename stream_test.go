@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// streamingCommander reports events before returning its result, or waits
+// for ctx when block is set
+type streamingCommander struct {
+	mockCommander
+	events    []PingEvent
+	err       error
+	block     bool
+	cancelled chan struct{}
+}
+
+func (c *streamingCommander) Ping(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+	observe := pingObserverFrom(ctx)
+	for _, e := range c.events {
+		if observe != nil {
+			observe(e)
+		}
+	}
+	if c.block {
+		<-ctx.Done()
+		close(c.cancelled)
+		return PingResult{Host: host, Status: pingStatus(ctx.Err())}, ctx.Err()
+	}
+	return PingResult{Successful: c.err == nil, Host: host, PacketsSent: 2, PacketsRecv: 1}, c.err
+}
+
+// sseEvent is one parsed Server-Sent Event
+type sseEvent struct {
+	name string
+	data string
+}
+
+// readEvents parses every event in body
+func readEvents(t *testing.T, body *bufio.Scanner) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var event sseEvent
+	for body.Scan() {
+		line := body.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, event)
+			event = sseEvent{}
+		}
+	}
+	return events
+}
+
+var testPingEvents = []PingEvent{
+	{Type: PingEventReply, Host: "example.com", IPAddress: "192.0.2.1", Seq: 0, Rtt: time.Millisecond, TTL: 64, Bytes: 32},
+	{Type: PingEventDuplicate, Host: "example.com", IPAddress: "192.0.2.1", Seq: 0, Rtt: 2 * time.Millisecond, TTL: 64, Bytes: 32},
+	{Type: PingEventTimeout, Host: "example.com", IPAddress: "192.0.2.1", Seq: 1},
+}
+
+func TestStream_Ping(t *testing.T) {
+	handler := handleRequests(newTestServer(t, &streamingCommander{events: testPingEvents}, DefaultConfig()))
+
+	for _, tt := range []struct {
+		name   string
+		path   string
+		accept string
+	}{
+		{"accept header", "/execute", "application/json, text/event-stream"},
+		{"stream path", "/execute/stream", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(`{"type":"ping","payload":"example.com"}`))
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("expected an event stream, got %q", ct)
+			}
+			events := readEvents(t, bufio.NewScanner(rec.Body))
+			if len(events) != 4 {
+				t.Fatalf("expected 4 events, got %+v", events)
+			}
+			for i, want := range testPingEvents {
+				var got PingEvent
+				if err := json.Unmarshal([]byte(events[i].data), &got); err != nil {
+					t.Fatalf("failed to decode event %d: %v", i, err)
+				}
+				if events[i].name != want.Type || got != want {
+					t.Errorf("event %d: expected %+v, got %s %+v", i, want, events[i].name, got)
+				}
+			}
+			var res struct {
+				Success bool       `json:"success"`
+				Data    PingResult `json:"data"`
+			}
+			if err := json.Unmarshal([]byte(events[3].data), &res); err != nil {
+				t.Fatalf("failed to decode result: %v", err)
+			}
+			if events[3].name != "result" || !res.Success || res.Data.PacketsSent != 2 {
+				t.Errorf("expected the statistics last, got %s %s", events[3].name, events[3].data)
+			}
+		})
+	}
+}
+
+func TestStream_Errors(t *testing.T) {
+	// errors before any event keep their status
+	handler := handleRequests(newTestServer(t, &streamingCommander{}, DefaultConfig()))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/execute/stream", strings.NewReader(`{"type":"ping","payload":""}`)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("expected a 400 JSON response, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	// errors once events were sent end the stream
+	cmdr := &streamingCommander{events: testPingEvents[:1], err: context.DeadlineExceeded}
+	handler = handleRequests(newTestServer(t, cmdr, DefaultConfig()))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/execute/stream", strings.NewReader(`{"type":"ping","payload":"example.com"}`)))
+	events := readEvents(t, bufio.NewScanner(rec.Body))
+	if len(events) != 2 || events[1].name != "error" || !strings.Contains(events[1].data, `"code":"timeout"`) {
+		t.Errorf("expected a reply then a timeout error, got %+v", events)
+	}
+}
+
+func TestStream_ClientDisconnect(t *testing.T) {
+	cmdr := &streamingCommander{events: testPingEvents[:1], block: true, cancelled: make(chan struct{})}
+	ts := httptest.NewServer(handleRequests(newTestServer(t, cmdr, DefaultConfig())))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", ts.URL+"/execute/stream", strings.NewReader(`{"type":"ping","payload":"example.com"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	// the first event arrives before the ping finishes
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "event: reply\n" {
+		t.Fatalf("expected a reply event, got %q %v", line, err)
+	}
+
+	cancel()
+	select {
+	case <-cmdr.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the ping to stop when the client disconnects")
+	}
+}
+
+func TestPingEvents(t *testing.T) {
+	var mu sync.Mutex
+	var got []PingEvent
+	observe := func(e PingEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, e)
+	}
+	ctx := WithPingObserver(context.Background(), observe)
+	events := newPingEvents(ctx, "example.com", "192.0.2.1", PingOptions{PacketTimeout: Duration(20 * time.Millisecond)})
+
+	events.sent(0)
+	events.sent(1)
+	events.received(PingPacket{Seq: 0, Rtt: time.Millisecond})
+	events.received(PingPacket{Seq: 0, Rtt: time.Millisecond, Duplicate: true})
+	time.Sleep(100 * time.Millisecond)
+	events.sent(2)
+	events.finish(false)
+	events.received(PingPacket{Seq: 2})
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []string
+	for _, e := range got {
+		types = append(types, e.Type+":"+string(rune('0'+e.Seq)))
+	}
+	want := "reply:0 duplicate:0 timeout:1 timeout:2"
+	if strings.Join(types, " ") != want {
+		t.Errorf("expected %s, got %s", want, strings.Join(types, " "))
+	}
+
+	// without a packet timeout requests time out when the next one is due
+	events = newPingEvents(ctx, "example.com", "192.0.2.1", PingOptions{}.withDefaults())
+	if events.timeout != time.Duration(DefaultPingOptions.Interval) {
+		t.Errorf("expected the default interval as timeout, got %v", events.timeout)
+	}
+	events.finish(true)
+	got = nil
+	mu.Unlock()
+	events = newPingEvents(ctx, "example.com", "192.0.2.1", PingOptions{Interval: Duration(20 * time.Millisecond)}.withDefaults())
+	events.sent(0)
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	if len(got) != 1 || got[0].Type != PingEventTimeout {
+		t.Errorf("expected a live timeout with default options, got %+v", got)
+	}
+	mu.Unlock()
+	events.finish(false)
+	mu.Lock()
+
+	// nothing is tracked without an observer
+	if newPingEvents(context.Background(), "example.com", "192.0.2.1", PingOptions{}) != nil {
+		t.Error("expected no tracker without an observer")
+	}
+}
+
+func TestPingEvents_SlowObserver(t *testing.T) {
+	release := make(chan struct{})
+	var observed atomic.Int64
+	ctx := WithPingObserver(context.Background(), func(e PingEvent) {
+		<-release
+		observed.Add(1)
+	})
+	events := newPingEvents(ctx, "example.com", "192.0.2.1", PingOptions{Timeout: Duration(time.Minute)})
+
+	// the pinger goes on while the client is stuck, events over the
+	// buffer are dropped
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for seq := 0; seq < 2*pingEventBuffer; seq++ {
+			events.sent(seq)
+			events.received(PingPacket{Seq: seq})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a slow observer not to block the pinger")
+	}
+	close(release)
+	events.finish(false)
+	if n := observed.Load(); n < pingEventBuffer || n >= 2*pingEventBuffer {
+		t.Errorf("expected the buffered events to be observed and the rest dropped, got %d", n)
+	}
+}
+
+func TestWantsEventStream(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                    false,
+		"application/json":                    false,
+		"text/event-stream":                   true,
+		"application/json, text/event-stream": true,
+		"text/event-stream; charset=utf-8":    true,
+	} {
+		req := httptest.NewRequest("POST", "/execute", nil)
+		req.Header.Set("Accept", accept)
+		if got := wantsEventStream(req); got != want {
+			t.Errorf("wantsEventStream(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
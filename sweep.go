@@ -0,0 +1,292 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "net/netip"
+    "strings"
+    "sync"
+    "time"
+)
+
+// sweepTimeout is the deadline for a whole sweep, hosts not pinged by then
+// are left out of the result
+const sweepTimeout = 5 * time.Minute
+
+// SweepLimits struct for the server-side bounds on sweeps
+type SweepLimits struct {
+    MaxHosts       int      `json:"max_hosts"`
+    MaxConcurrency int      `json:"max_concurrency"`
+    MaxTimeout     Duration `json:"max_timeout"`
+}
+
+// DefaultSweepLimits are the bounds applied when none are configured
+var DefaultSweepLimits = SweepLimits{
+    MaxHosts:       1024,
+    MaxConcurrency: 64,
+    MaxTimeout:     Duration(5 * time.Second),
+}
+
+// Validate checks the limits allow a sweep with the default options
+func (l SweepLimits) Validate() error {
+    if l.MaxHosts < 1 {
+        return errors.New("max_hosts must be at least 1")
+    }
+    if l.MaxConcurrency < 1 {
+        return errors.New("max_concurrency must be at least 1")
+    }
+    if l.MaxTimeout < DefaultSweepOptions.Timeout {
+        return fmt.Errorf("max_timeout must be at least %v", time.Duration(DefaultSweepOptions.Timeout))
+    }
+    return nil
+}
+
+// SweepOptions struct for per-request sweep settings, zero values use the
+// defaults
+type SweepOptions struct {
+    Concurrency int      `json:"concurrency,omitempty"`
+    Timeout     Duration `json:"timeout,omitempty"` // per host
+    Count       int      `json:"count,omitempty"`   // echo requests per host
+    Privileged  bool     `json:"privileged,omitempty"`
+}
+
+// DefaultSweepOptions are the settings used when a request does not
+// override them
+var DefaultSweepOptions = SweepOptions{
+    Concurrency: 32,
+    Timeout:     Duration(time.Second),
+    Count:       1,
+}
+
+// withDefaults fills any unset option from DefaultSweepOptions
+func (o SweepOptions) withDefaults() SweepOptions {
+    if o.Concurrency == 0 {
+        o.Concurrency = DefaultSweepOptions.Concurrency
+    }
+    if o.Timeout == 0 {
+        o.Timeout = DefaultSweepOptions.Timeout
+    }
+    if o.Count == 0 {
+        o.Count = DefaultSweepOptions.Count
+    }
+    return o
+}
+
+// Validate checks the options against the sweep and ping limits
+func (o SweepOptions) Validate(l SweepLimits, pl PingLimits) error {
+    o = o.withDefaults()
+    if o.Concurrency < 0 || o.Concurrency > l.MaxConcurrency {
+        return fmt.Errorf("concurrency must be between 1 and %d", l.MaxConcurrency)
+    }
+    if o.Timeout < 0 || o.Timeout > l.MaxTimeout {
+        return fmt.Errorf("timeout must be between 0s and %v", time.Duration(l.MaxTimeout))
+    }
+    if o.Count < 0 || o.Count > pl.MaxCount {
+        return fmt.Errorf("count must be between 1 and %d", pl.MaxCount)
+    }
+    if o.Privileged && !pl.AllowPrivileged {
+        return errors.New("privileged mode is not allowed")
+    }
+    // every echo request has to be sent before each host's timeout
+    return o.pingOptions(pl).Validate(pl)
+}
+
+// pingOptions returns the options each host is pinged with
+func (o SweepOptions) pingOptions(pl PingLimits) PingOptions {
+    return PingOptions{
+        Count:      o.Count,
+        Interval:   pl.MinInterval,
+        Timeout:    o.Timeout,
+        Privileged: o.Privileged,
+    }
+}
+
+// SweepResult struct for a sweep, the lists are in address order
+type SweepResult struct {
+    Range   string      `json:"range"`
+    Status  string      `json:"status"`
+    Hosts   int         `json:"hosts"`
+    Alive   []SweepHost `json:"alive"`
+    Dead    []string    `json:"dead"`
+    Refused []string    `json:"refused,omitempty"`
+}
+
+// SweepHost struct for an address that replied
+type SweepHost struct {
+    Address string        `json:"address"`
+    Rtt     time.Duration `json:"rtt"` // average round-trip time
+}
+
+// addressRange is a CIDR or an inclusive range of addresses
+type addressRange struct {
+    first, last netip.Addr
+    prefix      netip.Prefix // set for CIDRs
+}
+
+// parseAddressRange parses a CIDR such as 192.168.1.0/24, a range such as
+// 192.168.1.10-192.168.1.50 or a single address
+func parseAddressRange(s string) (addressRange, error) {
+    s = strings.TrimSpace(s)
+    if strings.Contains(s, "/") {
+        prefix, err := netip.ParsePrefix(s)
+        if err != nil {
+            return addressRange{}, fmt.Errorf("invalid CIDR %q", s)
+        }
+        prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+        return addressRange{first: prefix.Addr(), last: lastAddress(prefix), prefix: prefix}, nil
+    }
+    from, to, isRange := strings.Cut(s, "-")
+    first, err := netip.ParseAddr(strings.TrimSpace(from))
+    if err != nil {
+        return addressRange{}, fmt.Errorf("invalid address %q", from)
+    }
+    last := first
+    if isRange {
+        last, err = netip.ParseAddr(strings.TrimSpace(to))
+        if err != nil {
+            return addressRange{}, fmt.Errorf("invalid address %q", to)
+        }
+    }
+    first, last = first.Unmap(), last.Unmap()
+    if first.Is4() != last.Is4() {
+        return addressRange{}, errors.New("range must not mix IPv4 and IPv6 addresses")
+    }
+    if last.Less(first) {
+        return addressRange{}, fmt.Errorf("range ends at %s before it starts at %s", last, first)
+    }
+    return addressRange{first: first.WithZone(""), last: last.WithZone("")}, nil
+}
+
+// addresses lists the hosts in the range, the network and broadcast
+// addresses of IPv4 CIDRs are left out, more than max is an error
+func (r addressRange) addresses(max int) ([]netip.Addr, error) {
+    first, last := r.first, r.last
+    if r.prefix.IsValid() && first.Is4() && r.prefix.Bits() <= 30 {
+        first, last = first.Next(), last.Prev()
+    }
+    var addrs []netip.Addr
+    for addr := first; addr.IsValid() && !last.Less(addr); addr = addr.Next() {
+        if len(addrs) == max {
+            return nil, fmt.Errorf("range has more than %d addresses", max)
+        }
+        addrs = append(addrs, addr)
+    }
+    return addrs, nil
+}
+
+// overlaps reports whether any address of the range is in prefix
+func (r addressRange) overlaps(prefix netip.Prefix) bool {
+    prefix = prefix.Masked()
+    if prefix.Addr().Is4() != r.first.Is4() {
+        return false
+    }
+    return !lastAddress(prefix).Less(r.first) && !r.last.Less(prefix.Addr())
+}
+
+// within reports whether every address of the range is in prefix
+func (r addressRange) within(prefix netip.Prefix) bool {
+    return prefix.Contains(r.first) && prefix.Contains(r.last)
+}
+
+// String returns the range as a CIDR or first-last
+func (r addressRange) String() string {
+    if r.prefix.IsValid() {
+        return r.prefix.String()
+    }
+    if r.first == r.last {
+        return r.first.String()
+    }
+    return r.first.String() + "-" + r.last.String()
+}
+
+// lastAddress returns the highest address in prefix
+func lastAddress(prefix netip.Prefix) netip.Addr {
+    addr := prefix.Masked().Addr()
+    b := addr.As16()
+    offset := 0
+    if addr.Is4() {
+        offset = 12
+    }
+    for bit := prefix.Bits() + offset*8; bit < 128; bit++ {
+        b[bit/8] |= 1 << (7 - bit%8)
+    }
+    last := netip.AddrFrom16(b)
+    if addr.Is4() {
+        return last.Unmap()
+    }
+    return last
+}
+
+// sweep pings every address in r with at most opts.Concurrency pings at a
+// time, refused addresses are listed apart and any other ping error
+// stops the sweep
+func sweep(ctx context.Context, cmdr Commander, r addressRange, addrs []netip.Addr, opts SweepOptions, pl PingLimits) (SweepResult, error) {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+
+    results := make([]PingResult, len(addrs))
+    errs := make([]error, len(addrs))
+    done := make([]bool, len(addrs))
+    next := make(chan int)
+    var failure error
+    var once sync.Once
+    var wg sync.WaitGroup
+    for w := 0; w < opts.Concurrency && w < len(addrs); w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range next {
+                result, err := cmdr.Ping(ctx, addrs[i].String(), opts.pingOptions(pl))
+                if ctx.Err() != nil {
+                    continue
+                }
+                if err != nil && !errors.Is(err, ErrTargetRefused) {
+                    once.Do(func() { failure = err })
+                    cancel()
+                    continue
+                }
+                results[i], errs[i], done[i] = result, err, true
+            }
+        }()
+    }
+feed:
+    for i := range addrs {
+        select {
+        case next <- i:
+        case <-ctx.Done():
+            break feed
+        }
+    }
+    close(next)
+    wg.Wait()
+
+    result := SweepResult{
+        Range:  r.String(),
+        Status: PingStatusCompleted,
+        Hosts:  len(addrs),
+        Alive:  []SweepHost{},
+        Dead:   []string{},
+    }
+    for i, addr := range addrs {
+        switch {
+        case !done[i]:
+        case errs[i] != nil:
+            result.Refused = append(result.Refused, addr.String())
+        case results[i].Successful:
+            result.Alive = append(result.Alive, SweepHost{Address: addr.String(), Rtt: results[i].AvgRtt})
+        default:
+            result.Dead = append(result.Dead, addr.String())
+        }
+    }
+    if failure != nil {
+        log.Printf("Sweep of %s stopped: %v\n", r, failure)
+        return SweepResult{}, failure
+    }
+    if err := ctx.Err(); err != nil {
+        result.Status = pingStatus(err)
+        return result, err
+    }
+    return result, nil
+}
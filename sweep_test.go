@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAddressRange(t *testing.T) {
+	tests := []struct {
+		payload string
+		first   string
+		last    string
+		count   int
+	}{
+		{payload: "192.168.1.0/24", first: "192.168.1.1", last: "192.168.1.254", count: 254},
+		{payload: "192.168.1.77/24", first: "192.168.1.1", last: "192.168.1.254", count: 254},
+		{payload: "10.0.0.0/31", first: "10.0.0.0", last: "10.0.0.1", count: 2},
+		{payload: "10.0.0.9/32", first: "10.0.0.9", last: "10.0.0.9", count: 1},
+		{payload: "10.0.0.250-10.0.1.4", first: "10.0.0.250", last: "10.0.1.4", count: 11},
+		{payload: "10.0.0.1", first: "10.0.0.1", last: "10.0.0.1", count: 1},
+		{payload: "2001:db8::/126", first: "2001:db8::", last: "2001:db8::3", count: 4},
+	}
+	for _, tt := range tests {
+		r, err := parseAddressRange(tt.payload)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.payload, err)
+			continue
+		}
+		addrs, err := r.addresses(1024)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.payload, err)
+			continue
+		}
+		if len(addrs) != tt.count || addrs[0].String() != tt.first || addrs[len(addrs)-1].String() != tt.last {
+			t.Errorf("%s: expected %d addresses %s to %s, got %d %s to %s", tt.payload, tt.count, tt.first, tt.last,
+				len(addrs), addrs[0], addrs[len(addrs)-1])
+		}
+	}
+
+	for _, payload := range []string{"", "192.168.1.0/33", "host.example.com", "10.0.0.5-10.0.0.1", "10.0.0.1-::1", "10.0.0.1-"} {
+		if _, err := parseAddressRange(payload); err == nil {
+			t.Errorf("%q: expected an error", payload)
+		}
+	}
+
+	r, _ := parseAddressRange("10.0.0.0/8")
+	if _, err := r.addresses(1024); err == nil || !strings.Contains(err.Error(), "more than 1024") {
+		t.Errorf("expected a /8 to be refused, got %v", err)
+	}
+}
+
+// executeSweep runs a sweep of payload through /execute
+func executeSweep(t *testing.T, cmdr Commander, cfg Config, payload, options string) (int, CommandResponse, SweepResult) {
+	t.Helper()
+	handler := handleCommand(newTestServer(t, cmdr, cfg))
+	body := fmt.Sprintf(`{"type":"sweep","payload":%q`, payload)
+	if options != "" {
+		body += `,"options":` + options
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/execute", strings.NewReader(body+"}")))
+	var res CommandResponse
+	var data struct {
+		Data SweepResult `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	json.Unmarshal(rec.Body.Bytes(), &data)
+	return rec.Code, res, data.Data
+}
+
+func TestSweep(t *testing.T) {
+	cmdr := pingFunc(func(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+		if opts.Count != 2 || opts.Timeout != Duration(500*time.Millisecond) {
+			return PingResult{}, fmt.Errorf("unexpected options %+v", opts)
+		}
+		switch host {
+		case "192.168.1.2", "192.168.1.5":
+			return PingResult{Successful: true, Host: host, AvgRtt: time.Millisecond}, nil
+		case "192.168.1.3":
+			return PingResult{}, fmt.Errorf("%w: %s is denied", ErrTargetRefused, host)
+		}
+		return PingResult{Host: host, PacketsSent: 2}, nil
+	})
+
+	code, res, result := executeSweep(t, cmdr, DefaultConfig(), "192.168.1.0/29", `{"count":2,"timeout":"500ms","concurrency":3}`)
+	if code != http.StatusOK || !res.Success {
+		t.Fatalf("expected status 200, got %d %+v", code, res)
+	}
+	if result.Range != "192.168.1.0/29" || result.Status != PingStatusCompleted || result.Hosts != 6 {
+		t.Errorf("unexpected sweep %+v", result)
+	}
+	if len(result.Alive) != 2 || result.Alive[0] != (SweepHost{Address: "192.168.1.2", Rtt: time.Millisecond}) || result.Alive[1].Address != "192.168.1.5" {
+		t.Errorf("unexpected alive hosts %+v", result.Alive)
+	}
+	if strings.Join(result.Dead, " ") != "192.168.1.1 192.168.1.4 192.168.1.6" {
+		t.Errorf("unexpected dead hosts %v", result.Dead)
+	}
+	if len(result.Refused) != 1 || result.Refused[0] != "192.168.1.3" {
+		t.Errorf("unexpected refused hosts %v", result.Refused)
+	}
+}
+
+func TestSweep_Concurrency(t *testing.T) {
+	cmdr := &countingCommander{}
+	code, _, result := executeSweep(t, cmdr, DefaultConfig(), "10.0.0.1-10.0.0.12", `{"concurrency":3}`)
+	if code != http.StatusOK || len(result.Alive) != 12 {
+		t.Fatalf("expected 12 hosts alive, got %d %+v", code, result)
+	}
+	if most := cmdr.most.Load(); most != 3 {
+		t.Errorf("expected 3 pings at a time, got %d", most)
+	}
+}
+
+func TestSweep_Errors(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SweepLimits.MaxHosts = 16
+	fails := pingFunc(func(ctx context.Context, host string, opts PingOptions) (PingResult, error) {
+		return PingResult{}, errors.New("failed to ping target host: socket: permission denied")
+	})
+
+	tests := []struct {
+		name    string
+		cmdr    Commander
+		payload string
+		options string
+		status  int
+	}{
+		{"too many hosts", &mockCommander{}, "10.0.0.0/24", "", http.StatusBadRequest},
+		{"invalid range", &mockCommander{}, "10.0.0.9-10.0.0.1", "", http.StatusBadRequest},
+		{"hostname", &mockCommander{}, "example.com", "", http.StatusBadRequest},
+		{"concurrency over limit", &mockCommander{}, "10.0.0.0/28", `{"concurrency":1000}`, http.StatusBadRequest},
+		{"timeout over limit", &mockCommander{}, "10.0.0.0/28", `{"timeout":"1m"}`, http.StatusBadRequest},
+		{"count does not fit in timeout", &mockCommander{}, "10.0.0.0/28", `{"count":3,"timeout":"300ms"}`, http.StatusBadRequest},
+		{"ping failure", fails, "10.0.0.0/28", "", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, _ := executeSweep(t, tt.cmdr, cfg, tt.payload, tt.options)
+			if code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, code)
+			}
+		})
+	}
+}
+
+func TestSweep_Localhost(t *testing.T) {
+	privileged := os.Geteuid() == 0
+	code, res, result := executeSweep(t, NewCommander(), DefaultConfig(), "127.0.0.1-127.0.0.2",
+		fmt.Sprintf(`{"timeout":"1s","privileged":%v}`, privileged))
+	if code == http.StatusInternalServerError && strings.Contains(res.Error, "permission denied") {
+		t.Skipf("ICMP sockets not permitted: %s", res.Error)
+	}
+	if code != http.StatusOK || len(result.Alive) != 2 {
+		t.Errorf("expected both loopback addresses alive, got %d %+v %+v", code, res, result)
+	}
+}
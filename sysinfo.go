@@ -0,0 +1,58 @@
+package main
+
+import (
+    "runtime"
+)
+
+// OSInfo struct for operating system details
+type OSInfo struct {
+    Name    string `json:"name"`
+    Version string `json:"version"`
+    Kernel  string `json:"kernel"`
+    Arch    string `json:"arch"`
+}
+
+// CPUInfo struct for processor details
+type CPUInfo struct {
+    Model string `json:"model"`
+    Cores int    `json:"cores"`
+}
+
+// MemoryInfo struct for memory sizes in bytes
+type MemoryInfo struct {
+    Total     uint64 `json:"total"`
+    Available uint64 `json:"available"`
+}
+
+// LoadAverage struct for the 1, 5 and 15 minute load averages
+type LoadAverage struct {
+    One     float64 `json:"one"`
+    Five    float64 `json:"five"`
+    Fifteen float64 `json:"fifteen"`
+}
+
+// DaemonInfo struct for details about this build of the daemon
+type DaemonInfo struct {
+    Version   string `json:"version"`
+    BuildDate string `json:"build_date"`
+    GoVersion string `json:"go_version"`
+}
+
+// daemonInfo reports the version the Makefile stamped into the binary
+func daemonInfo() DaemonInfo {
+    return DaemonInfo{
+        Version:   Version,
+        BuildDate: BuildDate,
+        GoVersion: runtime.Version(),
+    }
+}
+
+// utsString converts a NUL terminated utsname field into a string
+func utsString(b []byte) string {
+    for i, c := range b {
+        if c == 0 {
+            return string(b[:i])
+        }
+    }
+    return string(b)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// readPlatformInfo fills info from uname and sysctl
+func readPlatformInfo(info *SystemInfo) error {
+    var uts unix.Utsname
+    err := unix.Uname(&uts)
+    if err != nil {
+        return fmt.Errorf("uname: %w", err)
+    }
+    info.OS.Name = "macOS"
+    info.OS.Kernel = utsString(uts.Release[:])
+    info.OS.Arch = utsString(uts.Machine[:])
+    if version, err := unix.Sysctl("kern.osproductversion"); err == nil {
+        info.OS.Version = version
+    }
+
+    if model, err := unix.Sysctl("machdep.cpu.brand_string"); err == nil {
+        info.CPU.Model = model
+    }
+    if cores, err := unix.SysctlUint32("hw.ncpu"); err == nil {
+        info.CPU.Cores = int(cores)
+    }
+
+    info.Memory.Total, err = unix.SysctlUint64("hw.memsize")
+    if err != nil {
+        return fmt.Errorf("sysctl hw.memsize: %w", err)
+    }
+    // free plus speculative pages is what vm_stat reports as available
+    pageSize, err := unix.SysctlUint32("hw.pagesize")
+    if err == nil {
+        free, _ := unix.SysctlUint32("vm.page_free_count")
+        speculative, _ := unix.SysctlUint32("vm.page_speculative_count")
+        info.Memory.Available = uint64(free+speculative) * uint64(pageSize)
+    }
+
+    boot, err := unix.SysctlTimeval("kern.boottime")
+    if err != nil {
+        return fmt.Errorf("sysctl kern.boottime: %w", err)
+    }
+    info.BootTime = time.Unix(boot.Unix()).UTC()
+    info.Uptime = time.Since(info.BootTime).Truncate(time.Second)
+
+    // struct loadavg { fixpt_t ldavg[3]; long fscale; }
+    raw, err := unix.SysctlRaw("vm.loadavg")
+    if err != nil {
+        return fmt.Errorf("sysctl vm.loadavg: %w", err)
+    }
+    if len(raw) >= 24 {
+        scale := float64(binary.LittleEndian.Uint64(raw[16:24]))
+        info.LoadAverage = LoadAverage{
+            One:     float64(binary.LittleEndian.Uint32(raw[0:4])) / scale,
+            Five:    float64(binary.LittleEndian.Uint32(raw[4:8])) / scale,
+            Fifteen: float64(binary.LittleEndian.Uint32(raw[8:12])) / scale,
+        }
+    }
+    return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// procRoot is where the proc filesystem is mounted, tests point it elsewhere
+var procRoot = "/proc"
+
+// osReleasePath is the os-release file describing the distribution
+var osReleasePath = "/etc/os-release"
+
+// readPlatformInfo fills info from /proc, os-release and uname
+func readPlatformInfo(info *SystemInfo) error {
+    var uts unix.Utsname
+    err := unix.Uname(&uts)
+    if err != nil {
+        return fmt.Errorf("uname: %w", err)
+    }
+    info.OS.Kernel = utsString(uts.Release[:])
+    info.OS.Arch = utsString(uts.Machine[:])
+
+    // os-release is optional, minimal containers often do not have one
+    if f, err := os.Open(osReleasePath); err == nil {
+        name, version := parseOSRelease(f)
+        f.Close()
+        if name != "" {
+            info.OS.Name = name
+        }
+        info.OS.Version = version
+    }
+
+    err = readProcFile("cpuinfo", func(r io.Reader) error {
+        model, cores := parseCPUInfo(r)
+        info.CPU.Model = model
+        if cores > 0 {
+            info.CPU.Cores = cores
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    err = readProcFile("meminfo", func(r io.Reader) error {
+        var err error
+        info.Memory, err = parseMeminfo(r)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+
+    err = readProcFile("uptime", func(r io.Reader) error {
+        var err error
+        info.Uptime, err = parseUptime(r)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    info.BootTime = time.Now().Add(-info.Uptime).Truncate(time.Second).UTC()
+
+    return readProcFile("loadavg", func(r io.Reader) error {
+        var err error
+        info.LoadAverage, err = parseLoadAverage(r)
+        return err
+    })
+}
+
+// readProcFile opens a file below procRoot and hands it to parse
+func readProcFile(name string, parse func(io.Reader) error) error {
+    f, err := os.Open(procRoot + "/" + name)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    err = parse(f)
+    if err != nil {
+        return fmt.Errorf("parsing %s: %w", name, err)
+    }
+    return nil
+}
+
+// parseOSRelease returns NAME and VERSION_ID from an os-release file
+func parseOSRelease(r io.Reader) (string, string) {
+    var name, version string
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        key, value, ok := strings.Cut(scanner.Text(), "=")
+        if !ok {
+            continue
+        }
+        value = strings.Trim(value, `"'`)
+        switch key {
+        case "NAME":
+            name = value
+        case "VERSION_ID":
+            version = value
+        }
+    }
+    return name, version
+}
+
+// parseCPUInfo returns the first model name and the number of processors
+func parseCPUInfo(r io.Reader) (string, int) {
+    var model string
+    cores := 0
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        key, value, ok := strings.Cut(scanner.Text(), ":")
+        if !ok {
+            continue
+        }
+        switch strings.TrimSpace(key) {
+        case "processor":
+            cores++
+        case "model name", "Model":
+            if model == "" {
+                model = strings.TrimSpace(value)
+            }
+        }
+    }
+    return model, cores
+}
+
+// parseMeminfo returns MemTotal and MemAvailable in bytes
+func parseMeminfo(r io.Reader) (MemoryInfo, error) {
+    var mem MemoryInfo
+    scanner := bufio.NewScanner(r)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) < 2 {
+            continue
+        }
+        var target *uint64
+        switch fields[0] {
+        case "MemTotal:":
+            target = &mem.Total
+        case "MemAvailable:":
+            target = &mem.Available
+        default:
+            continue
+        }
+        value, err := strconv.ParseUint(fields[1], 10, 64)
+        if err != nil {
+            return MemoryInfo{}, err
+        }
+        // values are reported in kB
+        *target = value * 1024
+    }
+    if mem.Total == 0 {
+        return MemoryInfo{}, fmt.Errorf("MemTotal not found")
+    }
+    return mem, scanner.Err()
+}
+
+// parseUptime returns the first field of /proc/uptime
+func parseUptime(r io.Reader) (time.Duration, error) {
+    var seconds float64
+    _, err := fmt.Fscan(r, &seconds)
+    if err != nil {
+        return 0, err
+    }
+    return time.Duration(seconds * float64(time.Second)).Truncate(time.Second), nil
+}
+
+// parseLoadAverage returns the first three fields of /proc/loadavg
+func parseLoadAverage(r io.Reader) (LoadAverage, error) {
+    var load LoadAverage
+    _, err := fmt.Fscan(r, &load.One, &load.Five, &load.Fifteen)
+    if err != nil {
+        return LoadAverage{}, err
+    }
+    return load, nil
+}
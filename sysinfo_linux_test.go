@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	name, version := parseOSRelease(strings.NewReader(`PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+NAME="Debian GNU/Linux"
+VERSION_ID="12"
+ID=debian
+`))
+	if name != "Debian GNU/Linux" {
+		t.Errorf("expected name Debian GNU/Linux, got %q", name)
+	}
+	if version != "12" {
+		t.Errorf("expected version 12, got %q", version)
+	}
+}
+
+func TestParseCPUInfo(t *testing.T) {
+	model, cores := parseCPUInfo(strings.NewReader(`processor	: 0
+model name	: Intel(R) Xeon(R) CPU
+cpu MHz		: 2000.000
+
+processor	: 1
+model name	: Intel(R) Xeon(R) CPU
+`))
+	if model != "Intel(R) Xeon(R) CPU" {
+		t.Errorf("unexpected model %q", model)
+	}
+	if cores != 2 {
+		t.Errorf("expected 2 cores, got %d", cores)
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	mem, err := parseMeminfo(strings.NewReader(`MemTotal:        6158152 kB
+MemFree:         4896420 kB
+MemAvailable:    5671792 kB
+`))
+	if err != nil {
+		t.Fatalf("parseMeminfo() returned error: %v", err)
+	}
+	if mem.Total != 6158152*1024 {
+		t.Errorf("unexpected total %d", mem.Total)
+	}
+	if mem.Available != 5671792*1024 {
+		t.Errorf("unexpected available %d", mem.Available)
+	}
+
+	if _, err := parseMeminfo(strings.NewReader("MemFree: 1 kB\n")); err == nil {
+		t.Error("expected error when MemTotal is missing")
+	}
+}
+
+func TestParseUptime(t *testing.T) {
+	uptime, err := parseUptime(strings.NewReader("866.05 689.94\n"))
+	if err != nil {
+		t.Fatalf("parseUptime() returned error: %v", err)
+	}
+	if uptime != 866*time.Second {
+		t.Errorf("expected 866s, got %v", uptime)
+	}
+}
+
+func TestParseLoadAverage(t *testing.T) {
+	load, err := parseLoadAverage(strings.NewReader("0.07 0.15 0.12 2/71 17623\n"))
+	if err != nil {
+		t.Fatalf("parseLoadAverage() returned error: %v", err)
+	}
+	if load.One != 0.07 || load.Five != 0.15 || load.Fifteen != 0.12 {
+		t.Errorf("unexpected load average %+v", load)
+	}
+
+	if _, err := parseLoadAverage(strings.NewReader("")); err == nil {
+		t.Error("expected error for empty loadavg")
+	}
+}
+
+func TestReadPlatformInfo(t *testing.T) {
+	var info SystemInfo
+	if err := readPlatformInfo(&info); err != nil {
+		t.Fatalf("readPlatformInfo() returned error: %v", err)
+	}
+	if info.OS.Kernel == "" || info.OS.Arch == "" {
+		t.Errorf("expected kernel and arch from uname, got %+v", info.OS)
+	}
+	if info.Memory.Total == 0 {
+		t.Error("expected total memory")
+	}
+	if info.BootTime.IsZero() || info.BootTime.After(time.Now()) {
+		t.Errorf("unexpected boot time %v", info.BootTime)
+	}
+}
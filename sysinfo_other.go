@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// readPlatformInfo has nothing beyond the portable details on this platform
+func readPlatformInfo(info *SystemInfo) error {
+    return nil
+}
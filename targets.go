@@ -0,0 +1,171 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "path"
+    "strings"
+)
+
+// ErrTargetRefused is returned when every address of a target is refused
+// by the target lists
+var ErrTargetRefused = errors.New("target refused")
+
+// TargetsConfig struct for the addresses commands may send traffic to
+//
+// Entries are CIDRs, matched against every resolved address, or hostname
+// globs, matched against the name the caller gave. Deny wins over allow
+// and an empty allow list allows everything not denied.
+type TargetsConfig struct {
+    Allow        []string `json:"allow"`
+    Deny         []string `json:"deny"`
+    AllowSpecial bool     `json:"allow_special"` // multicast, broadcast and unspecified addresses
+}
+
+// Validate checks every entry is a CIDR or hostname glob
+func (t TargetsConfig) Validate() error {
+    for _, entry := range append(append([]string{}, t.Allow...), t.Deny...) {
+        if err := validateTargetPattern(entry); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// targetRule struct for a parsed allow or deny entry
+type targetRule struct {
+    pattern string
+    network *net.IPNet
+}
+
+// matches reports whether the entry matches host or its resolved ip
+func (r targetRule) matches(host string, ip net.IP) bool {
+    if r.network != nil {
+        return r.network.Contains(ip)
+    }
+    ok, _ := path.Match(r.pattern, host)
+    return ok
+}
+
+// TargetFilter struct for checking resolved addresses against TargetsConfig
+type TargetFilter struct {
+    allow        []targetRule
+    deny         []targetRule
+    allowSpecial bool
+    // broadcasts returns the directed broadcast addresses of the local
+    // networks, tests replace it
+    broadcasts func() []net.IP
+}
+
+// NewTargetFilter create a filter from a validated config
+func NewTargetFilter(cfg TargetsConfig) *TargetFilter {
+    parse := func(entries []string) []targetRule {
+        var rules []targetRule
+        for _, entry := range entries {
+            rule := targetRule{pattern: strings.ToLower(entry)}
+            if _, network, err := net.ParseCIDR(entry); err == nil {
+                rule.network = network
+            }
+            rules = append(rules, rule)
+        }
+        return rules
+    }
+    return &TargetFilter{
+        allow:        parse(cfg.Allow),
+        deny:         parse(cfg.Deny),
+        allowSpecial: cfg.AllowSpecial,
+        broadcasts:   localBroadcasts,
+    }
+}
+
+// Check returns an error wrapping ErrTargetRefused when ip, resolved from
+// host, may not be sent traffic
+func (f *TargetFilter) Check(host string, ip net.IP) error {
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    if !f.allowSpecial {
+        if reason := specialAddress(ip, f.broadcasts()); reason != "" {
+            return fmt.Errorf("%w: %s is a %s address", ErrTargetRefused, ip, reason)
+        }
+    }
+    for _, rule := range f.deny {
+        if rule.matches(host, ip) {
+            return fmt.Errorf("%w: %s (%s) matches deny %s", ErrTargetRefused, host, ip, rule.pattern)
+        }
+    }
+    if len(f.allow) == 0 {
+        return nil
+    }
+    for _, rule := range f.allow {
+        if rule.matches(host, ip) {
+            return nil
+        }
+    }
+    return fmt.Errorf("%w: %s (%s) is not in the allow list", ErrTargetRefused, host, ip)
+}
+
+// Filter returns the addresses of host that may be sent traffic, or the
+// first refusal when there are none
+func (f *TargetFilter) Filter(host string, ips []net.IP) ([]net.IP, error) {
+    var allowed []net.IP
+    var refused error
+    for _, ip := range ips {
+        if err := f.Check(host, ip); err != nil {
+            if refused == nil {
+                refused = err
+            }
+            continue
+        }
+        allowed = append(allowed, ip)
+    }
+    if len(allowed) == 0 {
+        return nil, refused
+    }
+    return allowed, nil
+}
+
+// specialAddress names the kind of address ip is when it is multicast,
+// broadcast or unspecified
+func specialAddress(ip net.IP, broadcasts []net.IP) string {
+    switch {
+    case ip.IsUnspecified():
+        return "unspecified"
+    case ip.IsMulticast():
+        return "multicast"
+    case ip.Equal(net.IPv4bcast):
+        return "broadcast"
+    }
+    for _, broadcast := range broadcasts {
+        if ip.Equal(broadcast) {
+            return "broadcast"
+        }
+    }
+    return ""
+}
+
+// localBroadcasts returns the directed broadcast address of every IPv4
+// network the host is on
+func localBroadcasts() []net.IP {
+    addrs, err := net.InterfaceAddrs()
+    if err != nil {
+        return nil
+    }
+    var broadcasts []net.IP
+    for _, addr := range addrs {
+        ipNet, ok := addr.(*net.IPNet)
+        if !ok || ipNet.IP.To4() == nil {
+            continue
+        }
+        ones, bits := ipNet.Mask.Size()
+        if bits != 32 || ones >= 31 {
+            continue
+        }
+        ip := ipNet.IP.To4()
+        broadcast := make(net.IP, net.IPv4len)
+        for i := range broadcast {
+            broadcast[i] = ip[i] | ^ipNet.Mask[len(ipNet.Mask)-net.IPv4len+i]
+        }
+        broadcasts = append(broadcasts, broadcast)
+    }
+    return broadcasts
+}
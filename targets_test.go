@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestTargetFilter_Check(t *testing.T) {
+	filter := NewTargetFilter(TargetsConfig{
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32", "*.example.com"},
+		Deny:  []string{"192.0.2.128/25", "secret.example.com"},
+	})
+	filter.broadcasts = func() []net.IP { return []net.IP{net.ParseIP("192.0.2.127")} }
+
+	tests := []struct {
+		host    string
+		ip      string
+		allowed bool
+	}{
+		{host: "192.0.2.10", ip: "192.0.2.10", allowed: true},
+		{host: "2001:db8::1", ip: "2001:db8::1", allowed: true},
+		{host: "www.example.com", ip: "198.51.100.7", allowed: true},
+		{host: "WWW.Example.COM.", ip: "198.51.100.7", allowed: true},
+		{host: "198.51.100.7", ip: "198.51.100.7"},
+		{host: "192.0.2.200", ip: "192.0.2.200"},
+		{host: "secret.example.com", ip: "198.51.100.8"},
+		// an allowed name resolving into a denied range
+		{host: "rebound.example.com", ip: "192.0.2.129"},
+		{host: "example.org", ip: "203.0.113.1"},
+		{host: "0.0.0.0", ip: "0.0.0.0"},
+		{host: "::", ip: "::"},
+		{host: "224.0.0.1", ip: "224.0.0.1"},
+		{host: "ff02::1", ip: "ff02::1"},
+		{host: "255.255.255.255", ip: "255.255.255.255"},
+		{host: "192.0.2.127", ip: "192.0.2.127"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+"/"+tt.ip, func(t *testing.T) {
+			err := filter.Check(tt.host, net.ParseIP(tt.ip))
+			if tt.allowed && err != nil {
+				t.Errorf("expected %s to be allowed, got %v", tt.ip, err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrTargetRefused) {
+				t.Errorf("expected %s to be refused, got %v", tt.ip, err)
+			}
+		})
+	}
+}
+
+func TestTargetFilter_Defaults(t *testing.T) {
+	filter := NewTargetFilter(TargetsConfig{})
+	filter.broadcasts = func() []net.IP { return nil }
+	if err := filter.Check("localhost", net.ParseIP("127.0.0.1")); err != nil {
+		t.Errorf("expected loopback to be allowed by default, got %v", err)
+	}
+	if err := filter.Check("224.0.0.251", net.ParseIP("224.0.0.251")); !errors.Is(err, ErrTargetRefused) {
+		t.Errorf("expected multicast to be refused by default, got %v", err)
+	}
+
+	filter = NewTargetFilter(TargetsConfig{AllowSpecial: true})
+	if err := filter.Check("224.0.0.251", net.ParseIP("224.0.0.251")); err != nil {
+		t.Errorf("expected allow_special to allow multicast, got %v", err)
+	}
+}
+
+func TestTargetFilter_Filter(t *testing.T) {
+	filter := NewTargetFilter(TargetsConfig{Deny: []string{"::1/128"}})
+	ips, err := filter.Filter("localhost", []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")})
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected only 127.0.0.1 to remain, got %v %v", ips, err)
+	}
+	if _, err := filter.Filter("localhost", []net.IP{net.ParseIP("::1")}); !errors.Is(err, ErrTargetRefused) {
+		t.Errorf("expected every address to be refused, got %v", err)
+	}
+}
+
+func TestPing_TargetRefusedAfterResolution(t *testing.T) {
+	defer func(orig func(context.Context, string, string) ([]net.IP, error)) { lookupIP = orig }(lookupIP)
+	lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("10.0.0.5")}, nil
+	}
+	cmdr := NewCommander(WithTargetFilter(NewTargetFilter(TargetsConfig{
+		Allow: []string{"*.example.com"},
+		Deny:  []string{"10.0.0.0/8"},
+	})))
+
+	_, err := cmdr.Ping(context.Background(), "printer.example.com", PingOptions{})
+	if !errors.Is(err, ErrTargetRefused) {
+		t.Fatalf("expected ErrTargetRefused, got %v", err)
+	}
+	if cmdErr := asCommandError(err); cmdErr.Code != ErrCodeTargetRefused || cmdErr.Status() != 403 {
+		t.Errorf("expected target_refused 403, got %s %d", cmdErr.Code, cmdErr.Status())
+	}
+
+	// the default filter refuses multicast without sending anything
+	_, err = NewCommander().Ping(context.Background(), "224.0.0.1", PingOptions{})
+	if !errors.Is(err, ErrTargetRefused) {
+		t.Errorf("expected multicast to be refused, got %v", err)
+	}
+}
+
+func TestTargetsConfig_Validate(t *testing.T) {
+	if err := (TargetsConfig{Allow: []string{"10.0.0.0/8", "*.example.com"}}).Validate(); err != nil {
+		t.Errorf("expected valid targets, got %v", err)
+	}
+	if err := (TargetsConfig{Deny: []string{"10.0.0.0/40"}}).Validate(); err == nil {
+		t.Error("expected invalid CIDR to be rejected")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "errors"
+    "fmt"
+    "log"
+    "math/big"
+    "net"
+    "os"
+    "sync"
+    "time"
+)
+
+// CertReloadInterval is how often the certificate files are checked for changes
+var CertReloadInterval = 5 * time.Second
+
+// selfSignedValidity is how long a bootstrap certificate is valid for
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// TLSConfig struct for serving HTTPS
+type TLSConfig struct {
+    CertFile     string `json:"cert_file"`
+    KeyFile      string `json:"key_file"`
+    ClientCAFile string `json:"client_ca_file"`
+    SelfSigned   bool   `json:"self_signed"`
+}
+
+// Enabled reports whether HTTPS is configured
+func (t TLSConfig) Enabled() bool {
+    return t.CertFile != "" || t.KeyFile != "" || t.SelfSigned
+}
+
+// Validate checks the certificate, key and CA bundle can be loaded
+func (t TLSConfig) Validate() error {
+    if t.SelfSigned && (t.CertFile != "" || t.KeyFile != "") {
+        return errors.New("self_signed cannot be combined with cert_file and key_file")
+    }
+    if !t.SelfSigned && (t.CertFile != "" || t.KeyFile != "") {
+        if t.CertFile == "" || t.KeyFile == "" {
+            return errors.New("cert_file and key_file must both be set")
+        }
+        if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+            return err
+        }
+    }
+    if t.ClientCAFile != "" {
+        if !t.Enabled() {
+            return errors.New("client_ca_file requires cert_file and key_file or self_signed")
+        }
+        if _, err := loadCertPool(t.ClientCAFile); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// CertStore struct for the server certificate and client CA bundle, both
+// are reloaded whenever their files change
+type CertStore struct {
+    cfg  TLSConfig
+    mu   sync.RWMutex
+    cert *tls.Certificate
+    cas  *x509.CertPool
+    stop chan struct{}
+    once sync.Once
+}
+
+// NewCertStore loads the certificates from cfg, or creates a self-signed
+// certificate when cfg.SelfSigned is set
+func NewCertStore(cfg TLSConfig) (*CertStore, error) {
+    cs := &CertStore{
+        cfg:  cfg,
+        stop: make(chan struct{}),
+    }
+    if cfg.SelfSigned {
+        cert, err := selfSignedCertificate()
+        if err != nil {
+            return nil, err
+        }
+        sum := sha256.Sum256(cert.Certificate[0])
+        log.Printf("Serving a self-signed certificate, SHA-256 fingerprint %X\n", sum)
+        cs.cert = &cert
+    }
+    err := cs.Reload()
+    if err != nil {
+        return nil, err
+    }
+    return cs, nil
+}
+
+// Reload re-reads the certificate files, on error the current ones are kept
+func (cs *CertStore) Reload() error {
+    cert := cs.certificate()
+    if !cs.cfg.SelfSigned {
+        loaded, err := tls.LoadX509KeyPair(cs.cfg.CertFile, cs.cfg.KeyFile)
+        if err != nil {
+            return fmt.Errorf("loading certificate: %w", err)
+        }
+        cert = &loaded
+    }
+    var cas *x509.CertPool
+    if cs.cfg.ClientCAFile != "" {
+        var err error
+        cas, err = loadCertPool(cs.cfg.ClientCAFile)
+        if err != nil {
+            return err
+        }
+    }
+
+    cs.mu.Lock()
+    cs.cert = cert
+    cs.cas = cas
+    cs.mu.Unlock()
+    return nil
+}
+
+// Watch reloads the certificate files whenever they change
+func (cs *CertStore) Watch(interval time.Duration) {
+    var files []string
+    for _, file := range []string{cs.cfg.CertFile, cs.cfg.KeyFile, cs.cfg.ClientCAFile} {
+        if file != "" {
+            files = append(files, file)
+        }
+    }
+    if len(files) == 0 {
+        return
+    }
+    watchFiles(cs.stop, interval, files, func() error {
+        if err := cs.Reload(); err != nil {
+            log.Printf("Keeping current certificates: %v\n", err)
+            return err
+        }
+        log.Println("Reloaded TLS certificates")
+        return nil
+    })
+}
+
+// Close stops watching the certificate files
+func (cs *CertStore) Close() error {
+    cs.once.Do(func() { close(cs.stop) })
+    return nil
+}
+
+// certificate returns the current server certificate
+func (cs *CertStore) certificate() *tls.Certificate {
+    cs.mu.RLock()
+    defer cs.mu.RUnlock()
+    return cs.cert
+}
+
+// tlsNextProtos are the protocols offered over ALPN, the config returned
+// for each client replaces the one http.Server adds them to
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+// TLSConfig returns a config that always serves the current certificates
+// and, with a client CA bundle, requires a client certificate signed by it
+func (cs *CertStore) TLSConfig() *tls.Config {
+    base := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: tlsNextProtos}
+    base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+        cs.mu.RLock()
+        defer cs.mu.RUnlock()
+        cfg := &tls.Config{
+            MinVersion:   tls.VersionTLS12,
+            Certificates: []tls.Certificate{*cs.cert},
+            NextProtos:   tlsNextProtos,
+        }
+        if cs.cas != nil {
+            cfg.ClientCAs = cs.cas
+            cfg.ClientAuth = tls.RequireAndVerifyClientCert
+        }
+        return cfg, nil
+    }
+    return base
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("reading client CA bundle: %w", err)
+    }
+    pool := x509.NewCertPool()
+    if !pool.AppendCertsFromPEM(data) {
+        return nil, fmt.Errorf("client CA bundle %s contains no certificates", path)
+    }
+    return pool, nil
+}
+
+// selfSignedCertificate creates a certificate for localhost and the
+// loopback addresses, it is only meant for local testing
+func selfSignedCertificate() (tls.Certificate, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    hosts := []string{"localhost"}
+    if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+        hosts = append(hosts, hostname)
+    }
+    now := time.Now()
+    template := &x509.Certificate{
+        SerialNumber:          serial,
+        Subject:               pkix.Name{CommonName: "espresso-commander"},
+        NotBefore:             now.Add(-time.Hour),
+        NotAfter:              now.Add(selfSignedValidity),
+        KeyUsage:              x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        BasicConstraintsValid: true,
+        DNSNames:              hosts,
+        IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key issued by issuer, or self-signed when
+// issuer is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, issuer *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write stores the certificate and key as PEM files in dir
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// serveTLS starts a server for cfg returning the principal of each request
+func serveTLS(t *testing.T, cfg TLSConfig) *httptest.Server {
+	t.Helper()
+	certs, err := NewCertStore(cfg)
+	if err != nil {
+		t.Fatalf("NewCertStore: %v", err)
+	}
+	t.Cleanup(func() { certs.Close() })
+	certs.Watch(10 * time.Millisecond)
+
+	handler := authenticate(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(principalFrom(r.Context()).Label))
+	}))
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = certs.TLSConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// tlsClient returns a client trusting roots and presenting certs
+func tlsClient(roots *x509.CertPool, certs ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+		DisableKeepAlives: true,
+	}}
+}
+
+func TestCertStore_SelfSigned(t *testing.T) {
+	server := serveTLS(t, TLSConfig{SelfSigned: true})
+
+	// the generated certificate is not trusted by default
+	if _, err := tlsClient(nil).Get(server.URL); err == nil {
+		t.Fatal("expected an untrusted certificate error")
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.TLS.PeerCertificates[0].Subject.CommonName != "espresso-commander" {
+		t.Errorf("unexpected certificate subject %v", resp.TLS.PeerCertificates[0].Subject)
+	}
+}
+
+func TestCertStore_HTTP2(t *testing.T) {
+	certs, err := NewCertStore(TLSConfig{SelfSigned: true})
+	if err != nil {
+		t.Fatalf("NewCertStore: %v", err)
+	}
+	defer certs.Close()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = true
+	server.TLS = certs.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.TLS.NegotiatedProtocol != "h2" {
+		t.Errorf("expected HTTP/2, got %s over %q", resp.Proto, resp.TLS.NegotiatedProtocol)
+	}
+}
+
+func TestCertStore_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "fleet ca", 1, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "localhost", 2, ca).write(t, dir, "server")
+	controller := newTestCert(t, "controller-1", 3, ca)
+	stranger := newTestCert(t, "stranger", 4, newTestCert(t, "other ca", 5, nil))
+
+	server := serveTLS(t, TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	if _, err := tlsClient(roots).Get(server.URL); err == nil {
+		t.Error("expected a request without a client certificate to fail")
+	}
+	if _, err := tlsClient(roots, stranger.tlsCertificate()).Get(server.URL); err == nil {
+		t.Error("expected a certificate from another CA to fail")
+	}
+
+	resp, err := tlsClient(roots, controller.tlsCertificate()).Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET with client certificate: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if string(body) != "cert:controller-1" {
+		t.Errorf("expected principal cert:controller-1, got %q", body)
+	}
+}
+
+func TestCertStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil)
+	certFile, keyFile := newTestCert(t, "localhost", 10, ca).write(t, dir, "server")
+	server := serveTLS(t, TLSConfig{CertFile: certFile, KeyFile: keyFile})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serial := func() int64 {
+		resp, err := tlsClient(roots).Get(server.URL)
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 10 {
+		t.Fatalf("expected serial 10, got %d", got)
+	}
+
+	// replace the certificate, moving the modification time so the change is seen
+	newTestCert(t, "localhost", 11, ca).write(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, future, future); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for serial() != 11 {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSConfig_Validate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil)
+	certFile, keyFile := ca.write(t, dir, "ca")
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	valid := []TLSConfig{
+		{},
+		{SelfSigned: true},
+		{CertFile: certFile, KeyFile: keyFile},
+		{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile},
+		{SelfSigned: true, ClientCAFile: certFile},
+	}
+	for _, cfg := range valid {
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid: %v", cfg, err)
+		}
+	}
+
+	invalid := []TLSConfig{
+		{CertFile: certFile},
+		{CertFile: certFile, KeyFile: certFile},
+		{SelfSigned: true, CertFile: certFile, KeyFile: keyFile},
+		{ClientCAFile: certFile},
+		{SelfSigned: true, ClientCAFile: garbage},
+		{SelfSigned: true, ClientCAFile: filepath.Join(dir, "missing.pem")},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "log"
+    "math/rand"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/net/icmp"
+    "golang.org/x/net/ipv4"
+    "golang.org/x/net/ipv6"
+)
+
+// Traceroute probe modes
+const (
+    TracerouteICMP = "icmp"
+    TracerouteUDP  = "udp"
+)
+
+// tracerouteLookupTimeout bounds the reverse DNS lookup of each hop
+const tracerouteLookupTimeout = 2 * time.Second
+
+// lookupAddr finds the names of an address, tests replace it to avoid real DNS
+var lookupAddr = net.DefaultResolver.LookupAddr
+
+// TracerouteOptions struct for per-request traceroute settings, zero values
+// use the defaults
+type TracerouteOptions struct {
+    Mode    string   `json:"mode,omitempty"`
+    MaxHops int      `json:"max_hops,omitempty"`
+    Timeout Duration `json:"timeout,omitempty"` // per hop
+    Probes  int      `json:"probes,omitempty"`  // probes per hop
+    Port    int      `json:"port,omitempty"`    // first UDP destination port
+    Family  string   `json:"family,omitempty"`
+}
+
+// DefaultTracerouteOptions are the settings used when a request does not
+// override them, the same as traceroute(8)
+var DefaultTracerouteOptions = TracerouteOptions{
+    Mode:    TracerouteICMP,
+    MaxHops: 30,
+    Timeout: Duration(time.Second),
+    Probes:  3,
+    Port:    33434,
+    Family:  FamilyAny,
+}
+
+// withDefaults fills any unset option from DefaultTracerouteOptions
+func (o TracerouteOptions) withDefaults() TracerouteOptions {
+    if o.Mode == "" {
+        o.Mode = DefaultTracerouteOptions.Mode
+    }
+    if o.MaxHops == 0 {
+        o.MaxHops = DefaultTracerouteOptions.MaxHops
+    }
+    if o.Timeout == 0 {
+        o.Timeout = DefaultTracerouteOptions.Timeout
+    }
+    if o.Probes == 0 {
+        o.Probes = DefaultTracerouteOptions.Probes
+    }
+    if o.Port == 0 {
+        o.Port = DefaultTracerouteOptions.Port
+    }
+    if o.Family == "" {
+        o.Family = DefaultTracerouteOptions.Family
+    }
+    return o
+}
+
+// Validate checks the options against the traceroute and ping limits
+func (o TracerouteOptions) Validate(l TracerouteLimits, pl PingLimits) error {
+    o = o.withDefaults()
+    if o.Mode != TracerouteICMP && o.Mode != TracerouteUDP {
+        return fmt.Errorf("mode must be %s or %s", TracerouteICMP, TracerouteUDP)
+    }
+    if o.MaxHops < 0 || o.MaxHops > l.MaxHops {
+        return fmt.Errorf("max_hops must be between 1 and %d", l.MaxHops)
+    }
+    if o.Timeout < 0 || o.Timeout > l.MaxTimeout {
+        return fmt.Errorf("timeout must be between 0s and %v", time.Duration(l.MaxTimeout))
+    }
+    if o.Probes < 0 || o.Probes > l.MaxProbes {
+        return fmt.Errorf("probes must be between 1 and %d", l.MaxProbes)
+    }
+    // every probe is sent to the next port
+    if last := 65535 - o.MaxHops*o.Probes + 1; o.Port < 0 || o.Port > last {
+        return fmt.Errorf("port must be between 1 and %d", last)
+    }
+    if o.Family != FamilyAny && o.Family != FamilyIPv4 && o.Family != FamilyIPv6 {
+        return fmt.Errorf("family must be %s, %s or %s", FamilyIPv4, FamilyIPv6, FamilyAny)
+    }
+    // only a raw socket sees the ICMP errors of the routers on the way
+    if !pl.AllowPrivileged {
+        return errors.New("traceroute needs privileged mode, which is not allowed")
+    }
+    return nil
+}
+
+// TracerouteLimits struct for the server-side bounds on TracerouteOptions
+type TracerouteLimits struct {
+    MaxHops    int      `json:"max_hops"`
+    MaxProbes  int      `json:"max_probes"`
+    MaxTimeout Duration `json:"max_timeout"`
+}
+
+// DefaultTracerouteLimits are the bounds applied when none are configured
+var DefaultTracerouteLimits = TracerouteLimits{
+    MaxHops:    64,
+    MaxProbes:  10,
+    MaxTimeout: Duration(5 * time.Second),
+}
+
+// Validate checks the limits allow a traceroute with the default options
+func (l TracerouteLimits) Validate() error {
+    if l.MaxHops < DefaultTracerouteOptions.MaxHops || l.MaxHops > 255 {
+        return fmt.Errorf("max_hops must be between %d and 255", DefaultTracerouteOptions.MaxHops)
+    }
+    if l.MaxProbes < DefaultTracerouteOptions.Probes || l.MaxProbes > 100 {
+        return fmt.Errorf("max_probes must be between %d and 100", DefaultTracerouteOptions.Probes)
+    }
+    if l.MaxTimeout < DefaultTracerouteOptions.Timeout {
+        return fmt.Errorf("max_timeout must be at least %v", time.Duration(DefaultTracerouteOptions.Timeout))
+    }
+    return nil
+}
+
+// runTimeout returns the longest a traceroute within the limits can take
+func (l TracerouteLimits) runTimeout() time.Duration {
+    return time.Duration(l.MaxTimeout)*time.Duration(l.MaxHops) + tracerouteLookupTimeout
+}
+
+// TracerouteResult struct for traceroute result
+type TracerouteResult struct {
+    Host      string          `json:"host"`
+    IPAddress string          `json:"ip_address"`
+    Family    string          `json:"family"`
+    Mode      string          `json:"mode"`
+    Status    string          `json:"status"`
+    Reached   bool            `json:"reached"`
+    Hops      []TracerouteHop `json:"hops"`
+}
+
+// TracerouteHop struct for the probes sent with one TTL
+type TracerouteHop struct {
+    TTL     int             `json:"ttl"`
+    Address string          `json:"address,omitempty"` // destination or first address that answered
+    Name    string          `json:"name,omitempty"`    // reverse DNS name of address
+    Rtts    []time.Duration `json:"rtts"`              // one per answered probe
+    Lost    int             `json:"lost"`
+}
+
+func (c *commander) Traceroute(ctx context.Context, host string, opts TracerouteOptions) (TracerouteResult, error) {
+    opts = opts.withDefaults()
+
+    if err := ctx.Err(); err != nil {
+        return TracerouteResult{Host: host, Mode: opts.Mode, Status: pingStatus(err)}, err
+    }
+
+    ips, err := resolveHost(ctx, host, opts.Family)
+    if ctx.Err() != nil {
+        return TracerouteResult{Host: host, Mode: opts.Mode, Status: pingStatus(ctx.Err())}, ctx.Err()
+    }
+    if err != nil {
+        return TracerouteResult{}, fmt.Errorf("%w %s: %v", ErrUnresolvableHost, host, err)
+    }
+    // only the destination is checked, the hops on the way are not targets
+    ips, err = c.filterTargets(ctx, host, ips)
+    if err != nil {
+        log.Printf("Refused traceroute to %s: %v\n", host, err)
+        return TracerouteResult{}, err
+    }
+
+    t, err := newTracer(ips[0], opts)
+    if err != nil {
+        return TracerouteResult{}, fmt.Errorf("failed to traceroute target host: %w", err)
+    }
+    defer t.close()
+
+    result := TracerouteResult{
+        Host:      host,
+        IPAddress: ips[0].String(),
+        Family:    ipFamily(ips[0]),
+        Mode:      opts.Mode,
+        Hops:      []TracerouteHop{},
+    }
+    log.Printf("TRACEROUTE %s (%s), %d hops max\n", host, ips[0], opts.MaxHops)
+    for ttl := 1; ttl <= opts.MaxHops; ttl++ {
+        hop, done, err := t.hop(ctx, ttl)
+        if ctx.Err() != nil {
+            break
+        }
+        if err != nil {
+            return TracerouteResult{}, fmt.Errorf("failed to traceroute target host: %w", err)
+        }
+        debugf("%d %s %v\n", hop.TTL, hop.Address, hop.Rtts)
+        result.Hops = append(result.Hops, hop)
+        if done {
+            result.Reached = hop.Address == result.IPAddress
+            break
+        }
+    }
+    if err := ctx.Err(); err != nil {
+        result.Status = pingStatus(err)
+        return result, err
+    }
+    lookupHopNames(ctx, result.Hops)
+    result.Status = PingStatusCompleted
+    return result, nil
+}
+
+// lookupHopNames fills in the reverse DNS name of every hop, a hop without
+// a name is left blank
+func lookupHopNames(ctx context.Context, hops []TracerouteHop) {
+    ctx, cancel := context.WithTimeout(ctx, tracerouteLookupTimeout)
+    defer cancel()
+
+    names := make(map[string]string)
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    for _, hop := range hops {
+        if _, ok := names[hop.Address]; ok || hop.Address == "" {
+            continue
+        }
+        names[hop.Address] = ""
+        wg.Add(1)
+        go func(address string) {
+            defer wg.Done()
+            found, err := lookupAddr(ctx, address)
+            if err != nil || len(found) == 0 {
+                return
+            }
+            mu.Lock()
+            names[address] = strings.TrimSuffix(found[0], ".")
+            mu.Unlock()
+        }(hop.Address)
+    }
+    wg.Wait()
+    for i := range hops {
+        hops[i].Name = names[hops[i].Address]
+    }
+}
+
+// tracer sends the probes of one traceroute and matches the replies to them
+type tracer struct {
+    ip     net.IP
+    opts   TracerouteOptions
+    proto  int             // ICMP protocol number of the replies
+    id     int             // echo identifier in ICMP mode
+    conn   net.PacketConn  // raw ICMP socket, sends the probes in ICMP mode
+    udp    net.PacketConn  // sends the probes in UDP mode
+    setTTL func(int) error // sets the TTL of the probes sent next
+    sport  int             // source port of the UDP probes
+    seq    int             // sequence number of the next probe, the port limit keeps it in 16 bits
+}
+
+// probeData is the payload of every probe
+var probeData = []byte("espresso-commander traceroute")
+
+// newTracer opens the sockets to trace the route to ip with, replies are
+// always read from a raw ICMP socket as unprivileged ICMP sockets are not
+// passed the Time Exceeded errors of the routers on the way on Linux
+func newTracer(ip net.IP, opts TracerouteOptions) (*tracer, error) {
+    t := &tracer{ip: ip, opts: opts, id: rand.Intn(0xffff) + 1}
+    network, address := "ip4:icmp", "0.0.0.0"
+    t.proto = 1
+    if ipFamily(ip) == FamilyIPv6 {
+        network, address = "ip6:ipv6-icmp", "::"
+        t.proto = 58
+    }
+    conn, err := icmp.ListenPacket(network, address)
+    if err != nil {
+        return nil, err
+    }
+    t.conn = conn
+    if t.proto == 1 {
+        t.setTTL = conn.IPv4PacketConn().SetTTL
+    } else {
+        t.setTTL = conn.IPv6PacketConn().SetHopLimit
+    }
+    if opts.Mode == TracerouteUDP {
+        t.udp, err = net.ListenPacket("udp", net.JoinHostPort(address, "0"))
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        t.sport = t.udp.LocalAddr().(*net.UDPAddr).Port
+        if t.proto == 1 {
+            t.setTTL = ipv4.NewPacketConn(t.udp).SetTTL
+        } else {
+            t.setTTL = ipv6.NewPacketConn(t.udp).SetHopLimit
+        }
+    }
+    return t, nil
+}
+
+func (t *tracer) close() {
+    t.conn.Close()
+    if t.udp != nil {
+        t.udp.Close()
+    }
+}
+
+// hop sends every probe with ttl and waits up to the timeout for their
+// replies, done is true once the destination or a router reporting it as
+// unreachable answered
+func (t *tracer) hop(ctx context.Context, ttl int) (TracerouteHop, bool, error) {
+    hop := TracerouteHop{TTL: ttl, Rtts: []time.Duration{}}
+    sent := make(map[int]time.Time)
+    for i := 0; i < t.opts.Probes; i++ {
+        if err := t.send(ttl); err != nil {
+            return hop, false, err
+        }
+        sent[t.seq] = time.Now()
+        t.seq++
+    }
+
+    // stop waiting as soon as ctx is done
+    err := t.conn.SetReadDeadline(time.Now().Add(time.Duration(t.opts.Timeout)))
+    if err != nil {
+        return hop, false, err
+    }
+    stop := context.AfterFunc(ctx, func() {
+        t.conn.SetReadDeadline(time.Now())
+    })
+    defer stop()
+
+    done := false
+    buf := make([]byte, 1500)
+    for len(hop.Rtts) < t.opts.Probes {
+        n, peer, err := t.conn.ReadFrom(buf)
+        var netErr net.Error
+        if errors.As(err, &netErr) && netErr.Timeout() {
+            break
+        } else if err != nil {
+            return hop, false, err
+        }
+        seq, last, ok := t.match(buf[:n])
+        if !ok {
+            continue
+        }
+        at, ok := sent[seq]
+        if !ok {
+            // a late reply to an earlier hop
+            continue
+        }
+        delete(sent, seq)
+        hop.Rtts = append(hop.Rtts, time.Since(at))
+        from := peerIP(peer)
+        if hop.Address == "" || (last && from.Equal(t.ip)) {
+            hop.Address = from.String()
+        }
+        done = done || last
+    }
+    hop.Lost = t.opts.Probes - len(hop.Rtts)
+    return hop, done, nil
+}
+
+// send sends the next probe with ttl
+func (t *tracer) send(ttl int) error {
+    if err := t.setTTL(ttl); err != nil {
+        return err
+    }
+    if t.opts.Mode == TracerouteUDP {
+        _, err := t.udp.WriteTo(probeData, &net.UDPAddr{IP: t.ip, Port: t.opts.Port + t.seq})
+        return err
+    }
+
+    msg := icmp.Message{
+        Type: ipv4.ICMPTypeEcho,
+        Body: &icmp.Echo{ID: t.id, Seq: t.seq, Data: probeData},
+    }
+    if t.proto == 58 {
+        msg.Type = ipv6.ICMPTypeEchoRequest
+    }
+    b, err := msg.Marshal(nil)
+    if err != nil {
+        return err
+    }
+    _, err = t.conn.WriteTo(b, &net.IPAddr{IP: t.ip})
+    return err
+}
+
+// match finds the probe an ICMP message answers, last is true when the
+// message ends the trace
+func (t *tracer) match(b []byte) (seq int, last bool, ok bool) {
+    msg, err := icmp.ParseMessage(t.proto, b)
+    if err != nil {
+        return 0, false, false
+    }
+    var quoted []byte
+    switch body := msg.Body.(type) {
+    case *icmp.Echo:
+        if t.opts.Mode != TracerouteICMP || (msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply) {
+            return 0, false, false
+        }
+        if body.ID != t.id {
+            return 0, false, false
+        }
+        return body.Seq, true, true
+    case *icmp.TimeExceeded:
+        quoted = body.Data
+    case *icmp.DstUnreach:
+        quoted, last = body.Data, true
+    default:
+        return 0, false, false
+    }
+    seq, ok = t.matchQuoted(quoted)
+    return seq, last, ok
+}
+
+// matchQuoted finds the probe in the start of the packet quoted by an ICMP
+// error
+func (t *tracer) matchQuoted(b []byte) (int, bool) {
+    var proto int
+    var dst net.IP
+    if t.proto == 1 {
+        if len(b) < ipv4.HeaderLen {
+            return 0, false
+        }
+        headerLen := int(b[0]&0x0f) * 4
+        if len(b) < headerLen+8 {
+            return 0, false
+        }
+        proto, dst, b = int(b[9]), net.IP(b[16:20]), b[headerLen:]
+    } else {
+        if len(b) < ipv6.HeaderLen+8 {
+            return 0, false
+        }
+        proto, dst, b = int(b[6]), net.IP(b[24:40]), b[ipv6.HeaderLen:]
+    }
+    if !dst.Equal(t.ip) {
+        return 0, false
+    }
+
+    if t.opts.Mode == TracerouteUDP {
+        sport, dport := int(binary.BigEndian.Uint16(b[0:2])), int(binary.BigEndian.Uint16(b[2:4]))
+        if proto != 17 || sport != t.sport || dport < t.opts.Port {
+            return 0, false
+        }
+        return dport - t.opts.Port, true
+    }
+    if proto != t.proto || (b[0] != byte(ipv4.ICMPTypeEcho) && b[0] != byte(ipv6.ICMPTypeEchoRequest)) {
+        return 0, false
+    }
+    if int(binary.BigEndian.Uint16(b[4:6])) != t.id {
+        return 0, false
+    }
+    return int(binary.BigEndian.Uint16(b[6:8])), true
+}
+
+// peerIP returns the address of the host a reply came from
+func peerIP(addr net.Addr) net.IP {
+    switch a := addr.(type) {
+    case *net.IPAddr:
+        return a.IP
+    case *net.UDPAddr:
+        return a.IP
+    }
+    return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestTracerouteOptions_Validate(t *testing.T) {
+	limits := DefaultTracerouteLimits
+	pingLimits := DefaultPingLimits
+
+	tests := []struct {
+		name    string
+		opts    TracerouteOptions
+		wantErr bool
+	}{
+		{name: "defaults", opts: TracerouteOptions{}},
+		{name: "udp", opts: TracerouteOptions{Mode: TracerouteUDP, Port: 40000}},
+		{name: "at limits", opts: TracerouteOptions{MaxHops: 64, Probes: 10, Timeout: Duration(5 * time.Second), Family: FamilyIPv6}},
+		{name: "unknown mode", opts: TracerouteOptions{Mode: "tcp"}, wantErr: true},
+		{name: "too many hops", opts: TracerouteOptions{MaxHops: 65}, wantErr: true},
+		{name: "too many probes", opts: TracerouteOptions{Probes: 11}, wantErr: true},
+		{name: "timeout too long", opts: TracerouteOptions{Timeout: Duration(time.Minute)}, wantErr: true},
+		{name: "ports run out", opts: TracerouteOptions{Mode: TracerouteUDP, Port: 65500}, wantErr: true},
+		{name: "unknown family", opts: TracerouteOptions{Family: "ipx"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate(limits, pingLimits)
+			if tt.wantErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	pingLimits.AllowPrivileged = false
+	if err := (TracerouteOptions{}).Validate(limits, pingLimits); err == nil {
+		t.Error("expected traceroute to need privileged mode")
+	}
+}
+
+// quote builds the start of a probe as an ICMP error quotes it
+func quote(src, dst net.IP, proto int, payload []byte) []byte {
+	if dst.To4() != nil {
+		h := ipv4.Header{Version: 4, Len: ipv4.HeaderLen, TotalLen: ipv4.HeaderLen + len(payload), TTL: 1, Protocol: proto, Src: src, Dst: dst}
+		b, _ := h.Marshal()
+		return append(b, payload...)
+	}
+	b := make([]byte, ipv6.HeaderLen)
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6], b[7] = byte(proto), 1
+	copy(b[8:24], src)
+	copy(b[24:40], dst)
+	return append(b, payload...)
+}
+
+// echoProbe is the start of an echo request probe
+func echoProbe(typ icmp.Type, id, seq int) []byte {
+	b, _ := (&icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Seq: seq, Data: probeData}}).Marshal(nil)
+	return b[:8]
+}
+
+// udpProbe is the UDP header of a probe
+func udpProbe(sport, dport int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[0:2], uint16(sport))
+	binary.BigEndian.PutUint16(b[2:4], uint16(dport))
+	return b
+}
+
+func marshal(typ icmp.Type, body icmp.MessageBody) []byte {
+	b, _ := (&icmp.Message{Type: typ, Body: body}).Marshal(nil)
+	return b
+}
+
+func TestTracer_Match(t *testing.T) {
+	src, dst, other := net.ParseIP("192.168.1.2"), net.ParseIP("203.0.113.9"), net.ParseIP("203.0.113.10")
+	src6, dst6 := net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8:1::9")
+	icmp4 := TracerouteOptions{Mode: TracerouteICMP, Port: 33434}
+	udp4 := TracerouteOptions{Mode: TracerouteUDP, Port: 33434}
+
+	tests := []struct {
+		name   string
+		tracer tracer
+		msg    []byte
+		seq    int
+		last   bool
+		ok     bool
+	}{
+		{
+			name:   "echo reply",
+			tracer: tracer{ip: dst, opts: icmp4, proto: 1, id: 7},
+			msg:    marshal(ipv4.ICMPTypeEchoReply, &icmp.Echo{ID: 7, Seq: 4}),
+			seq:    4, last: true, ok: true,
+		},
+		{
+			name:   "echo reply to another process",
+			tracer: tracer{ip: dst, opts: icmp4, proto: 1, id: 7},
+			msg:    marshal(ipv4.ICMPTypeEchoReply, &icmp.Echo{ID: 8, Seq: 4}),
+		},
+		{
+			name:   "time exceeded for an echo request",
+			tracer: tracer{ip: dst, opts: icmp4, proto: 1, id: 7},
+			msg:    marshal(ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote(src, dst, 1, echoProbe(ipv4.ICMPTypeEcho, 7, 5))}),
+			seq:    5, ok: true,
+		},
+		{
+			name:   "time exceeded for another destination",
+			tracer: tracer{ip: dst, opts: icmp4, proto: 1, id: 7},
+			msg:    marshal(ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote(src, other, 1, echoProbe(ipv4.ICMPTypeEcho, 7, 5))}),
+		},
+		{
+			name:   "host unreachable",
+			tracer: tracer{ip: dst, opts: icmp4, proto: 1, id: 7},
+			msg:    marshal(ipv4.ICMPTypeDestinationUnreachable, &icmp.DstUnreach{Data: quote(src, dst, 1, echoProbe(ipv4.ICMPTypeEcho, 7, 9))}),
+			seq:    9, last: true, ok: true,
+		},
+		{
+			name:   "time exceeded for a UDP probe",
+			tracer: tracer{ip: dst, opts: udp4, proto: 1, sport: 40000},
+			msg:    marshal(ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote(src, dst, 17, udpProbe(40000, 33440))}),
+			seq:    6, ok: true,
+		},
+		{
+			name:   "port unreachable for a UDP probe",
+			tracer: tracer{ip: dst, opts: udp4, proto: 1, sport: 40000},
+			msg:    marshal(ipv4.ICMPTypeDestinationUnreachable, &icmp.DstUnreach{Data: quote(src, dst, 17, udpProbe(40000, 33434))}),
+			seq:    0, last: true, ok: true,
+		},
+		{
+			name:   "UDP probe from another socket",
+			tracer: tracer{ip: dst, opts: udp4, proto: 1, sport: 40000},
+			msg:    marshal(ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote(src, dst, 17, udpProbe(40001, 33440))}),
+		},
+		{
+			name:   "echo reply in UDP mode",
+			tracer: tracer{ip: dst, opts: udp4, proto: 1, sport: 40000},
+			msg:    marshal(ipv4.ICMPTypeEchoReply, &icmp.Echo{Seq: 1}),
+		},
+		{
+			name:   "IPv6 time exceeded",
+			tracer: tracer{ip: dst6, opts: icmp4, proto: 58, id: 7},
+			msg:    marshal(ipv6.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote(src6, dst6, 58, echoProbe(ipv6.ICMPTypeEchoRequest, 7, 3))}),
+			seq:    3, ok: true,
+		},
+		{
+			name:   "IPv6 port unreachable",
+			tracer: tracer{ip: dst6, opts: udp4, proto: 58, sport: 40000},
+			msg:    marshal(ipv6.ICMPTypeDestinationUnreachable, &icmp.DstUnreach{Data: quote(src6, dst6, 17, udpProbe(40000, 33436))}),
+			seq:    2, last: true, ok: true,
+		},
+		{
+			name:   "truncated quote",
+			tracer: tracer{ip: dst, opts: icmp4, proto: 1, id: 7},
+			msg:    marshal(ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quote(src, dst, 1, nil)}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seq, last, ok := tt.tracer.match(tt.msg)
+			if ok != tt.ok || (ok && (seq != tt.seq || last != tt.last)) {
+				t.Errorf("expected seq %d last %v ok %v, got %d %v %v", tt.seq, tt.last, tt.ok, seq, last, ok)
+			}
+		})
+	}
+}
+
+// routeConn is a raw ICMP socket on a route through routers to dst, each
+// echo request is answered by the router its TTL runs out at or by dst
+type routeConn struct {
+	net.PacketConn
+	dst      net.IP
+	routers  []net.IP // nil entries drop the probe
+	ttl      int
+	replies  chan routeReply
+	deadline time.Time
+}
+
+type routeReply struct {
+	from net.IP
+	msg  []byte
+}
+
+func newRouteConn(dst net.IP, routers ...net.IP) *routeConn {
+	return &routeConn{dst: dst, routers: routers, replies: make(chan routeReply, 100)}
+}
+
+func (c *routeConn) setTTL(ttl int) error {
+	c.ttl = ttl
+	return nil
+}
+
+func (c *routeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	msg, err := icmp.ParseMessage(1, b)
+	if err != nil {
+		return 0, err
+	}
+	echo := msg.Body.(*icmp.Echo)
+	switch {
+	case c.ttl > len(c.routers):
+		c.replies <- routeReply{c.dst, marshal(ipv4.ICMPTypeEchoReply, &icmp.Echo{ID: echo.ID, Seq: echo.Seq})}
+	case c.routers[c.ttl-1] != nil:
+		quoted := quote(net.ParseIP("192.168.1.2"), c.dst, 1, b)
+		c.replies <- routeReply{c.routers[c.ttl-1], marshal(ipv4.ICMPTypeTimeExceeded, &icmp.TimeExceeded{Data: quoted})}
+	}
+	return len(b), nil
+}
+
+func (c *routeConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case r := <-c.replies:
+		return copy(b, r.msg), &net.IPAddr{IP: r.from}, nil
+	case <-time.After(time.Until(c.deadline)):
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *routeConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func TestTracer_Hop(t *testing.T) {
+	dst, router := net.ParseIP("203.0.113.9"), net.ParseIP("192.168.1.1")
+	conn := newRouteConn(dst, router, nil)
+	tr := &tracer{
+		ip:     dst,
+		opts:   TracerouteOptions{Mode: TracerouteICMP, Probes: 3, Timeout: Duration(50 * time.Millisecond)},
+		proto:  1,
+		id:     7,
+		conn:   conn,
+		setTTL: conn.setTTL,
+	}
+
+	hop, done, err := tr.hop(context.Background(), 1)
+	if err != nil || done {
+		t.Fatalf("expected an intermediate hop, got done %v err %v", done, err)
+	}
+	if hop.Address != "192.168.1.1" || len(hop.Rtts) != 3 || hop.Lost != 0 {
+		t.Errorf("expected the router to answer every probe, got %+v", hop)
+	}
+
+	hop, done, err = tr.hop(context.Background(), 2)
+	if err != nil || done {
+		t.Fatalf("expected a silent hop, got done %v err %v", done, err)
+	}
+	if hop.Address != "" || len(hop.Rtts) != 0 || hop.Lost != 3 {
+		t.Errorf("expected every probe to be lost, got %+v", hop)
+	}
+
+	hop, done, err = tr.hop(context.Background(), 3)
+	if err != nil || !done {
+		t.Fatalf("expected the destination to end the trace, got done %v err %v", done, err)
+	}
+	if hop.Address != "203.0.113.9" || len(hop.Rtts) != 3 {
+		t.Errorf("expected the destination to answer, got %+v", hop)
+	}
+}
+
+func TestCommander_Traceroute(t *testing.T) {
+	defer func(orig func(context.Context, string) ([]string, error)) { lookupAddr = orig }(lookupAddr)
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		return []string{"localhost."}, nil
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("raw sockets need root")
+	}
+	tests := []struct {
+		name string
+		opts TracerouteOptions
+	}{
+		{name: "icmp", opts: TracerouteOptions{Mode: TracerouteICMP}},
+		{name: "udp", opts: TracerouteOptions{Mode: TracerouteUDP}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := NewCommander().Traceroute(context.Background(), "127.0.0.1", tt.opts)
+			skipIfPermissionDenied(t, err)
+			if err != nil {
+				t.Fatalf("Traceroute returned error: %v", err)
+			}
+			if !result.Reached || result.Status != PingStatusCompleted || result.Mode != tt.opts.Mode {
+				t.Errorf("expected 127.0.0.1 to be reached, got %+v", result)
+			}
+			if len(result.Hops) != 1 {
+				t.Fatalf("expected a single hop, got %+v", result.Hops)
+			}
+			hop := result.Hops[0]
+			if hop.TTL != 1 || hop.Address != "127.0.0.1" || hop.Name != "localhost" || len(hop.Rtts)+hop.Lost != 3 || len(hop.Rtts) == 0 {
+				t.Errorf("unexpected hop %+v", hop)
+			}
+		})
+	}
+}
+
+func TestCommander_TracerouteErrors(t *testing.T) {
+	cmdr := NewCommander(WithTargetFilter(NewTargetFilter(TargetsConfig{Deny: []string{"127.0.0.0/8"}})))
+	if _, err := cmdr.Traceroute(context.Background(), "127.0.0.1", TracerouteOptions{}); !errors.Is(err, ErrTargetRefused) {
+		t.Errorf("expected the target to be refused, got %v", err)
+	}
+	if _, err := cmdr.Traceroute(context.Background(), "999.999.999.999", TracerouteOptions{}); !errors.Is(err, ErrUnresolvableHost) {
+		t.Errorf("expected ErrUnresolvableHost, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := cmdr.Traceroute(ctx, "127.0.0.1", TracerouteOptions{})
+	if !errors.Is(err, context.Canceled) || result.Status != PingStatusCancelled {
+		t.Errorf("expected a cancelled traceroute, got %+v %v", result, err)
+	}
+}
+
+func TestTracerouteCommand(t *testing.T) {
+	hops := TracerouteResult{
+		Host:      "example.com",
+		IPAddress: "93.184.216.34",
+		Status:    PingStatusTimedOut,
+		Hops:      []TracerouteHop{{TTL: 1, Address: "192.168.1.1", Rtts: []time.Duration{time.Millisecond}}},
+	}
+
+	tests := []struct {
+		name    string
+		cmdr    *mockCommander
+		options string
+		status  int
+		success bool
+	}{
+		{
+			name:    "reached",
+			cmdr:    &mockCommander{traceResult: TracerouteResult{Reached: true, Status: PingStatusCompleted}},
+			options: `{"mode":"icmp","max_hops":20,"timeout":"2s","probes":1}`,
+			status:  http.StatusOK,
+			success: true,
+		},
+		{
+			name:    "not reached",
+			cmdr:    &mockCommander{traceResult: TracerouteResult{Status: PingStatusCompleted}},
+			status:  http.StatusOK,
+			success: true,
+		},
+		{
+			name:    "too many hops",
+			cmdr:    &mockCommander{},
+			options: `{"max_hops":100}`,
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:   "timed out",
+			cmdr:   &mockCommander{traceResult: hops, traceError: context.DeadlineExceeded},
+			status: http.StatusGatewayTimeout,
+		},
+		{
+			name:   "socket error",
+			cmdr:   &mockCommander{traceError: errors.New("failed to traceroute target host: socket: operation not permitted")},
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"type":"traceroute","payload":"example.com"`
+			if tt.options != "" {
+				body += `,"options":` + tt.options
+			}
+			rec := httptest.NewRecorder()
+			handleCommand(newTestServer(t, tt.cmdr, DefaultConfig()))(rec, httptest.NewRequest("POST", "/execute", strings.NewReader(body+"}")))
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body)
+			}
+			if tt.success != strings.Contains(rec.Body.String(), `"success":true`) {
+				t.Errorf("expected success %v, got %s", tt.success, rec.Body)
+			}
+			if tt.success && strings.Contains(rec.Body.String(), `"reached":true`) != tt.cmdr.traceResult.Reached {
+				t.Errorf("expected reached %v, got %s", tt.cmdr.traceResult.Reached, rec.Body)
+			}
+			if tt.status == http.StatusGatewayTimeout && !strings.Contains(rec.Body.String(), `"address":"192.168.1.1"`) {
+				t.Errorf("expected the hops found before the timeout, got %s", rec.Body)
+			}
+		})
+	}
+
+	cmdr := &mockCommander{}
+	rec := httptest.NewRecorder()
+	handleCommand(newTestServer(t, cmdr, DefaultConfig()))(rec, httptest.NewRequest("POST", "/execute",
+		strings.NewReader(`{"type":"traceroute","payload":"example.com","options":{"max_hops":20,"probes":1}}`)))
+	if cmdr.traceHost != "example.com" || cmdr.traceOptions.MaxHops != 20 || cmdr.traceOptions.Probes != 1 {
+		t.Errorf("expected the host and options to be passed on, got %s %+v", cmdr.traceHost, cmdr.traceOptions)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+    "os"
+    "time"
+)
+
+// watchFiles calls reload in the background whenever the modification time
+// of one of paths changes, until stop is closed. A failed reload is retried
+// every interval until it succeeds
+func watchFiles(stop <-chan struct{}, interval time.Duration, paths []string, reload func() error) {
+    modTimes := func() []time.Time {
+        times := make([]time.Time, len(paths))
+        for i, path := range paths {
+            if info, err := os.Stat(path); err == nil {
+                times[i] = info.ModTime()
+            }
+        }
+        return times
+    }
+    last := modTimes()
+
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
+                current := modTimes()
+                changed := false
+                for i := range current {
+                    if !current[i].Equal(last[i]) {
+                        changed = true
+                    }
+                }
+                if changed && reload() == nil {
+                    last = current
+                }
+            }
+        }
+    }()
+}
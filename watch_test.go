@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchFiles_RetriesFailedReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var calls atomic.Int32
+	done := make(chan struct{})
+	watchFiles(stop, 5*time.Millisecond, []string{path}, func() error {
+		// fail twice, as if the file was read half written
+		switch calls.Add(1) {
+		case 1, 2:
+			return errors.New("unexpected end of JSON input")
+		case 3:
+			close(done)
+		}
+		return nil
+	})
+
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the reload to be retried, got %d calls", calls.Load())
+	}
+
+	// once it succeeded the file is not reloaded again until it changes
+	time.Sleep(50 * time.Millisecond)
+	if got := calls.Load(); got != 3 {
+		t.Errorf("expected 3 reloads, got %d", got)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/coder/websocket"
+    "github.com/coder/websocket/wsjson"
+)
+
+// wsWriteTimeout bounds how long a slow client can hold up a command that
+// is sending it events
+const wsWriteTimeout = 10 * time.Second
+
+// wsRequest struct for a message from a WebSocket client, either a command
+// to run or, with cancel set, the ID of a running command to stop
+type wsRequest struct {
+    ID     string `json:"id"`
+    Cancel bool   `json:"cancel,omitempty"`
+    CommandRequest
+}
+
+// wsMessage struct for a message to a WebSocket client, event is a ping
+// event type with a PingEvent in data, or result or error with the
+// CommandResponse
+type wsMessage struct {
+    ID    string      `json:"id"`
+    Event string      `json:"event"`
+    Data  interface{} `json:"data"`
+}
+
+// wsSession struct for the commands running on one connection
+type wsSession struct {
+    s    *Server
+    conn *websocket.Conn
+
+    mu      sync.Mutex
+    running map[string]context.CancelFunc
+    wg      sync.WaitGroup
+}
+
+// handleWebSocket runs every CommandRequest sent over the connection at the
+// same time, results are sent as they happen tagged with the request's ID
+func handleWebSocket(s *Server) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        conn, err := websocket.Accept(w, r, nil)
+        if err != nil {
+            // Accept has already written the response
+            log.Printf("WebSocket upgrade failed: %v\n", err)
+            return
+        }
+        conn.SetReadLimit(MaxBodyBytes)
+        principal := principalFrom(r.Context())
+        log.Printf("WebSocket opened for %s\n", principal.Label)
+
+        // commands keep the caller and client address of the upgrade
+        // request and stop when the connection closes
+        ctx, cancel := context.WithCancel(r.Context())
+        session := &wsSession{s: s, conn: conn, running: make(map[string]context.CancelFunc)}
+        err = session.serve(ctx)
+        cancel()
+        session.wg.Wait()
+
+        var closeErr websocket.CloseError
+        if errors.As(err, &closeErr) || errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
+            conn.Close(websocket.StatusNormalClosure, "")
+        } else {
+            log.Printf("WebSocket for %s failed: %v\n", principal.Label, err)
+            conn.Close(websocket.StatusInternalError, "")
+        }
+        log.Printf("WebSocket closed for %s\n", principal.Label)
+    }
+}
+
+// serve reads requests until the connection closes
+func (ws *wsSession) serve(ctx context.Context) error {
+    for {
+        _, data, err := ws.conn.Read(ctx)
+        if err != nil {
+            return err
+        }
+        var req wsRequest
+        err = json.Unmarshal(data, &req)
+        if err != nil {
+            ws.fail(ctx, "", NewCommandError(ErrCodeInvalidJSON, err))
+            continue
+        }
+        if req.ID == "" {
+            ws.fail(ctx, "", NewCommandError(ErrCodeInvalidRequest, errors.New("id is required")))
+            continue
+        }
+        if req.Cancel {
+            ws.cancel(ctx, req.ID)
+            continue
+        }
+        ws.start(ctx, req)
+    }
+}
+
+// start runs req in the background unless its ID is already running
+func (ws *wsSession) start(ctx context.Context, req wsRequest) {
+    ws.mu.Lock()
+    if _, ok := ws.running[req.ID]; ok {
+        ws.mu.Unlock()
+        // replied from the read loop, so it is done before the session is
+        // torn down
+        ws.fail(ctx, req.ID, NewCommandError(ErrCodeInvalidRequest, fmt.Errorf("id %q is already running", req.ID)))
+        return
+    }
+    defer ws.mu.Unlock()
+    cmdCtx, cancel := context.WithCancel(ctx)
+    ws.running[req.ID] = cancel
+    ws.wg.Add(1)
+    go func() {
+        defer ws.wg.Done()
+        defer func() {
+            ws.mu.Lock()
+            delete(ws.running, req.ID)
+            ws.mu.Unlock()
+            cancel()
+        }()
+        defer func() {
+            if rec := recover(); rec != nil {
+                panicsRecovered.Add(1)
+                log.Printf("Recovered from panic in WebSocket command %s: %v\n", req.ID, rec)
+                ws.fail(ctx, req.ID, NewCommandError(ErrCodeInternal, fmt.Errorf("%v", rec)))
+            }
+        }()
+
+        cmdCtx = WithPingObserver(cmdCtx, func(e PingEvent) {
+            ws.send(ctx, wsMessage{ID: req.ID, Event: e.Type, Data: e})
+        })
+        res, err := ws.s.Execute(cmdCtx, req.CommandRequest)
+        if err != nil {
+            ws.failWithData(ctx, req.ID, err, res.Data)
+            return
+        }
+        ws.send(ctx, wsMessage{ID: req.ID, Event: "result", Data: res})
+    }()
+}
+
+// cancel stops the command running with id
+func (ws *wsSession) cancel(ctx context.Context, id string) {
+    ws.mu.Lock()
+    cancel, ok := ws.running[id]
+    ws.mu.Unlock()
+    if !ok {
+        ws.fail(ctx, id, NewCommandError(ErrCodeNotFound, fmt.Errorf("no command running with id %q", id)))
+        return
+    }
+    // the command answers with a cancelled error once it stops
+    cancel()
+}
+
+// fail sends err for the request with id
+func (ws *wsSession) fail(ctx context.Context, id string, err error) {
+    ws.failWithData(ctx, id, err, nil)
+}
+
+// failWithData sends err and any partial result for the request with id
+func (ws *wsSession) failWithData(ctx context.Context, id string, err error, data interface{}) {
+    ws.send(ctx, wsMessage{ID: id, Event: "error", Data: errorResponse(err, data)})
+}
+
+// send writes msg, closing the connection if the client does not keep up
+// or the write fails
+func (ws *wsSession) send(ctx context.Context, msg wsMessage) {
+    ctx, cancel := context.WithTimeout(ctx, wsWriteTimeout)
+    defer cancel()
+    err := wsjson.Write(ctx, ws.conn, msg)
+    if err != nil && !errors.Is(err, context.Canceled) {
+        log.Printf("Failed to write WebSocket message: %v\n", err)
+        ws.conn.Close(websocket.StatusPolicyViolation, "write failed")
+    }
+}
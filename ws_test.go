@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// wsTestMessage is a wsMessage with data left to decode
+type wsTestMessage struct {
+	ID    string          `json:"id"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// dialWS opens /ws on ts with an optional API key
+func dialWS(t *testing.T, ts *httptest.Server, key string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	opts := &websocket.DialOptions{HTTPHeader: http.Header{}}
+	if key != "" {
+		opts.HTTPHeader.Set("Authorization", "Bearer "+key)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", opts)
+	if err == nil {
+		t.Cleanup(func() { conn.CloseNow() })
+	}
+	return conn, resp, err
+}
+
+// sendWS writes a raw message
+func sendWS(t *testing.T, conn *websocket.Conn, msg string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Write(ctx, websocket.MessageText, []byte(msg)); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
+
+// readWS reads the next message
+func readWS(t *testing.T, conn *websocket.Conn) wsTestMessage {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var msg wsTestMessage
+	if err := wsjson.Read(ctx, conn, &msg); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return msg
+}
+
+// responseCode returns the error code of a result or error message
+func responseCode(t *testing.T, msg wsTestMessage) ErrorCode {
+	t.Helper()
+	var res CommandResponse
+	if err := json.Unmarshal(msg.Data, &res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return res.Code
+}
+
+func TestWebSocket_Multiplexed(t *testing.T) {
+	cmdr := &cancellableCommander{started: make(chan struct{}, 1), release: make(chan struct{})}
+	ts := httptest.NewServer(handleRequests(newTestServer(t, cmdr, DefaultConfig())))
+	defer ts.Close()
+	conn, _, err := dialWS(t, ts, "")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+
+	sendWS(t, conn, `{"id":"slow","type":"ping","payload":"127.0.0.1"}`)
+	<-cmdr.started
+	sendWS(t, conn, `{"id":"info","type":"sysinfo"}`)
+	msg := readWS(t, conn)
+	if msg.ID != "info" || msg.Event != "result" {
+		t.Fatalf("expected the sysinfo result while the ping runs, got %+v", msg)
+	}
+
+	sendWS(t, conn, `{"id":"slow","cancel":true}`)
+	msg = readWS(t, conn)
+	if msg.ID != "slow" || msg.Event != "error" || responseCode(t, msg) != ErrCodeCancelled {
+		t.Errorf("expected the ping to be cancelled, got %+v %s", msg, msg.Data)
+	}
+}
+
+func TestWebSocket_Events(t *testing.T) {
+	ts := httptest.NewServer(handleRequests(newTestServer(t, &streamingCommander{events: testPingEvents}, DefaultConfig())))
+	defer ts.Close()
+	conn, _, err := dialWS(t, ts, "")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+
+	sendWS(t, conn, `{"id":"p1","type":"ping","payload":"example.com"}`)
+	for i, want := range []string{PingEventReply, PingEventDuplicate, PingEventTimeout, "result"} {
+		msg := readWS(t, conn)
+		if msg.ID != "p1" || msg.Event != want {
+			t.Errorf("message %d: expected p1 %s, got %s %s", i, want, msg.ID, msg.Event)
+		}
+	}
+}
+
+func TestWebSocket_Errors(t *testing.T) {
+	cmdr := &cancellableCommander{started: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(cmdr.release)
+	ts := httptest.NewServer(handleRequests(newTestServer(t, cmdr, DefaultConfig())))
+	defer ts.Close()
+	conn, _, err := dialWS(t, ts, "")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	sendWS(t, conn, `{"id":"busy","type":"ping","payload":"127.0.0.1"}`)
+	<-cmdr.started
+
+	tests := []struct {
+		name string
+		msg  string
+		id   string
+		code ErrorCode
+	}{
+		{"invalid json", `{"id":`, "", ErrCodeInvalidJSON},
+		{"missing id", `{"type":"sysinfo"}`, "", ErrCodeInvalidRequest},
+		{"unknown command", `{"id":"x","type":"reboot"}`, "x", ErrCodeUnknownCommand},
+		{"invalid payload", `{"id":"y","type":"ping","payload":""}`, "y", ErrCodeInvalidRequest},
+		{"id in use", `{"id":"busy","type":"sysinfo"}`, "busy", ErrCodeInvalidRequest},
+		{"cancel unknown", `{"id":"nothing","cancel":true}`, "nothing", ErrCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendWS(t, conn, tt.msg)
+			msg := readWS(t, conn)
+			if msg.ID != tt.id || msg.Event != "error" || responseCode(t, msg) != tt.code {
+				t.Errorf("expected %q error %s, got %+v %s", tt.id, tt.code, msg, msg.Data)
+			}
+		})
+	}
+}
+
+func TestWebSocket_Authentication(t *testing.T) {
+	ts := httptest.NewServer(handleRequests(newTestServer(t, &mockCommander{}, authConfig())))
+	defer ts.Close()
+
+	_, resp, err := dialWS(t, ts, "")
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a key, got %v", err)
+	}
+
+	conn, _, err := dialWS(t, ts, "monitor-secret")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	sendWS(t, conn, `{"id":"1","type":"ping","payload":"127.0.0.1"}`)
+	if msg := readWS(t, conn); responseCode(t, msg) != ErrCodeForbidden {
+		t.Errorf("expected the monitor key to be refused ping, got %s", msg.Data)
+	}
+	sendWS(t, conn, `{"id":"2","type":"sysinfo"}`)
+	if msg := readWS(t, conn); msg.Event != "result" {
+		t.Errorf("expected the monitor key to run sysinfo, got %+v", msg)
+	}
+}
+
+func TestWebSocket_CloseCancels(t *testing.T) {
+	cmdr := &streamingCommander{events: testPingEvents[:1], block: true, cancelled: make(chan struct{})}
+	ts := httptest.NewServer(handleRequests(newTestServer(t, cmdr, DefaultConfig())))
+	defer ts.Close()
+	conn, _, err := dialWS(t, ts, "")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+
+	sendWS(t, conn, `{"id":"p","type":"ping","payload":"example.com"}`)
+	if msg := readWS(t, conn); msg.Event != PingEventReply {
+		t.Fatalf("expected a reply event, got %+v", msg)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+	select {
+	case <-cmdr.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected closing the connection to stop the ping")
+	}
+}